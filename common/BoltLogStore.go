@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/coreos/bbolt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// 日志的根bucket, 下面按 命名空间/任务名 分bucket, key为自增序号
+	boltLogBucket = []byte("logs")
+)
+
+// 内嵌bolt数据库日志存储, 不需要额外部署数据库
+// bolt同一时间只允许一个进程写入, 每次操作时打开数据库、操作完立即关闭,
+// 这样同一台机器上的master和worker可以共用一个数据库文件; 打开是文件锁加mmap, 开销与日志量无关
+// 每个任务一个bucket, 按任务查询直接定位到该任务的bucket, 一个任务的日志全部读出后排序分页;
+// 不指定任务的查询和删除(按命名空间汇总、日志保留期清理)需要读取所有任务的日志, 日志量大时使用mongodb
+type BoltLogStore struct {
+	path  string
+	mutex sync.Mutex // 同一进程内重复打开同一个文件会互相等待文件锁, 进程内串行
+}
+
+// 初始化bolt日志存储
+func InitBoltLogStore(config *LogStoreConfig) (store *BoltLogStore, err error) {
+	store = &BoltLogStore{
+		path: config.BoltPath,
+	}
+	err = os.MkdirAll(filepath.Dir(store.path), 0755)
+	return
+}
+
+// 打开数据库执行操作, 其他进程占用超时时返回ERR_LOG_STORE_BUSY
+// 只读操作时数据库文件还不存在则不执行
+func (store *BoltLogStore) withDB(readOnly bool, handler func(db *bolt.DB) error) (err error) {
+	var (
+		db *bolt.DB
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if readOnly {
+		if _, err = os.Stat(store.path); os.IsNotExist(err) {
+			err = nil
+			return
+		}
+	}
+	if db, err = bolt.Open(store.path, 0644, &bolt.Options{
+		Timeout:  LOG_STORE_LOCK_TIMEOUT * time.Millisecond,
+		ReadOnly: readOnly,
+	}); err != nil {
+		if err == bolt.ErrTimeout {
+			err = ERR_LOG_STORE_BUSY
+		}
+		return
+	}
+	defer db.Close()
+	err = handler(db)
+	return
+}
+
+// 遍历满足条件的任务bucket
+func forEachLogBucket(tx *bolt.Tx, query *JobLogQuery, handler func(jobBucket *bolt.Bucket) error) (err error) {
+	var (
+		rootBucket *bolt.Bucket
+		nsBucket   *bolt.Bucket
+		jobBucket  *bolt.Bucket
+	)
+	if rootBucket = tx.Bucket(boltLogBucket); rootBucket == nil {
+		return
+	}
+	// 指定了任务时直接定位, 不遍历其他任务
+	if query.Namespace != "" && query.JobName != "" {
+		if nsBucket = rootBucket.Bucket([]byte(query.Namespace)); nsBucket == nil {
+			return
+		}
+		if jobBucket = nsBucket.Bucket([]byte(query.JobName)); jobBucket == nil {
+			return
+		}
+		return handler(jobBucket)
+	}
+	return rootBucket.ForEach(func(namespace []byte, value []byte) error {
+		var (
+			nsBucket *bolt.Bucket
+		)
+		// value不为空的是普通key, 不是bucket
+		if value != nil || (query.Namespace != "" && string(namespace) != query.Namespace) {
+			return nil
+		}
+		nsBucket = rootBucket.Bucket(namespace)
+		return nsBucket.ForEach(func(jobName []byte, value []byte) error {
+			if value != nil || (query.JobName != "" && string(jobName) != query.JobName) {
+				return nil
+			}
+			return handler(nsBucket.Bucket(jobName))
+		})
+	})
+}
+
+// 批量写入日志
+func (store *BoltLogStore) Append(logs []*JobLog) (err error) {
+	return store.withDB(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) (err error) {
+			var (
+				rootBucket *bolt.Bucket
+				nsBucket   *bolt.Bucket
+				jobBucket  *bolt.Bucket
+				jobLog     *JobLog
+				seq        uint64
+				key        []byte
+				value      []byte
+			)
+			if rootBucket, err = tx.CreateBucketIfNotExists(boltLogBucket); err != nil {
+				return
+			}
+			for _, jobLog = range logs {
+				if nsBucket, err = rootBucket.CreateBucketIfNotExists([]byte(NormalizeNamespace(jobLog.Namespace))); err != nil {
+					return
+				}
+				if jobBucket, err = nsBucket.CreateBucketIfNotExists([]byte(jobLog.JobName)); err != nil {
+					return
+				}
+				if seq, err = jobBucket.NextSequence(); err != nil {
+					return
+				}
+				if value, err = json.Marshal(jobLog); err != nil {
+					return
+				}
+				// 大端序号, key的顺序就是写入顺序
+				key = make([]byte, 8)
+				binary.BigEndian.PutUint64(key, seq)
+				if err = jobBucket.Put(key, value); err != nil {
+					return
+				}
+			}
+			return
+		})
+	})
+}
+
+// 查询日志: 读取满足条件的任务bucket后排序分页
+func (store *BoltLogStore) Query(query *JobLogQuery) (logList []*JobLog, err error) {
+	logList = make([]*JobLog, 0)
+	if err = store.withDB(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return forEachLogBucket(tx, query, func(jobBucket *bolt.Bucket) error {
+				return jobBucket.ForEach(func(key []byte, value []byte) error {
+					var (
+						jobLog *JobLog
+					)
+					jobLog = &JobLog{}
+					if json.Unmarshal(value, jobLog) == nil && query.Match(jobLog) {
+						logList = append(logList, jobLog)
+					}
+					return nil
+				})
+			})
+		})
+	}); err != nil {
+		return
+	}
+	logList = sortAndPageLogs(logList, query)
+	return
+}
+
+// 删除日志
+func (store *BoltLogStore) Delete(query *JobLogQuery) (deleted int64, err error) {
+	err = store.withDB(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			return forEachLogBucket(tx, query, func(jobBucket *bolt.Bucket) (err error) {
+				var (
+					cursor *bolt.Cursor
+					key    []byte
+					value  []byte
+					jobLog *JobLog
+					keys   [][]byte
+				)
+				// 遍历时删除会让游标跳过下一条, 先找出要删除的key
+				cursor = jobBucket.Cursor()
+				for key, value = cursor.First(); key != nil; key, value = cursor.Next() {
+					jobLog = &JobLog{}
+					if json.Unmarshal(value, jobLog) == nil && query.Match(jobLog) {
+						keys = append(keys, key)
+					}
+				}
+				for _, key = range keys {
+					if err = jobBucket.Delete(key); err != nil {
+						return
+					}
+					deleted++
+				}
+				return
+			})
+		})
+	})
+	return
+}
+
+// 每次操作后已经关闭数据库
+func (store *BoltLogStore) Close(ctx context.Context) (err error) {
+	return
+}
@@ -1,15 +1,78 @@
 package common
 
 const (
-	// 任务保存目录
+	// 程序版本
+	CRONTAB_VERSION = "1.1.0"
+
+	// 任务保存目录 /cron/jobs/{命名空间}/{任务名}
 	JOB_SAVE_DIR = "/cron/jobs/"
 
-	// 强杀任务目录
+	// 默认命名空间, 旧版本没有命名空间的任务都属于默认命名空间
+	JOB_NAMESPACE_DEFAULT = "default"
+
+	// 强杀任务目录 /cron/killer/{命名空间}/{任务名}
 	JOB_KILLER_DIR = "/cron/killer/"
 
 	// 强杀任务租约过期时间,单位秒
 	KILL_JOB_LEASE_TTL = 1
 
+	// 任务版本历史目录 /cron/history/{命名空间}/{任务名}/{时间戳}
+	JOB_HISTORY_DIR = "/cron/history/"
+
+	// 任务版本操作: 保存
+	JOB_HISTORY_OP_SAVE = "save"
+
+	// 任务版本操作: 删除
+	JOB_HISTORY_OP_DELETE = "delete"
+
+	// 任务版本操作: 回滚
+	JOB_HISTORY_OP_ROLLBACK = "rollback"
+
+	// 任务版本操作: 从回收站恢复
+	JOB_HISTORY_OP_RESTORE = "restore"
+
+	// 回收站目录 /cron/trash/{命名空间}/{任务名}/{删除时间戳}
+	JOB_TRASH_DIR = "/cron/trash/"
+
+	// 每个任务默认保留的版本记录数
+	JOB_HISTORY_MAX_VERSIONS = 100
+
+	// 回收站过期清理的检查间隔，单位秒
+	JOB_TRASH_PURGE_INTERVAL = 3600
+
+	// 任务日志定期清理的默认检查间隔，单位秒
+	JOB_LOG_PURGE_INTERVAL = 3600
+
+	// worker把监听到的任务变化写入本地快照文件的间隔，单位毫秒
+	JOB_CACHE_FLUSH_INTERVAL = 1000
+
+	// 内存任务存储保留的修改事件数, 从更早的revision开始监听时返回ERR_STORE_COMPACTED
+	MEMORY_STORE_EVENT_LIMIT = 10000
+
+	// 保存/删除任务时不检查revision
+	JOB_REVISION_ANY = -1
+
+	// 导入导出格式: json
+	JOB_FORMAT_JSON = "json"
+
+	// 导入导出格式: yaml
+	JOB_FORMAT_YAML = "yaml"
+
+	// 导入格式: 标准crontab文件
+	JOB_FORMAT_CRONTAB = "crontab"
+
+	// 声明式同步的默认来源
+	JOB_MANAGED_SOURCE_DEFAULT = "apply"
+
+	// 页面修改受管任务: 警告，确认后仍然可以修改
+	MANAGED_JOB_POLICY_WARN = "warn"
+
+	// 页面修改受管任务: 禁止
+	MANAGED_JOB_POLICY_BLOCK = "block"
+
+	// 传递操作人的HTTP请求头
+	JOB_OPERATOR_HEADER = "X-Operator"
+
 	// 保存任务事件
 	JOB_EVENT_SAVE = 1
 
@@ -19,9 +82,88 @@ const (
 	// 任务杀死事件
 	JOB_EVENT_KILL = 3
 
+	// 执行模式: 抢锁，同一时刻只有一个worker执行
+	JOB_EXEC_MODE_SINGLE = ""
+
+	// 执行模式: 广播，每个(满足选择器的)worker都执行，不抢锁
+	JOB_EXEC_MODE_BROADCAST = "broadcast"
+
+	// 执行模式: 分片，每次调度拆成多个分片，由不同的worker分别抢锁执行
+	JOB_EXEC_MODE_SHARD = "shard"
+
+	// 传递给分片任务命令的分片序号环境变量
+	JOB_SHARD_INDEX_ENV = "SHARD_INDEX"
+
+	// 传递给分片任务命令的分片总数环境变量
+	JOB_SHARD_TOTAL_ENV = "SHARD_TOTAL"
+
+	// 执行状态: 成功
+	JOB_RUN_STATUS_SUCCESS = "success"
+
+	// 执行状态: 失败
+	JOB_RUN_STATUS_FAILED = "failed"
+
+	// 执行状态: 未完成(分片未全部执行)
+	JOB_RUN_STATUS_INCOMPLETE = "incomplete"
+
+	// 执行状态: 还没有执行过
+	JOB_RUN_STATUS_NONE = "none"
+
+	// 任务状态: 启用
+	JOB_STATE_ENABLED = "enabled"
+
+	// 任务状态: 停用
+	JOB_STATE_DISABLED = "disabled"
+
+	// 任务列表排序: 任务名
+	JOB_SORT_BY_NAME = "name"
+
+	// 任务列表排序: 创建时间
+	JOB_SORT_BY_CREATE_TIME = "createTime"
+
+	// 任务列表排序: 最后修改时间
+	JOB_SORT_BY_UPDATE_TIME = "updateTime"
+
+	// 任务列表默认每页任务数
+	JOB_LIST_PAGE_SIZE = 20
+
+	// 任务列表每页最多任务数
+	JOB_LIST_MAX_PAGE_SIZE = 500
+
 	// 人物锁目录
 	JOB_LOCK_DIR = "/cron/lock/"
 
+	// 任务锁租约默认过期时间,单位秒
+	JOB_LOCK_TTL = 5
+
+	// 负载评分中可用内存的计量单位(1GB), 可用内存每多一个单位评分越接近不计内存时的值
+	WORKER_MEM_SCORE_UNIT = 1024 * 1024 * 1024
+
+	// 分片锁在分片执行完成后最长保留的时间，单位秒，防止晚到的worker重复执行同一分片
+	// 实际保留时间按任务的调度间隔计算, 见BuildShardLockRetain
+	JOB_SHARD_LOCK_RETAIN = 300
+
+	// 丢锁策略: 杀死正在执行的任务
+	JOB_LOCK_LOST_POLICY_KILL = "kill"
+
+	// 丢锁策略: 任务继续执行，只在日志中标记丢锁
+	JOB_LOCK_LOST_POLICY_MARK = "mark"
+
+	// etcd不可用时需要抢锁的任务: 跳过本次执行
+	JOB_LOCK_FALLBACK_SKIP = "skip"
+
+	// etcd不可用时需要抢锁的任务: 不抢锁直接在本节点执行
+	JOB_LOCK_FALLBACK_RUN = "run"
+
+	// etcd连通性探测间隔，单位秒
+	ETCD_PROBE_INTERVAL = 5
+
+	// etcd单个事务允许的操作数, 与etcd的--max-txn-ops默认值一致
+	ETCD_MAX_TXN_OPS = 128
+
+	// 传递给任务命令的栅栏令牌环境变量
+	JOB_FENCING_TOKEN_ENV = "CRON_FENCING_TOKEN"
+
 	// 查询日志条数
 	LOG_LIMIT_NUM = 10
 
@@ -33,4 +175,82 @@ const (
 
 	// 服务注册租约过期时间，单位秒
 	REGISTER_WORKER_LEASE_TTL = 10
+
+	// worker运维状态目录 /cron/worker_state/{workerId}
+	JOB_WORKER_STATE_DIR = "/cron/worker_state/"
+
+	// worker状态: 正常接收任务
+	WORKER_STATE_ACTIVE = ""
+
+	// worker状态: 已封锁，不再接收新的任务，正在执行的任务继续执行
+	WORKER_STATE_CORDONED = "cordoned"
+
+	// worker状态: 排空中，封锁并等待正在执行的任务结束
+	WORKER_STATE_DRAINING = "draining"
+
+	// 注册信息(负载)刷新间隔，单位秒
+	REGISTER_WORKER_REFRESH_INTERVAL = 5
+
+	// 调度方式: 每个worker各自计算调度并抢锁执行
+	DISPATCH_MODE_WORKER = "worker"
+
+	// 调度方式: 选举出的master统一计算调度，把执行任务分派到worker的队列
+	DISPATCH_MODE_MASTER = "master"
+
+	// 任务分派队列目录 /cron/dispatch/{worker}/
+	JOB_DISPATCH_DIR = "/cron/dispatch/"
+
+	// 分派记录租约过期时间，单位秒, worker长时间未取走的分派自动作废
+	JOB_DISPATCH_LEASE_TTL = 60
+
+	// master选举目录
+	MASTER_ELECTION_DIR = "/cron/election/"
+
+	// master选举会话租约过期时间，单位秒
+	MASTER_ELECTION_TTL = 10
+
+	// 日志存储: MongoDB
+	LOG_STORE_MONGODB = "mongodb"
+
+	// 日志存储: 本地JSONL文件, 按大小轮转
+	LOG_STORE_FILE = "file"
+
+	// 日志存储: 内嵌的bolt数据库
+	LOG_STORE_BOLT = "bolt"
+
+	// 日志排序: 按开始时间
+	JOB_LOG_SORT_BY_START_TIME = "startTime"
+
+	// 日志排序: 按计划时间
+	JOB_LOG_SORT_BY_PLAN_TIME = "planTime"
+
+	// 汇总调度记录时每次读取的日志条数
+	JOB_LOG_QUERY_BATCH = 500
+
+	// 查询最近一次调度状态时读取的日志条数, 一次调度的日志比这个多时加倍重新读取
+	JOB_LOG_LAST_RUN_BATCH = 16
+
+	// JSONL日志: 正在写入的文件名, 轮转后的文件名为 joblog-{时间戳}.jsonl
+	LOG_FILE_ACTIVE_NAME = "joblog.jsonl"
+
+	// JSONL日志: 每个任务单个文件默认最大大小，单位MB
+	LOG_FILE_MAX_SIZE = 100
+
+	// JSONL日志: 每个任务默认保留的轮转文件个数
+	LOG_FILE_MAX_BACKUPS = 10
+
+	// 日志文件和bolt数据库的加锁超时时间，单位毫秒
+	LOG_STORE_LOCK_TIMEOUT = 5000
+
+	// 日志写入: 等待写入存储的批次个数上限, 超出时直接落盘
+	LOG_SINK_BATCH_QUEUE = 16
+
+	// 日志暂存: 默认占用磁盘的上限，单位MB
+	LOG_SPOOL_MAX_SIZE = 1024
+
+	// 日志暂存: 重放失败后的最短重试间隔，单位毫秒
+	LOG_SPOOL_RETRY_MIN = 1000
+
+	// 日志暂存: 重放失败后的最长重试间隔，单位毫秒
+	LOG_SPOOL_RETRY_MAX = 60000
 )
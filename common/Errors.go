@@ -4,5 +4,43 @@ import "errors"
 
 var (
 	ERR_LOCK_ALREADY_REQUIRED = errors.New("锁已被占用，抢锁失败")
-	ERR_NO_LOCAL_IP_FOUND = errors.New("没有找到网卡IP")
+	ERR_NO_LOCAL_IP_FOUND     = errors.New("没有找到网卡IP")
+	ERR_LOCK_LOST             = errors.New("lock lost")
+	ERR_NO_MATCHING_WORKER    = errors.New("没有在线的worker满足任务的标签选择器")
+	ERR_INVALID_EXEC_MODE     = errors.New("不支持的任务执行模式")
+	ERR_INVALID_SHARD_TOTAL   = errors.New("分片任务的分片数必须大于0")
+	ERR_INVALID_DISPATCH      = errors.New("分派记录不合法")
+	ERR_WORKER_NOT_FOUND      = errors.New("worker不在线")
+	ERR_DRAIN_TIMEOUT         = errors.New("等待worker排空超时")
+	ERR_INVALID_WORKER_ID     = errors.New("worker ID不能包含/")
+	ERR_EMPTY_WORKER_ID       = errors.New("worker ID不能为空")
+	ERR_WORKER_ID_CONFLICT    = errors.New("worker ID已被其他在线worker使用")
+	ERR_ETCD_UNAVAILABLE      = errors.New("etcd不可用，跳过需要抢锁的任务")
+	ERR_DISPATCH_CORDONED     = errors.New("节点已封锁，跳过本次分派")
+	ERR_DISPATCH_RUNNING      = errors.New("任务正在执行中，跳过本次分派")
+	ERR_JOB_VERSION_NOT_FOUND = errors.New("任务版本不存在")
+	ERR_ROLLBACK_TO_DELETE    = errors.New("不能回滚到删除操作的版本")
+	ERR_JOB_CONFLICT          = errors.New("任务已被其他人修改，请刷新后重试")
+	ERR_INVALID_NAMESPACE     = errors.New("命名空间不能包含/")
+	ERR_EMPTY_JOB_NAME        = errors.New("任务名不能为空")
+	ERR_INVALID_JOB_NAME      = errors.New("任务名不能包含/")
+	ERR_INVALID_JOB_FORMAT    = errors.New("不支持的导入导出格式")
+	ERR_INVALID_CRONTAB_LINE  = errors.New("无法解析的crontab行")
+	ERR_CRONTAB_REBOOT        = errors.New("不支持@reboot")
+	ERR_DUPLICATE_JOB_NAME    = errors.New("导入内容中任务名重复")
+	ERR_JOB_EXISTS            = errors.New("任务已存在且内容不同，需要指定覆盖")
+	ERR_JOB_MANAGED           = errors.New("任务由声明式配置管理，页面上的修改会在下次同步时被覆盖")
+	ERR_JOB_MANAGED_BLOCKED   = errors.New("任务由声明式配置管理，不允许在页面上修改")
+	ERR_JOB_MANAGED_BY_OTHER  = errors.New("任务由其他来源的声明式配置管理")
+	ERR_APPLY_INVALID         = errors.New("清单中有错误，没有应用任何修改")
+	ERR_APPLY_CONFLICT        = errors.New("任务在生成计划之后被修改，没有应用任何修改，请重新执行")
+	ERR_TRASH_NOT_FOUND       = errors.New("回收站中没有该任务")
+	ERR_TRASH_PURGE_ALL       = errors.New("没有指定任务名，清空整个回收站需要传all=true")
+	ERR_STORE_COMPACTED       = errors.New("要监听的revision已被压缩")
+	ERR_STORE_CLOSED          = errors.New("任务存储已关闭")
+	ERR_LEASE_NOT_FOUND       = errors.New("租约不存在或已过期")
+	ERR_STORE_TXN_TOO_LARGE   = errors.New("修改的记录太多，超出etcd单个事务的操作数上限(--max-txn-ops)，没有应用任何修改，请分批应用或调大上限")
+	ERR_INVALID_LOG_STORE     = errors.New("不支持的日志存储类型")
+	ERR_LOG_STORE_BUSY        = errors.New("日志存储被其他进程占用，请稍后重试")
+	ERR_LOG_SPOOL_FULL        = errors.New("日志暂存目录已达到容量上限")
 )
@@ -0,0 +1,707 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 基于etcd的任务存储
+// 任务保存在 /cron/jobs/命名空间/任务名, 强杀通知在 /cron/killer/命名空间/任务名, 附属记录直接使用调用方给出的key
+type EtcdJobStore struct {
+	client  *clientv3.Client
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+
+	requestTimeout time.Duration // 单次请求的超时时间, 0表示不超时
+	maxTxnOps      int           // 单个事务的操作数上限
+}
+
+// 初始化etcd任务存储, 使用共享的etcd连接
+func InitEtcdJobStore(client *clientv3.Client, requestTimeout time.Duration) (store *EtcdJobStore) {
+	store = &EtcdJobStore{
+		client:         client,
+		kv:             clientv3.NewKV(client),
+		lease:          clientv3.NewLease(client),
+		watcher:        clientv3.NewWatcher(client),
+		requestTimeout: requestTimeout,
+		maxTxnOps:      ETCD_MAX_TXN_OPS,
+	}
+	return
+}
+
+// 设置单个事务的操作数上限, 需要与etcd的--max-txn-ops一致, <=0时使用默认值
+func (store *EtcdJobStore) SetMaxTxnOps(maxTxnOps int) {
+	if maxTxnOps > 0 {
+		store.maxTxnOps = maxTxnOps
+	}
+}
+
+// 请求上下文, 配置了超时时间时etcd不可用的请求不会一直阻塞
+func (store *EtcdJobStore) requestCtx() (context.Context, context.CancelFunc) {
+	if store.requestTimeout > 0 {
+		return context.WithTimeout(context.TODO(), store.requestTimeout)
+	}
+	return context.WithCancel(context.TODO())
+}
+
+// 读取一个任务
+func (store *EtcdJobStore) GetJob(namespace string, name string) (job *Job, revision int64, err error) {
+	var (
+		jobKey     string
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		getResp    *clientv3.GetResponse
+	)
+	jobKey = BuildJobKey(namespace, name)
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, jobKey)
+	cancelFunc()
+	if err != nil || len(getResp.Kvs) == 0 {
+		return
+	}
+	revision = getResp.Kvs[0].ModRevision
+	// 无法解析的任务只返回revision, 调用方仍然可以覆盖或删除
+	if job, _ = UnpackJobFromKey(jobKey, getResp.Kvs[0].Value); job != nil {
+		job.ModRevision = revision
+	}
+	return
+}
+
+// 读取任务列表
+func (store *EtcdJobStore) ListJobs(namespace string, namePrefix string) (jobList []*Job, revision int64, err error) {
+	var (
+		dirKey     string
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		getResp    *clientv3.GetResponse
+		kvPair     *mvccpb.KeyValue
+		job        *Job
+	)
+	// 指定命名空间时任务名前缀直接作为etcd的key前缀, 只读取需要的任务
+	if dirKey = JOB_SAVE_DIR; namespace != "" {
+		dirKey = JOB_SAVE_DIR + namespace + "/" + namePrefix
+	}
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, dirKey, clientv3.WithPrefix())
+	cancelFunc()
+	if err != nil {
+		return
+	}
+
+	revision = getResp.Header.Revision
+	jobList = make([]*Job, 0, len(getResp.Kvs))
+	for _, kvPair = range getResp.Kvs {
+		if job, err = UnpackJobFromKey(string(kvPair.Key), kvPair.Value); err != nil {
+			err = nil
+			continue
+		}
+		// 不限命名空间时读取了所有任务, 在这里按任务名前缀过滤
+		if !strings.HasPrefix(job.Name, namePrefix) {
+			continue
+		}
+		job.ModRevision = kvPair.ModRevision
+		jobList = append(jobList, job)
+	}
+	return
+}
+
+// 有任务的命名空间
+func (store *EtcdJobStore) ListNamespaces() (namespaces []string, err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		getResp    *clientv3.GetResponse
+		kvPair     *mvccpb.KeyValue
+		namespace  string
+		existed    map[string]bool
+	)
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, JOB_SAVE_DIR, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancelFunc()
+	if err != nil {
+		return
+	}
+
+	namespaces = make([]string, 0)
+	existed = make(map[string]bool)
+	for _, kvPair = range getResp.Kvs {
+		if namespace, _ = ExtractJobName(string(kvPair.Key)); !existed[namespace] {
+			existed[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return
+}
+
+// 读取一条附属记录
+func (store *EtcdJobStore) GetRecord(key string) (record *StoreRecord, err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		getResp    *clientv3.GetResponse
+	)
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, key)
+	cancelFunc()
+	if err != nil || len(getResp.Kvs) == 0 {
+		return
+	}
+	record = buildStoreRecord(getResp.Kvs[0])
+	return
+}
+
+// 读取前缀下的附属记录
+func (store *EtcdJobStore) ListRecords(prefix string, desc bool) (records []*StoreRecord, err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		opts       []clientv3.OpOption
+		getResp    *clientv3.GetResponse
+		kvPair     *mvccpb.KeyValue
+	)
+	opts = []clientv3.OpOption{clientv3.WithPrefix()}
+	if desc {
+		opts = append(opts, clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	}
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, prefix, opts...)
+	cancelFunc()
+	if err != nil {
+		return
+	}
+
+	records = make([]*StoreRecord, 0, len(getResp.Kvs))
+	for _, kvPair = range getResp.Kvs {
+		records = append(records, buildStoreRecord(kvPair))
+	}
+	return
+}
+
+// 读取前缀下的附属记录和读取时的revision
+func (store *EtcdJobStore) ListRecordsWithRevision(prefix string) (records []*StoreRecord, revision int64, err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		getResp    *clientv3.GetResponse
+		kvPair     *mvccpb.KeyValue
+	)
+	ctx, cancelFunc = store.requestCtx()
+	getResp, err = store.kv.Get(ctx, prefix, clientv3.WithPrefix())
+	cancelFunc()
+	if err != nil {
+		return
+	}
+
+	revision = getResp.Header.Revision
+	records = make([]*StoreRecord, 0, len(getResp.Kvs))
+	for _, kvPair = range getResp.Kvs {
+		records = append(records, buildStoreRecord(kvPair))
+	}
+	return
+}
+
+// 删除附属记录
+func (store *EtcdJobStore) DeleteRecords(key string, isPrefix bool) (deleted int64, err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		opts       []clientv3.OpOption
+		delResp    *clientv3.DeleteResponse
+	)
+	if isPrefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	ctx, cancelFunc = store.requestCtx()
+	delResp, err = store.kv.Delete(ctx, key, opts...)
+	cancelFunc()
+	if err != nil {
+		return
+	}
+	deleted = delResp.Deleted
+	return
+}
+
+// 在一个etcd事务中写入任务和附属记录
+// 修改的条数受etcd的--max-txn-ops限制
+func (store *EtcdJobStore) Commit(jobWrites []*JobWrite, recordWrites []*RecordWrite) (succeeded bool, err error) {
+	var (
+		jobWrite    *JobWrite
+		recordWrite *RecordWrite
+		key         string
+		jobValue    []byte
+		cmps        []clientv3.Cmp
+		ops         []clientv3.Op
+		ctx         context.Context
+		cancelFunc  context.CancelFunc
+		txnResp     *clientv3.TxnResponse
+	)
+	for _, jobWrite = range jobWrites {
+		key = BuildJobKey(jobWrite.Namespace, jobWrite.Name)
+		if jobWrite.ExpectRevision != JOB_REVISION_ANY {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", jobWrite.ExpectRevision))
+		}
+		if jobWrite.Job == nil {
+			ops = append(ops, clientv3.OpDelete(key))
+			continue
+		}
+		if jobValue, err = json.Marshal(jobWrite.Job); err != nil {
+			return
+		}
+		ops = append(ops, clientv3.OpPut(key, string(jobValue)))
+	}
+	for _, recordWrite = range recordWrites {
+		if recordWrite.ExpectRevision != JOB_REVISION_ANY {
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(recordWrite.Key), "=", recordWrite.ExpectRevision))
+		}
+		switch {
+		case recordWrite.Value == nil:
+			ops = append(ops, clientv3.OpDelete(recordWrite.Key))
+		case recordWrite.LeaseId != 0:
+			ops = append(ops, clientv3.OpPut(recordWrite.Key, string(recordWrite.Value), clientv3.WithLease(clientv3.LeaseID(recordWrite.LeaseId))))
+		default:
+			ops = append(ops, clientv3.OpPut(recordWrite.Key, string(recordWrite.Value)))
+		}
+	}
+
+	// 超出上限时etcd会拒绝整个事务, 提前返回明确的错误
+	if len(cmps) > store.maxTxnOps || len(ops) > store.maxTxnOps {
+		err = ERR_STORE_TXN_TOO_LARGE
+		return
+	}
+
+	ctx, cancelFunc = store.requestCtx()
+	txnResp, err = store.kv.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	cancelFunc()
+	if err != nil {
+		return
+	}
+	succeeded = txnResp.Succeeded
+	return
+}
+
+// 监听任务变化
+func (store *EtcdJobStore) WatchJobs(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse {
+	return store.watchDir(ctx, JOB_SAVE_DIR, fromRevision)
+}
+
+// 发出强杀通知
+func (store *EtcdJobStore) KillJob(namespace string, name string) (err error) {
+	var (
+		leaseGrantResp *clientv3.LeaseGrantResponse
+	)
+	// worker监听 /cron/killer/目录下的put事件，创建租约并让他自动过期
+	if leaseGrantResp, err = store.lease.Grant(context.TODO(), KILL_JOB_LEASE_TTL); err != nil {
+		return
+	}
+	// 设置killer标记
+	_, err = store.kv.Put(context.TODO(), BuildKillerKey(namespace, name), "", clientv3.WithLease(leaseGrantResp.ID))
+	return
+}
+
+// 监听强杀通知
+func (store *EtcdJobStore) WatchKills(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse {
+	return store.watchDir(ctx, JOB_KILLER_DIR, fromRevision)
+}
+
+// 监听任务目录或强杀目录, 把etcd事件转换成任务事件
+// 要求集群有leader，失去leader时监听会被关闭
+func (store *EtcdJobStore) watchDir(ctx context.Context, dirKey string, fromRevision int64) <-chan *JobWatchResponse {
+	var (
+		opts      []clientv3.OpOption
+		watchChan clientv3.WatchChan
+		respChan  chan *JobWatchResponse
+	)
+	opts = []clientv3.OpOption{clientv3.WithPrefix()}
+	if fromRevision > 0 {
+		opts = append(opts, clientv3.WithRev(fromRevision))
+	}
+	watchChan = store.watcher.Watch(clientv3.WithRequireLeader(ctx), dirKey, opts...)
+	respChan = make(chan *JobWatchResponse)
+
+	go func() {
+		var (
+			watchResp  clientv3.WatchResponse
+			watchEvent *clientv3.Event
+			jobResp    *JobWatchResponse
+			jobEvent   *JobWatchEvent
+		)
+		defer close(respChan)
+		for watchResp = range watchChan {
+			jobResp = &JobWatchResponse{
+				Revision:        watchResp.Header.Revision,
+				CompactRevision: watchResp.CompactRevision,
+				Err:             watchResp.Err(),
+			}
+			for _, watchEvent = range watchResp.Events {
+				if jobEvent = buildJobWatchEvent(dirKey, watchEvent); jobEvent != nil {
+					jobResp.Events = append(jobResp.Events, jobEvent)
+				}
+			}
+			select {
+			case respChan <- jobResp:
+			case <-ctx.Done():
+				return
+			}
+			if jobResp.Err != nil {
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+// 监听前缀下的附属记录, 要求集群有leader，失去leader时监听会被关闭
+func (store *EtcdJobStore) WatchRecords(ctx context.Context, prefix string, fromRevision int64) <-chan *RecordWatchResponse {
+	var (
+		opts      []clientv3.OpOption
+		watchChan clientv3.WatchChan
+		respChan  chan *RecordWatchResponse
+	)
+	opts = []clientv3.OpOption{clientv3.WithPrefix()}
+	if fromRevision > 0 {
+		opts = append(opts, clientv3.WithRev(fromRevision))
+	}
+	watchChan = store.watcher.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...)
+	respChan = make(chan *RecordWatchResponse)
+
+	go func() {
+		var (
+			watchResp  clientv3.WatchResponse
+			watchEvent *clientv3.Event
+			recordResp *RecordWatchResponse
+		)
+		defer close(respChan)
+		for watchResp = range watchChan {
+			recordResp = &RecordWatchResponse{
+				Revision:        watchResp.Header.Revision,
+				CompactRevision: watchResp.CompactRevision,
+				Err:             watchResp.Err(),
+			}
+			for _, watchEvent = range watchResp.Events {
+				recordResp.Events = append(recordResp.Events, &RecordWatchEvent{
+					Record:  buildStoreRecord(watchEvent.Kv),
+					Deleted: watchEvent.Type == mvccpb.DELETE,
+				})
+			}
+			select {
+			case respChan <- recordResp:
+			case <-ctx.Done():
+				return
+			}
+			if recordResp.Err != nil {
+				return
+			}
+		}
+	}()
+	return respChan
+}
+
+// etcd事件转换成任务事件, 无法解析的任务和强杀通知的过期事件返回nil
+func buildJobWatchEvent(dirKey string, watchEvent *clientv3.Event) (jobEvent *JobWatchEvent) {
+	var (
+		job *Job
+		err error
+	)
+	jobEvent = &JobWatchEvent{Revision: watchEvent.Kv.ModRevision}
+	switch {
+	case dirKey == JOB_KILLER_DIR:
+		// 强杀通知标记过期时自动被删除, 不需要处理
+		if watchEvent.Type != mvccpb.PUT {
+			return nil
+		}
+		job = &Job{}
+		job.Namespace, job.Name = ExtractKillerName(string(watchEvent.Kv.Key))
+		jobEvent.EventType = JOB_EVENT_KILL
+	case watchEvent.Type == mvccpb.PUT:
+		if job, err = UnpackJobFromKey(string(watchEvent.Kv.Key), watchEvent.Kv.Value); err != nil {
+			return nil
+		}
+		job.ModRevision = watchEvent.Kv.ModRevision
+		jobEvent.EventType = JOB_EVENT_SAVE
+	default:
+		// 删除任务只需要命名空间和任务名即可
+		job = &Job{}
+		job.Namespace, job.Name = ExtractJobName(string(watchEvent.Kv.Key))
+		jobEvent.EventType = JOV_EVENT_DELETE
+	}
+	jobEvent.Job = job
+	return
+}
+
+// 尝试抢锁: 创建租约并自动续期, 用事务在锁不存在时写入锁
+func (store *EtcdJobStore) TryLock(lockKey string, ttl int64, retainTtl int64, onLost func()) (fencingToken int64, unlockFunc func(), err error) {
+	var (
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		cancelCtx      context.Context
+		cancelFunc     context.CancelFunc
+		leaseId        clientv3.LeaseID
+		keepRespChan   <-chan *clientv3.LeaseKeepAliveResponse
+		txnResp        *clientv3.TxnResponse
+	)
+	// 1.创建租约
+	if leaseGrantResp, err = store.lease.Grant(context.TODO(), ttl); err != nil {
+		return
+	}
+
+	// 用于取消自动续期的 cancelCtx, cancelFunc
+	cancelCtx, cancelFunc = context.WithCancel(context.TODO())
+
+	// 获取租约ID
+	leaseId = leaseGrantResp.ID
+
+	// 2.未执行完成，自动续租
+	if keepRespChan, err = store.lease.KeepAlive(cancelCtx, leaseId); err != nil {
+		goto FAIL
+	}
+
+	// 3.处理续租自动应答
+	go func() {
+		var (
+			keepResp *clientv3.LeaseKeepAliveResponse
+		)
+		for {
+			select {
+			case keepResp = <-keepRespChan:
+				if keepResp == nil {
+					goto END
+				}
+			}
+		}
+	END:
+		// 不是主动释放锁导致的续租结束，说明租约已经丢失，其他worker可能已经抢到了锁
+		if cancelCtx.Err() == nil && onLost != nil {
+			onLost()
+		}
+	}()
+
+	// 4.抢锁
+	if txnResp, err = store.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
+		Then(clientv3.OpPut(lockKey, "locked", clientv3.WithLease(leaseId))).
+		Else(clientv3.OpGet(lockKey)).
+		Commit(); err != nil {
+		goto FAIL
+	}
+
+	// 5.抢锁成功返回,失败释放租约
+	if !txnResp.Succeeded { // 抢锁失败
+		err = ERR_LOCK_ALREADY_REQUIRED
+		goto FAIL
+	}
+	// 抢锁成功, 锁的revision作为栅栏令牌
+	fencingToken = txnResp.Header.Revision
+	unlockFunc = func() {
+		cancelFunc()
+		if retainTtl > 0 {
+			store.retainLock(lockKey, fencingToken, retainTtl)
+		}
+		store.lease.Revoke(context.TODO(), leaseId) // 释放租约
+	}
+	return
+FAIL:
+	cancelFunc()                                // 取消自动续期
+	store.lease.Revoke(context.TODO(), leaseId) // 释放租约
+	return
+}
+
+// 释放锁前把锁换到一个retainTtl秒的新租约上, 锁已经不是自己的时不处理
+func (store *EtcdJobStore) retainLock(lockKey string, fencingToken int64, retainTtl int64) {
+	var (
+		leaseGrantResp *clientv3.LeaseGrantResponse
+		txnResp        *clientv3.TxnResponse
+		err            error
+	)
+	if leaseGrantResp, err = store.lease.Grant(context.TODO(), retainTtl); err != nil {
+		return
+	}
+	if txnResp, err = store.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", fencingToken)).
+		Then(clientv3.OpPut(lockKey, "done", clientv3.WithLease(leaseGrantResp.ID))).
+		Commit(); err != nil || !txnResp.Succeeded {
+		store.lease.Revoke(context.TODO(), leaseGrantResp.ID)
+	}
+}
+
+// 创建租约
+func (store *EtcdJobStore) GrantLease(ttl int64) (leaseId int64, err error) {
+	var (
+		ctx            context.Context
+		cancelFunc     context.CancelFunc
+		leaseGrantResp *clientv3.LeaseGrantResponse
+	)
+	ctx, cancelFunc = store.requestCtx()
+	leaseGrantResp, err = store.lease.Grant(ctx, ttl)
+	cancelFunc()
+	if err != nil {
+		return
+	}
+	leaseId = int64(leaseGrantResp.ID)
+	return
+}
+
+// 自动续租, etcd的续租应答通道关闭时续租已经停止
+func (store *EtcdJobStore) KeepAliveLease(ctx context.Context, leaseId int64) (aliveChan <-chan struct{}, err error) {
+	var (
+		keepRespChan <-chan *clientv3.LeaseKeepAliveResponse
+		stopChan     chan struct{}
+	)
+	if keepRespChan, err = store.lease.KeepAlive(ctx, clientv3.LeaseID(leaseId)); err != nil {
+		return
+	}
+	stopChan = make(chan struct{})
+	go func() {
+		var (
+			keepResp *clientv3.LeaseKeepAliveResponse
+		)
+		for keepResp = range keepRespChan {
+			if keepResp == nil {
+				break
+			}
+		}
+		close(stopChan)
+	}()
+	aliveChan = stopChan
+	return
+}
+
+// 撤销租约
+func (store *EtcdJobStore) RevokeLease(leaseId int64) (err error) {
+	var (
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+	)
+	ctx, cancelFunc = store.requestCtx()
+	_, err = store.lease.Revoke(ctx, clientv3.LeaseID(leaseId))
+	cancelFunc()
+	return
+}
+
+// 竞选leader: 创建选举会话, 会话租约过期后自动失去leader身份
+func (store *EtcdJobStore) Campaign(ctx context.Context, electionKey string, value string, ttl int64) (lostChan <-chan struct{}, resignFunc func(), err error) {
+	var (
+		session  *concurrency.Session
+		election *concurrency.Election
+	)
+	if session, err = concurrency.NewSession(store.client, concurrency.WithTTL(int(ttl))); err != nil {
+		return
+	}
+
+	// 阻塞直到当选或者被取消
+	election = concurrency.NewElection(session, electionKey)
+	if err = election.Campaign(ctx, value); err != nil {
+		session.Close()
+		return
+	}
+	lostChan = session.Done()
+	resignFunc = func() {
+		election.Resign(context.TODO())
+		session.Close()
+	}
+	return
+}
+
+// 探测etcd是否可用
+func (store *EtcdJobStore) Ping(ctx context.Context) (err error) {
+	_, err = store.kv.Get(ctx, JOB_SAVE_DIR, clientv3.WithCountOnly())
+	return
+}
+
+// 关闭存储
+func (store *EtcdJobStore) Close() {
+	store.watcher.Close()
+	store.lease.Close()
+}
+
+// 把旧版本 /cron/jobs/任务名 迁移到默认命名空间 /cron/jobs/default/任务名
+// 只有etcd中才会有旧版本的数据, 不属于JobStore接口
+func (store *EtcdJobStore) MigrateLegacyJobs() (err error) {
+	var (
+		getResp  *clientv3.GetResponse
+		kvPair   *mvccpb.KeyValue
+		jobName  string
+		job      *Job
+		jobValue []byte
+		newKey   string
+	)
+
+	if getResp, err = store.kv.Get(context.TODO(), JOB_SAVE_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+	for _, kvPair = range getResp.Kvs {
+		// 已经带有命名空间
+		if jobName = strings.TrimPrefix(string(kvPair.Key), JOB_SAVE_DIR); strings.Contains(jobName, "/") {
+			continue
+		}
+		if job, err = UnpackJob(kvPair.Value); err != nil {
+			err = nil
+			continue
+		}
+		job.Namespace = JOB_NAMESPACE_DEFAULT
+		if jobValue, err = json.Marshal(job); err != nil {
+			return
+		}
+		newKey = BuildJobKey(job.Namespace, jobName)
+
+		// 旧任务没有被修改并且默认命名空间下没有同名任务时才迁移
+		if _, err = store.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(string(kvPair.Key)), "=", kvPair.ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0)).
+			Then(clientv3.OpDelete(string(kvPair.Key)), clientv3.OpPut(newKey, string(jobValue))).
+			Commit(); err != nil {
+			return
+		}
+	}
+
+	// 旧版本的版本记录 /cron/history/{任务名}/{时间戳} 迁移到默认命名空间
+	err = store.migrateLegacyHistory()
+	return
+}
+
+// 迁移没有命名空间的版本记录, 否则任务名会被当成命名空间
+func (store *EtcdJobStore) migrateLegacyHistory() (err error) {
+	var (
+		getResp *clientv3.GetResponse
+		kvPair  *mvccpb.KeyValue
+		parts   []string
+		newKey  string
+	)
+
+	if getResp, err = store.kv.Get(context.TODO(), JOB_HISTORY_DIR, clientv3.WithPrefix()); err != nil {
+		return
+	}
+	for _, kvPair = range getResp.Kvs {
+		// 带有命名空间的key是 {命名空间}/{任务名}/{时间戳}
+		if parts = strings.Split(strings.TrimPrefix(string(kvPair.Key), JOB_HISTORY_DIR), "/"); len(parts) != 2 {
+			continue
+		}
+		newKey = BuildJobVersionDir(JOB_NAMESPACE_DEFAULT, parts[0]) + parts[1]
+
+		// 版本记录没有被修改并且新位置不存在时才迁移
+		if _, err = store.kv.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.ModRevision(string(kvPair.Key)), "=", kvPair.ModRevision),
+				clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0)).
+			Then(clientv3.OpDelete(string(kvPair.Key)), clientv3.OpPut(newKey, string(kvPair.Value))).
+			Commit(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// etcd的kv转换成附属记录
+func buildStoreRecord(kvPair *mvccpb.KeyValue) *StoreRecord {
+	return &StoreRecord{
+		Key:            string(kvPair.Key),
+		Value:          kvPair.Value,
+		CreateRevision: kvPair.CreateRevision,
+		ModRevision:    kvPair.ModRevision,
+	}
+}
@@ -0,0 +1,416 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 本地JSONL文件日志存储, 每行一条日志
+// 每个任务一个目录 {命名空间}/{任务名}/, 写入其中的 joblog.jsonl, 超过大小后改名为 joblog-{时间戳}.jsonl 并只保留最近的几个
+// 按任务查询只读取该任务的文件; 不指定任务的查询和删除(按命名空间汇总、日志保留期清理)需要读取所有任务的文件,
+// 一个任务的日志全部读出后排序分页, 大小不超过 单个文件大小 x (保留个数+1), 日志量更大时使用mongodb
+// 同一目录可以被同一台机器上的master和worker共用: 写入和删除通过锁文件上的flock互斥, 进程退出时系统自动释放, 读取不加锁
+// 旧版本写在根目录下的日志文件仍然可以查询和删除, 不再写入
+type FileLogStore struct {
+	dir        string
+	maxSize    int64 // 单个任务的单个文件的最大字节数
+	maxBackups int   // 单个任务保留的轮转文件个数
+
+	mutex    sync.Mutex // 进程内互斥, 进程间使用锁文件
+	lockFile *os.File   // 持有锁期间打开的锁文件
+}
+
+// 初始化JSONL文件日志存储
+func InitFileLogStore(config *LogStoreConfig) (store *FileLogStore, err error) {
+	store = &FileLogStore{
+		dir:        config.FileDir,
+		maxSize:    int64(config.FileMaxSize) * 1024 * 1024,
+		maxBackups: config.FileMaxBackups,
+	}
+	if store.maxSize <= 0 {
+		store.maxSize = LOG_FILE_MAX_SIZE * 1024 * 1024
+	}
+	if store.maxBackups <= 0 {
+		store.maxBackups = LOG_FILE_MAX_BACKUPS
+	}
+	err = os.MkdirAll(store.dir, 0755)
+	return
+}
+
+// 加锁, 其他进程持有锁时等待, 超时返回ERR_LOG_STORE_BUSY
+func (store *FileLogStore) lock() (err error) {
+	var (
+		lockFile *os.File
+		deadline time.Time
+	)
+	store.mutex.Lock()
+	if lockFile, err = os.OpenFile(filepath.Join(store.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+		goto FAIL
+	}
+	deadline = time.Now().Add(LOG_STORE_LOCK_TIMEOUT * time.Millisecond)
+	for {
+		if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			store.lockFile = lockFile
+			return
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			lockFile.Close()
+			goto FAIL
+		}
+		if time.Now().After(deadline) {
+			lockFile.Close()
+			err = ERR_LOG_STORE_BUSY
+			goto FAIL
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+FAIL:
+	store.mutex.Unlock()
+	return
+}
+
+// 解锁, 关闭锁文件即释放flock
+func (store *FileLogStore) unlock() {
+	store.lockFile.Close()
+	store.lockFile = nil
+	store.mutex.Unlock()
+}
+
+// 路径中的一段: 转义后不会包含路径分隔符, 也不会是 . 或 ..
+func logPathSegment(name string) string {
+	name = url.PathEscape(name)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// 任务的日志目录
+func (store *FileLogStore) jobLogDir(namespace string, jobName string) string {
+	return filepath.Join(store.dir, logPathSegment(NormalizeNamespace(namespace)), logPathSegment(jobName))
+}
+
+// 满足查询条件的日志目录: 各个任务的目录, 最后是旧版本的根目录
+func (store *FileLogStore) logDirs(query *JobLogQuery) (dirs []string, err error) {
+	var (
+		nsDirs []string
+		nsDir  string
+		infos  []os.FileInfo
+		info   os.FileInfo
+	)
+	switch {
+	case query.Namespace != "" && query.JobName != "":
+		dirs = []string{store.jobLogDir(query.Namespace, query.JobName)}
+	case query.Namespace != "":
+		nsDirs = []string{filepath.Join(store.dir, logPathSegment(query.Namespace))}
+	default:
+		if infos, err = ioutil.ReadDir(store.dir); err != nil {
+			return
+		}
+		for _, info = range infos {
+			if info.IsDir() {
+				nsDirs = append(nsDirs, filepath.Join(store.dir, info.Name()))
+			}
+		}
+	}
+	for _, nsDir = range nsDirs {
+		if query.JobName != "" {
+			dirs = append(dirs, filepath.Join(nsDir, logPathSegment(query.JobName)))
+			continue
+		}
+		if infos, err = ioutil.ReadDir(nsDir); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		for _, info = range infos {
+			if info.IsDir() {
+				dirs = append(dirs, filepath.Join(nsDir, info.Name()))
+			}
+		}
+	}
+	dirs = append(dirs, store.dir)
+	return
+}
+
+// 目录下的日志文件, 轮转后的文件按时间在前, 正在写入的文件在最后; 目录不存在时返回空
+func logFiles(dir string) (files []string, err error) {
+	var (
+		infos []os.FileInfo
+		info  os.FileInfo
+		name  string
+	)
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, info = range infos {
+		name = info.Name()
+		if name != LOG_FILE_ACTIVE_NAME && strings.HasPrefix(name, "joblog-") && strings.HasSuffix(name, ".jsonl") {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(files)
+	files = append(files, filepath.Join(dir, LOG_FILE_ACTIVE_NAME))
+	return
+}
+
+// 满足查询条件的所有日志文件
+func (store *FileLogStore) queryLogFiles(query *JobLogQuery) (files []string, err error) {
+	var (
+		dirs     []string
+		dir      string
+		dirFiles []string
+	)
+	if dirs, err = store.logDirs(query); err != nil {
+		return
+	}
+	for _, dir = range dirs {
+		if dirFiles, err = logFiles(dir); err != nil {
+			return
+		}
+		files = append(files, dirFiles...)
+	}
+	return
+}
+
+// 批量追加日志, 按任务写入各自的目录, 文件超过大小后轮转
+func (store *FileLogStore) Append(logs []*JobLog) (err error) {
+	var (
+		buffers map[string]*bytes.Buffer
+		buffer  *bytes.Buffer
+		jobLog  *JobLog
+		line    []byte
+		dir     string
+	)
+	buffers = make(map[string]*bytes.Buffer)
+	for _, jobLog = range logs {
+		if line, err = json.Marshal(jobLog); err != nil {
+			return
+		}
+		dir = store.jobLogDir(jobLog.Namespace, jobLog.JobName)
+		if buffer = buffers[dir]; buffer == nil {
+			buffer = &bytes.Buffer{}
+			buffers[dir] = buffer
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+
+	if err = store.lock(); err != nil {
+		return
+	}
+	defer store.unlock()
+
+	for dir, buffer = range buffers {
+		if err = store.appendJobLogs(dir, buffer.Bytes()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 把一个任务的日志追加到它的目录, 需要持有锁
+func (store *FileLogStore) appendJobLogs(dir string, content []byte) (err error) {
+	var (
+		activePath string
+		file       *os.File
+		info       os.FileInfo
+	)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	// 一次写入整批日志, 读取方不会读到半条
+	activePath = filepath.Join(dir, LOG_FILE_ACTIVE_NAME)
+	if file, err = os.OpenFile(activePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+	if _, err = file.Write(content); err != nil {
+		file.Close()
+		return
+	}
+	info, err = file.Stat()
+	file.Close()
+	if err != nil || info.Size() < store.maxSize {
+		return
+	}
+	err = store.rotate(dir)
+	return
+}
+
+// 轮转: 当前文件改名, 删除超出保留个数的旧文件, 需要持有锁
+func (store *FileLogStore) rotate(dir string) (err error) {
+	var (
+		files []string
+		index int
+	)
+	if err = os.Rename(filepath.Join(dir, LOG_FILE_ACTIVE_NAME), filepath.Join(dir, fmt.Sprintf("joblog-%020d.jsonl", time.Now().UnixNano()))); err != nil {
+		return
+	}
+	if files, err = logFiles(dir); err != nil {
+		return
+	}
+	// 最后一个是正在写入的文件
+	for index = 0; index < len(files)-1-store.maxBackups; index++ {
+		os.Remove(files[index])
+	}
+	return
+}
+
+// 逐行读取日志文件, 文件不存在时跳过, 无法解析的行交给handler时jobLog为nil
+func scanLogFile(path string, handler func(line []byte, jobLog *JobLog) error) (err error) {
+	var (
+		file   *os.File
+		reader *bufio.Reader
+		line   []byte
+		jobLog *JobLog
+	)
+	if file, err = os.Open(path); err != nil {
+		// 文件在列出之后被轮转或删除
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	// 输出可能很长, 不限制行的长度
+	reader = bufio.NewReader(file)
+	for {
+		if line, err = reader.ReadBytes('\n'); len(line) != 0 {
+			jobLog = &JobLog{}
+			if json.Unmarshal(line, jobLog) != nil {
+				jobLog = nil
+			}
+			if err = handler(line, jobLog); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 查询日志: 扫描满足条件的任务的文件后排序分页
+func (store *FileLogStore) Query(query *JobLogQuery) (logList []*JobLog, err error) {
+	var (
+		files []string
+		path  string
+	)
+	if files, err = store.queryLogFiles(query); err != nil {
+		return
+	}
+	logList = make([]*JobLog, 0)
+	for _, path = range files {
+		if err = scanLogFile(path, func(line []byte, jobLog *JobLog) error {
+			if jobLog != nil && query.Match(jobLog) {
+				logList = append(logList, jobLog)
+			}
+			return nil
+		}); err != nil {
+			return
+		}
+	}
+	logList = sortAndPageLogs(logList, query)
+	return
+}
+
+// 删除日志: 把不满足条件的行写入临时文件再改名替换
+func (store *FileLogStore) Delete(query *JobLogQuery) (deleted int64, err error) {
+	var (
+		files     []string
+		path      string
+		dir       string
+		fileCount int64
+	)
+	if err = store.lock(); err != nil {
+		return
+	}
+	defer store.unlock()
+
+	if files, err = store.queryLogFiles(query); err != nil {
+		return
+	}
+	for _, path = range files {
+		if fileCount, err = store.rewriteLogFile(path, query); err != nil {
+			return
+		}
+		deleted += fileCount
+		// 任务的日志删空后删除它的目录和命名空间目录, 目录不为空时删除失败
+		if dir = filepath.Dir(path); dir != store.dir {
+			os.Remove(dir)
+			os.Remove(filepath.Dir(dir))
+		}
+	}
+	return
+}
+
+// 从一个文件中删除满足条件的日志, 需要持有锁
+func (store *FileLogStore) rewriteLogFile(path string, query *JobLogQuery) (deleted int64, err error) {
+	var (
+		tmpPath string
+		tmpFile *os.File
+		writer  *bufio.Writer
+		kept    int64
+	)
+	tmpPath = path + ".tmp"
+	if tmpFile, err = os.Create(tmpPath); err != nil {
+		return
+	}
+	writer = bufio.NewWriter(tmpFile)
+	err = scanLogFile(path, func(line []byte, jobLog *JobLog) (writeErr error) {
+		// 无法解析的行原样保留
+		if jobLog != nil && query.Match(jobLog) {
+			deleted++
+			return
+		}
+		kept++
+		_, writeErr = writer.Write(line)
+		return
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	tmpFile.Close()
+	if err != nil || deleted == 0 {
+		os.Remove(tmpPath)
+		return
+	}
+
+	// 文件删空了就直接删除, 正在写入的文件在下次写入时重新创建
+	if kept == 0 {
+		os.Remove(tmpPath)
+		err = os.Remove(path)
+		return
+	}
+	err = os.Rename(tmpPath, path)
+	return
+}
+
+// 文件存储没有需要释放的资源
+func (store *FileLogStore) Close(ctx context.Context) (err error) {
+	return
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 日志按任务分目录存放, 按任务查询只读取该任务的目录, 任务名不会逃出日志目录
+func TestFileLogStorePerJobLayout(t *testing.T) {
+	var (
+		dir     string
+		store   *FileLogStore
+		logList []*JobLog
+		deleted int64
+		err     error
+	)
+	if dir, err = ioutil.TempDir("", "crontab-file-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if store, err = InitFileLogStore(&LogStoreConfig{FileDir: filepath.Join(dir, "log")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Append([]*JobLog{
+		{Namespace: "default", JobName: "job1", StartTime: 1},
+		{Namespace: "default", JobName: "..", StartTime: 2},
+		{Namespace: "ops", JobName: "job1", StartTime: 3},
+		{JobName: "job1", StartTime: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "log", "default", "job1", LOG_FILE_ACTIVE_NAME)); err != nil {
+		t.Fatalf("任务目录不存在: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, LOG_FILE_ACTIVE_NAME)); !os.IsNotExist(err) {
+		t.Fatal("任务名逃出了日志目录")
+	}
+
+	// 没有命名空间的日志属于默认命名空间, 按开始时间倒序
+	if logList, err = store.Query(&JobLogQuery{Namespace: "default", JobName: "job1"}); err != nil || len(logList) != 2 || logList[0].StartTime != 4 {
+		t.Fatalf("按任务查询不正确: %v %v", logList, err)
+	}
+	if logList, err = store.Query(&JobLogQuery{Namespace: "default"}); err != nil || len(logList) != 3 {
+		t.Fatalf("按命名空间查询不正确: %v %v", logList, err)
+	}
+	if logList, err = store.Query(&JobLogQuery{JobName: "job1"}); err != nil || len(logList) != 3 {
+		t.Fatalf("跨命名空间查询不正确: %v %v", logList, err)
+	}
+
+	// 删空后任务目录被删除
+	if deleted, err = store.Delete(&JobLogQuery{Namespace: "ops", JobName: "job1"}); err != nil || deleted != 1 {
+		t.Fatalf("删除不正确: %d %v", deleted, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "log", "ops")); !os.IsNotExist(err) {
+		t.Fatal("删空后目录没有删除")
+	}
+}
+
+// 旧版本写在根目录下的日志仍然可以查询和删除
+func TestFileLogStoreLegacyFiles(t *testing.T) {
+	var (
+		dir     string
+		store   *FileLogStore
+		logList []*JobLog
+		deleted int64
+		err     error
+	)
+	if dir, err = ioutil.TempDir("", "crontab-file-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, LOG_FILE_ACTIVE_NAME), []byte(`{"jobName":"old","startTime":1}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = InitFileLogStore(&LogStoreConfig{FileDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if logList, err = store.Query(&JobLogQuery{Namespace: "default", JobName: "old"}); err != nil || len(logList) != 1 {
+		t.Fatalf("旧日志查询不正确: %v %v", logList, err)
+	}
+	if deleted, err = store.Delete(&JobLogQuery{JobName: "old"}); err != nil || deleted != 1 {
+		t.Fatalf("旧日志删除不正确: %d %v", deleted, err)
+	}
+}
+
+// 两个进程(两个存储实例)共用目录时写入互斥, 不会丢失或写坏日志
+func TestFileLogStoreSharedLock(t *testing.T) {
+	var (
+		dir     string
+		stores  []*FileLogStore
+		wg      sync.WaitGroup
+		index   int
+		logList []*JobLog
+		err     error
+	)
+	if dir, err = ioutil.TempDir("", "crontab-file-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores = make([]*FileLogStore, 2)
+	for index = range stores {
+		if stores[index], err = InitFileLogStore(&LogStoreConfig{FileDir: dir}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index = 0; index < 100; index++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			if err := stores[index%2].Append([]*JobLog{{JobName: "shared", Output: strings.Repeat("x", 4096)}}); err != nil {
+				t.Error(err)
+			}
+		}(index)
+	}
+	wg.Wait()
+	if logList, err = stores[0].Query(&JobLogQuery{Namespace: "default", JobName: "shared"}); err != nil || len(logList) != 100 {
+		t.Fatalf("日志条数不正确: %d %v", len(logList), err)
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"context"
+)
+
+// 任务存储: 任务定义、版本历史和回收站记录、强杀通知、任务锁,
+// 以及worker注册信息、运维状态、分派队列和master选举
+// master和worker只通过它访问存储, 默认使用etcd, 进程内测试时使用内存实现
+type JobStore interface {
+	// 读取一个任务, 返回任务当前的revision; 任务不存在时job为nil且revision为0, 无法解析时job为nil
+	GetJob(namespace string, name string) (job *Job, revision int64, err error)
+
+	// 读取任务列表, 按命名空间和任务名排序, 任务的ModRevision为最后修改的revision
+	// namespace为空时读取所有命名空间, namePrefix不为空时只读取任务名以它开头的任务
+	// 同时返回读取时存储的revision, 用于从下一个revision开始监听
+	ListJobs(namespace string, namePrefix string) (jobList []*Job, revision int64, err error)
+
+	// 有任务的命名空间, 按名称排序
+	ListNamespaces() (namespaces []string, err error)
+
+	// 读取一条附属记录(版本历史、回收站), 不存在时返回nil
+	GetRecord(key string) (record *StoreRecord, err error)
+
+	// 读取前缀下的附属记录, 按key排序, desc为true时倒序
+	ListRecords(prefix string, desc bool) (records []*StoreRecord, err error)
+
+	// 读取前缀下的附属记录, 按key排序, 同时返回读取时存储的revision, 用于从下一个revision开始监听
+	ListRecordsWithRevision(prefix string) (records []*StoreRecord, revision int64, err error)
+
+	// 从fromRevision开始监听前缀下附属记录的变化, 其余同WatchJobs
+	WatchRecords(ctx context.Context, prefix string, fromRevision int64) <-chan *RecordWatchResponse
+
+	// 删除附属记录, isPrefix为true时删除前缀下的所有记录, 返回删除的条数
+	DeleteRecords(key string, isPrefix bool) (deleted int64, err error)
+
+	// 在一个事务中写入任务和附属记录, 任一条件不满足时什么都不写并返回succeeded=false
+	Commit(jobWrites []*JobWrite, recordWrites []*RecordWrite) (succeeded bool, err error)
+
+	// 从fromRevision开始监听任务变化, fromRevision为0时从当前开始
+	// 监听中断时返回带Err的应答并关闭通道, ctx取消时关闭通道
+	WatchJobs(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse
+
+	// 发出强杀通知, 通知在KILL_JOB_LEASE_TTL秒后自动过期
+	KillJob(namespace string, name string) (err error)
+
+	// 从fromRevision开始监听强杀通知, 事件类型为JOB_EVENT_KILL, 其余同WatchJobs
+	WatchKills(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse
+
+	// 尝试抢锁, ttl秒内没有续期时锁自动释放
+	// 成功时返回栅栏令牌(单调递增)和释放锁的函数, 持有期间锁丢失时调用onLost
+	// retainTtl>0时释放锁不会立即删除, 锁再保留retainTtl秒
+	TryLock(lockKey string, ttl int64, retainTtl int64, onLost func()) (fencingToken int64, unlockFunc func(), err error)
+
+	// 创建租约, ttl秒内没有续租时租约过期, 绑定该租约写入的记录随之删除
+	GrantLease(ttl int64) (leaseId int64, err error)
+
+	// 自动续租直到ctx取消, 续租停止(租约过期、存储不可用或ctx取消)时关闭返回的通道
+	KeepAliveLease(ctx context.Context, leaseId int64) (aliveChan <-chan struct{}, err error)
+
+	// 撤销租约, 绑定的记录随之删除
+	RevokeLease(leaseId int64) (err error)
+
+	// 竞选leader, 阻塞直到当选、出错或ctx取消, ttl秒内没有续租时失去leader身份
+	// 当选后lostChan在失去leader身份时关闭, 调用resignFunc主动让出
+	Campaign(ctx context.Context, electionKey string, value string, ttl int64) (lostChan <-chan struct{}, resignFunc func(), err error)
+
+	// 探测存储是否可用
+	Ping(ctx context.Context) (err error)
+
+	// 关闭存储, 共享的etcd连接不在这里关闭
+	Close()
+}
+
+// 附属记录
+type StoreRecord struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64 // 创建时的revision, 版本历史用它作为版本号
+	ModRevision    int64 // 最后修改的revision
+}
+
+// 任务写操作
+type JobWrite struct {
+	Namespace      string
+	Name           string
+	Job            *Job  // 要保存的任务, nil表示删除
+	ExpectRevision int64 // 任务当前的revision必须等于它, 0表示任务必须不存在, JOB_REVISION_ANY表示不检查
+}
+
+// 附属记录写操作
+type RecordWrite struct {
+	Key            string
+	Value          []byte // 要保存的值, nil表示删除
+	ExpectRevision int64  // 含义同JobWrite
+	LeaseId        int64  // 绑定的租约, 租约过期时记录被删除; 0表示不绑定
+}
+
+// 任务监听事件
+type JobWatchEvent struct {
+	EventType int  // SAVE DELETE KILL
+	Job       *Job // 删除和强杀事件只有命名空间和任务名
+	Revision  int64
+}
+
+// 任务监听应答
+type JobWatchResponse struct {
+	Events          []*JobWatchEvent
+	Revision        int64 // 应答时存储的revision
+	CompactRevision int64 // 要监听的revision已被压缩时, 可以继续监听的最小revision
+	Err             error // 监听中断的原因
+}
+
+// 附属记录监听事件
+type RecordWatchEvent struct {
+	Record  *StoreRecord // 删除事件只有Key和ModRevision
+	Deleted bool
+}
+
+// 附属记录监听应答, 字段含义同JobWatchResponse
+type RecordWatchResponse struct {
+	Events          []*RecordWatchEvent
+	Revision        int64
+	CompactRevision int64
+	Err             error
+}
+
+// 写入附属记录, 不检查revision
+func BuildRecordPut(key string, value []byte) *RecordWrite {
+	return &RecordWrite{Key: key, Value: value, ExpectRevision: JOB_REVISION_ANY}
+}
+
+// 删除附属记录, 不检查revision
+func BuildRecordDelete(key string) *RecordWrite {
+	return &RecordWrite{Key: key, ExpectRevision: JOB_REVISION_ANY}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"context"
+	"sort"
+)
+
+// 任务日志存储: worker批量写入, master查询和删除
+type LogStore interface {
+	// 批量追加日志
+	Append(logs []*JobLog) (err error)
+
+	// 查询满足条件的日志, 按query.SortBy倒序
+	Query(query *JobLogQuery) (logList []*JobLog, err error)
+
+	// 删除满足条件的日志(忽略排序和分页), 返回删除的条数
+	Delete(query *JobLogQuery) (deleted int64, err error)
+
+	// 关闭存储
+	Close(ctx context.Context) (err error)
+}
+
+// 日志查询条件
+type JobLogQuery struct {
+	Namespace  string // 命名空间, 为空表示所有命名空间
+	JobName    string // 任务名, 为空表示所有任务
+	EndBefore  int64  // 只匹配结束时间早于它的日志, 单位毫秒, 0表示不限制
+	PlanBefore int64  // 只匹配计划时间早于它的日志, 单位毫秒, 0表示不限制
+	SortBy     string // 排序字段: startTime或planTime, 倒序
+	Skip       int
+	Limit      int // 0表示不限制
+}
+
+// 日志存储配置, master和worker从各自的配置文件中填写
+type LogStoreConfig struct {
+	Type string // mongodb file bolt
+
+	MongodbUri            string
+	MongodbConnectTimeout int // 单位毫秒
+	MongodbDb             string
+	MongodbCollection     string
+
+	FileDir        string // JSONL文件目录
+	FileMaxSize    int    // 单个文件的最大大小, 单位MB, 超过后轮转
+	FileMaxBackups int    // 保留的轮转文件个数
+
+	BoltPath string // bolt数据库文件路径
+}
+
+// 按配置创建日志存储
+func InitLogStore(config *LogStoreConfig) (store LogStore, err error) {
+	switch config.Type {
+	case LOG_STORE_MONGODB, "":
+		store, err = InitMongoLogStore(config)
+	case LOG_STORE_FILE:
+		store, err = InitFileLogStore(config)
+	case LOG_STORE_BOLT:
+		store, err = InitBoltLogStore(config)
+	default:
+		err = ERR_INVALID_LOG_STORE
+	}
+	return
+}
+
+// 日志是否满足查询条件
+func (query *JobLogQuery) Match(jobLog *JobLog) bool {
+	// 没有命名空间的日志属于默认命名空间
+	if query.Namespace != "" && NormalizeNamespace(jobLog.Namespace) != query.Namespace {
+		return false
+	}
+	if query.JobName != "" && jobLog.JobName != query.JobName {
+		return false
+	}
+	if query.EndBefore > 0 && jobLog.EndTime >= query.EndBefore {
+		return false
+	}
+	if query.PlanBefore > 0 && jobLog.PlanTime >= query.PlanBefore {
+		return false
+	}
+	return true
+}
+
+// 对已经过滤的日志排序并分页, 用于不能在存储中排序的实现
+func sortAndPageLogs(logList []*JobLog, query *JobLogQuery) []*JobLog {
+	// 倒序, 时间相同时保持写入的先后顺序
+	sort.SliceStable(logList, func(i, j int) bool {
+		if query.SortBy == JOB_LOG_SORT_BY_PLAN_TIME {
+			return logList[i].PlanTime > logList[j].PlanTime
+		}
+		return logList[i].StartTime > logList[j].StartTime
+	})
+	if query.Skip >= len(logList) {
+		return make([]*JobLog, 0)
+	}
+	logList = logList[query.Skip:]
+	if query.Limit > 0 && query.Limit < len(logList) {
+		logList = logList[:query.Limit]
+	}
+	return logList
+}
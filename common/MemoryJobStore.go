@@ -0,0 +1,851 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内存任务存储, 只在一个进程内有效, 用于在没有etcd的情况下测试master和worker
+// key的布局和revision的语义与etcd相同: 每个事务revision加1, 监听可以从指定的revision开始
+// 过期的值和租约在读取时才删除, 不产生删除事件
+type MemoryJobStore struct {
+	mutex           sync.Mutex
+	values          map[string]*memoryValue
+	leases          map[int64]*memoryLease
+	lastLeaseId     int64
+	revision        int64          // 当前revision
+	events          []*memoryEvent // 最近的修改事件, 按revision递增
+	compactRevision int64          // 更早的事件已被丢弃
+	notifyChan      chan struct{}  // 每次修改后关闭并重新创建, 唤醒监听协程
+	closed          bool
+}
+
+// 内存中保存的值
+type memoryValue struct {
+	value          []byte
+	createRevision int64
+	modRevision    int64
+	expireTime     time.Time // 过期时间, 零值表示不过期
+	leaseId        int64     // 绑定的租约, 租约过期或撤销时值被删除
+}
+
+// 内存中的租约
+type memoryLease struct {
+	ttl        time.Duration
+	expireTime time.Time
+}
+
+// 内存中的修改事件
+type memoryEvent struct {
+	key            string
+	value          []byte
+	deleted        bool
+	createRevision int64
+	revision       int64
+}
+
+// 初始化内存任务存储
+func InitMemoryJobStore() (store *MemoryJobStore) {
+	store = &MemoryJobStore{
+		values:     make(map[string]*memoryValue),
+		leases:     make(map[int64]*memoryLease),
+		notifyChan: make(chan struct{}),
+	}
+	return
+}
+
+// 读取一个值, 过期的值视为不存在, 需要持有锁
+func (store *MemoryJobStore) get(key string) *memoryValue {
+	var (
+		value *memoryValue
+	)
+	if value = store.values[key]; value == nil {
+		return nil
+	}
+	if !value.expireTime.IsZero() && time.Now().After(value.expireTime) ||
+		value.leaseId != 0 && store.getLease(value.leaseId) == nil {
+		delete(store.values, key)
+		return nil
+	}
+	return value
+}
+
+// 读取一个租约, 过期的租约视为不存在, 需要持有锁
+func (store *MemoryJobStore) getLease(leaseId int64) *memoryLease {
+	var (
+		lease *memoryLease
+	)
+	if lease = store.leases[leaseId]; lease == nil {
+		return nil
+	}
+	if time.Now().After(lease.expireTime) {
+		delete(store.leases, leaseId)
+		return nil
+	}
+	return lease
+}
+
+// 前缀下未过期的key, 按key排序, 需要持有锁
+func (store *MemoryJobStore) keys(prefix string) (keyList []string) {
+	var (
+		key string
+	)
+	keyList = make([]string, 0)
+	for key = range store.values {
+		if strings.HasPrefix(key, prefix) && store.get(key) != nil {
+			keyList = append(keyList, key)
+		}
+	}
+	sort.Strings(keyList)
+	return
+}
+
+// 以当前revision写入一个值, 需要持有锁
+func (store *MemoryJobStore) put(key string, value []byte, expireTime time.Time) {
+	var (
+		createRevision int64
+		oldValue       *memoryValue
+	)
+	createRevision = store.revision
+	if oldValue = store.get(key); oldValue != nil {
+		createRevision = oldValue.createRevision
+	}
+	store.values[key] = &memoryValue{
+		value:          value,
+		createRevision: createRevision,
+		modRevision:    store.revision,
+		expireTime:     expireTime,
+	}
+	store.appendEvent(&memoryEvent{key: key, value: value, createRevision: createRevision, revision: store.revision})
+}
+
+// 以当前revision删除一个值, 返回是否存在, 需要持有锁
+func (store *MemoryJobStore) remove(key string) bool {
+	var (
+		existed bool
+	)
+	existed = store.get(key) != nil
+	delete(store.values, key)
+	if existed {
+		store.appendEvent(&memoryEvent{key: key, deleted: true, revision: store.revision})
+	}
+	return existed
+}
+
+// 记录修改事件, 只保留最近的MEMORY_STORE_EVENT_LIMIT个, 需要持有锁
+func (store *MemoryJobStore) appendEvent(event *memoryEvent) {
+	store.events = append(store.events, event)
+	if len(store.events) <= MEMORY_STORE_EVENT_LIMIT {
+		return
+	}
+	// 同一个revision的事件一起丢弃
+	store.compactRevision = store.events[len(store.events)-MEMORY_STORE_EVENT_LIMIT-1].revision + 1
+	for len(store.events) != 0 && store.events[0].revision < store.compactRevision {
+		store.events = store.events[1:]
+	}
+}
+
+// 唤醒监听协程, 需要持有锁
+func (store *MemoryJobStore) notify() {
+	close(store.notifyChan)
+	store.notifyChan = make(chan struct{})
+}
+
+// 读取一个任务
+func (store *MemoryJobStore) GetJob(namespace string, name string) (job *Job, revision int64, err error) {
+	var (
+		jobKey string
+		value  *memoryValue
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	jobKey = BuildJobKey(namespace, name)
+	if value = store.get(jobKey); value == nil {
+		return
+	}
+	revision = value.modRevision
+	if job, _ = UnpackJobFromKey(jobKey, value.value); job != nil {
+		job.ModRevision = revision
+	}
+	return
+}
+
+// 读取任务列表
+func (store *MemoryJobStore) ListJobs(namespace string, namePrefix string) (jobList []*Job, revision int64, err error) {
+	var (
+		dirKey string
+		key    string
+		value  *memoryValue
+		job    *Job
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	if dirKey = JOB_SAVE_DIR; namespace != "" {
+		dirKey = JOB_SAVE_DIR + namespace + "/" + namePrefix
+	}
+	revision = store.revision
+	jobList = make([]*Job, 0)
+	for _, key = range store.keys(dirKey) {
+		value = store.get(key)
+		if job, err = UnpackJobFromKey(key, value.value); err != nil {
+			err = nil
+			continue
+		}
+		// 不限命名空间时读取了所有任务, 在这里按任务名前缀过滤
+		if !strings.HasPrefix(job.Name, namePrefix) {
+			continue
+		}
+		job.ModRevision = value.modRevision
+		jobList = append(jobList, job)
+	}
+	return
+}
+
+// 有任务的命名空间
+func (store *MemoryJobStore) ListNamespaces() (namespaces []string, err error) {
+	var (
+		key       string
+		namespace string
+		existed   map[string]bool
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	// key已排序, 命名空间也是有序的
+	namespaces = make([]string, 0)
+	existed = make(map[string]bool)
+	for _, key = range store.keys(JOB_SAVE_DIR) {
+		if namespace, _ = ExtractJobName(key); !existed[namespace] {
+			existed[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return
+}
+
+// 读取一条附属记录
+func (store *MemoryJobStore) GetRecord(key string) (record *StoreRecord, err error) {
+	var (
+		value *memoryValue
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	if value = store.get(key); value != nil {
+		record = value.record(key)
+	}
+	return
+}
+
+// 读取前缀下的附属记录
+func (store *MemoryJobStore) ListRecords(prefix string, desc bool) (records []*StoreRecord, err error) {
+	var (
+		keyList []string
+		index   int
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	keyList = store.keys(prefix)
+	records = make([]*StoreRecord, len(keyList))
+	for index = range keyList {
+		if desc {
+			records[len(keyList)-1-index] = store.get(keyList[index]).record(keyList[index])
+		} else {
+			records[index] = store.get(keyList[index]).record(keyList[index])
+		}
+	}
+	return
+}
+
+// 删除附属记录
+func (store *MemoryJobStore) DeleteRecords(key string, isPrefix bool) (deleted int64, err error) {
+	var (
+		keyList []string
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	if isPrefix {
+		keyList = store.keys(key)
+	} else if store.get(key) != nil {
+		keyList = []string{key}
+	}
+	if len(keyList) == 0 {
+		return
+	}
+	store.revision++
+	for _, key = range keyList {
+		if store.remove(key) {
+			deleted++
+		}
+	}
+	store.notify()
+	return
+}
+
+// 在一个事务中写入任务和附属记录
+func (store *MemoryJobStore) Commit(jobWrites []*JobWrite, recordWrites []*RecordWrite) (succeeded bool, err error) {
+	var (
+		jobWrite    *JobWrite
+		recordWrite *RecordWrite
+		jobValues   [][]byte
+		jobValue    []byte
+		index       int
+	)
+	// 先序列化, 保证检查通过后所有写入都能完成
+	jobValues = make([][]byte, len(jobWrites))
+	for index, jobWrite = range jobWrites {
+		if jobWrite.Job != nil {
+			if jobValues[index], err = json.Marshal(jobWrite.Job); err != nil {
+				return
+			}
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	// 1.检查条件
+	for _, jobWrite = range jobWrites {
+		if !store.matchRevision(BuildJobKey(jobWrite.Namespace, jobWrite.Name), jobWrite.ExpectRevision) {
+			return
+		}
+	}
+	for _, recordWrite = range recordWrites {
+		if recordWrite.LeaseId != 0 && recordWrite.Value != nil && store.getLease(recordWrite.LeaseId) == nil {
+			err = ERR_LEASE_NOT_FOUND
+			return
+		}
+		if !store.matchRevision(recordWrite.Key, recordWrite.ExpectRevision) {
+			return
+		}
+	}
+
+	// 2.所有写入使用同一个revision
+	store.revision++
+	for index, jobWrite = range jobWrites {
+		if jobValue = jobValues[index]; jobValue == nil {
+			store.remove(BuildJobKey(jobWrite.Namespace, jobWrite.Name))
+		} else {
+			store.put(BuildJobKey(jobWrite.Namespace, jobWrite.Name), jobValue, time.Time{})
+		}
+	}
+	for _, recordWrite = range recordWrites {
+		if recordWrite.Value == nil {
+			store.remove(recordWrite.Key)
+		} else {
+			store.put(recordWrite.Key, recordWrite.Value, time.Time{})
+			store.values[recordWrite.Key].leaseId = recordWrite.LeaseId
+		}
+	}
+	store.notify()
+	succeeded = true
+	return
+}
+
+// key当前的revision是否符合预期, 需要持有锁
+func (store *MemoryJobStore) matchRevision(key string, expectRevision int64) bool {
+	var (
+		value    *memoryValue
+		revision int64
+	)
+	if expectRevision == JOB_REVISION_ANY {
+		return true
+	}
+	if value = store.get(key); value != nil {
+		revision = value.modRevision
+	}
+	return revision == expectRevision
+}
+
+// 监听任务变化
+func (store *MemoryJobStore) WatchJobs(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse {
+	return store.watchDir(ctx, JOB_SAVE_DIR, fromRevision)
+}
+
+// 发出强杀通知
+func (store *MemoryJobStore) KillJob(namespace string, name string) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	store.revision++
+	store.put(BuildKillerKey(namespace, name), []byte{}, time.Now().Add(KILL_JOB_LEASE_TTL*time.Second))
+	store.notify()
+	return
+}
+
+// 监听强杀通知
+func (store *MemoryJobStore) WatchKills(ctx context.Context, fromRevision int64) <-chan *JobWatchResponse {
+	return store.watchDir(ctx, JOB_KILLER_DIR, fromRevision)
+}
+
+// 监听任务目录或强杀目录
+func (store *MemoryJobStore) watchDir(ctx context.Context, dirKey string, fromRevision int64) <-chan *JobWatchResponse {
+	var (
+		respChan chan *JobWatchResponse
+	)
+	respChan = make(chan *JobWatchResponse)
+	fromRevision = store.watchStart(fromRevision)
+
+	go func() {
+		defer close(respChan)
+		store.watchLoop(ctx, dirKey, fromRevision, func(events []*memoryEvent, jobResp *JobWatchResponse) bool {
+			var (
+				event    *memoryEvent
+				jobEvent *JobWatchEvent
+			)
+			for _, event = range events {
+				if jobEvent = buildMemoryWatchEvent(dirKey, event); jobEvent != nil {
+					jobResp.Events = append(jobResp.Events, jobEvent)
+				}
+			}
+			if len(jobResp.Events) == 0 && jobResp.Err == nil {
+				return true
+			}
+			select {
+			case respChan <- jobResp:
+			case <-ctx.Done():
+				return false
+			}
+			return jobResp.Err == nil
+		})
+	}()
+	return respChan
+}
+
+// 监听前缀下的附属记录
+func (store *MemoryJobStore) WatchRecords(ctx context.Context, prefix string, fromRevision int64) <-chan *RecordWatchResponse {
+	var (
+		respChan chan *RecordWatchResponse
+	)
+	respChan = make(chan *RecordWatchResponse)
+	fromRevision = store.watchStart(fromRevision)
+
+	go func() {
+		defer close(respChan)
+		store.watchLoop(ctx, prefix, fromRevision, func(events []*memoryEvent, jobResp *JobWatchResponse) bool {
+			var (
+				event      *memoryEvent
+				recordResp *RecordWatchResponse
+			)
+			recordResp = &RecordWatchResponse{
+				Revision:        jobResp.Revision,
+				CompactRevision: jobResp.CompactRevision,
+				Err:             jobResp.Err,
+			}
+			for _, event = range events {
+				recordResp.Events = append(recordResp.Events, &RecordWatchEvent{
+					Record:  &StoreRecord{Key: event.key, Value: event.value, CreateRevision: event.createRevision, ModRevision: event.revision},
+					Deleted: event.deleted,
+				})
+			}
+			if len(recordResp.Events) == 0 && recordResp.Err == nil {
+				return true
+			}
+			select {
+			case respChan <- recordResp:
+			case <-ctx.Done():
+				return false
+			}
+			return recordResp.Err == nil
+		})
+	}()
+	return respChan
+}
+
+// 监听的起始revision, 从当前开始监听时以调用时的revision为准
+func (store *MemoryJobStore) watchStart(fromRevision int64) int64 {
+	if fromRevision <= 0 {
+		store.mutex.Lock()
+		fromRevision = store.revision + 1
+		store.mutex.Unlock()
+	}
+	return fromRevision
+}
+
+// 不断取出前缀下fromRevision之后的事件交给deliver, 直到deliver返回false或ctx取消
+// 存储关闭或者要监听的revision已被压缩时, 应答中带有Err
+func (store *MemoryJobStore) watchLoop(ctx context.Context, prefix string, fromRevision int64,
+	deliver func(events []*memoryEvent, jobResp *JobWatchResponse) bool) {
+	var (
+		nextRevision int64
+		event        *memoryEvent
+		events       []*memoryEvent
+		jobResp      *JobWatchResponse
+		notifyChan   chan struct{}
+	)
+	nextRevision = fromRevision
+	for {
+		// 1.取出nextRevision之后的事件
+		store.mutex.Lock()
+		events = nil
+		jobResp = &JobWatchResponse{Revision: store.revision}
+		switch {
+		case store.closed:
+			jobResp.Err = ERR_STORE_CLOSED
+		case nextRevision < store.compactRevision:
+			jobResp.Err = ERR_STORE_COMPACTED
+			jobResp.CompactRevision = store.compactRevision
+		default:
+			for _, event = range store.events {
+				if event.revision >= nextRevision && strings.HasPrefix(event.key, prefix) {
+					events = append(events, event)
+				}
+			}
+			nextRevision = store.revision + 1
+		}
+		notifyChan = store.notifyChan
+		store.mutex.Unlock()
+
+		// 2.投递事件
+		if !deliver(events, jobResp) {
+			return
+		}
+
+		// 3.等待下一次修改
+		select {
+		case <-notifyChan:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 内存事件转换成任务事件, 与etcd实现的规则相同
+func buildMemoryWatchEvent(dirKey string, event *memoryEvent) (jobEvent *JobWatchEvent) {
+	var (
+		job *Job
+		err error
+	)
+	jobEvent = &JobWatchEvent{Revision: event.revision}
+	switch {
+	case dirKey == JOB_KILLER_DIR:
+		if event.deleted {
+			return nil
+		}
+		job = &Job{}
+		job.Namespace, job.Name = ExtractKillerName(event.key)
+		jobEvent.EventType = JOB_EVENT_KILL
+	case !event.deleted:
+		if job, err = UnpackJobFromKey(event.key, event.value); err != nil {
+			return nil
+		}
+		job.ModRevision = event.revision
+		jobEvent.EventType = JOB_EVENT_SAVE
+	default:
+		job = &Job{}
+		job.Namespace, job.Name = ExtractJobName(event.key)
+		jobEvent.EventType = JOV_EVENT_DELETE
+	}
+	jobEvent.Job = job
+	return
+}
+
+// 尝试抢锁, 进程内的锁不会丢失, 持有期间不会过期
+func (store *MemoryJobStore) TryLock(lockKey string, ttl int64, retainTtl int64, onLost func()) (fencingToken int64, unlockFunc func(), err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	if store.get(lockKey) != nil {
+		err = ERR_LOCK_ALREADY_REQUIRED
+		return
+	}
+	store.revision++
+	store.put(lockKey, []byte("locked"), time.Time{})
+	store.notify()
+	fencingToken = store.revision
+
+	unlockFunc = func() {
+		var (
+			value *memoryValue
+		)
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		// 锁已经不是自己的
+		if value = store.get(lockKey); value == nil || value.createRevision != fencingToken {
+			return
+		}
+		if retainTtl > 0 {
+			// 锁再保留retainTtl秒
+			value.expireTime = time.Now().Add(time.Duration(retainTtl) * time.Second)
+			return
+		}
+		store.revision++
+		store.remove(lockKey)
+		store.notify()
+	}
+	return
+}
+
+// 读取前缀下的附属记录和读取时的revision
+func (store *MemoryJobStore) ListRecordsWithRevision(prefix string) (records []*StoreRecord, revision int64, err error) {
+	var (
+		key string
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	revision = store.revision
+	records = make([]*StoreRecord, 0)
+	for _, key = range store.keys(prefix) {
+		records = append(records, store.get(key).record(key))
+	}
+	return
+}
+
+// 创建租约
+func (store *MemoryJobStore) GrantLease(ttl int64) (leaseId int64, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+
+	store.lastLeaseId++
+	leaseId = store.lastLeaseId
+	store.leases[leaseId] = &memoryLease{
+		ttl:        time.Duration(ttl) * time.Second,
+		expireTime: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	return
+}
+
+// 自动续租, 每隔三分之一个ttl续租一次
+func (store *MemoryJobStore) KeepAliveLease(ctx context.Context, leaseId int64) (aliveChan <-chan struct{}, err error) {
+	var (
+		lease    *memoryLease
+		stopChan chan struct{}
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+	if lease = store.getLease(leaseId); lease == nil {
+		err = ERR_LEASE_NOT_FOUND
+		return
+	}
+
+	stopChan = make(chan struct{})
+	go func() {
+		var (
+			ticker *time.Ticker
+			alive  bool
+		)
+		defer close(stopChan)
+		ticker = time.NewTicker(lease.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			store.mutex.Lock()
+			if alive = !store.closed && store.getLease(leaseId) != nil; alive {
+				lease.expireTime = time.Now().Add(lease.ttl)
+			}
+			store.mutex.Unlock()
+			if !alive {
+				return
+			}
+		}
+	}()
+	aliveChan = stopChan
+	return
+}
+
+// 撤销租约, 绑定的值在同一个revision删除
+func (store *MemoryJobStore) RevokeLease(leaseId int64) (err error) {
+	var (
+		key     string
+		value   *memoryValue
+		keyList []string
+	)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+		return
+	}
+	if store.getLease(leaseId) == nil {
+		err = ERR_LEASE_NOT_FOUND
+		return
+	}
+
+	for key, value = range store.values {
+		if value.leaseId == leaseId {
+			keyList = append(keyList, key)
+		}
+	}
+	// 先删除值再删除租约, 租约不存在时值会被视为已删除, 不会产生删除事件
+	if len(keyList) != 0 {
+		sort.Strings(keyList)
+		store.revision++
+		for _, key = range keyList {
+			store.remove(key)
+		}
+		store.notify()
+	}
+	delete(store.leases, leaseId)
+	return
+}
+
+// 竞选leader: 选举key不存在时写入它即当选, 否则等待它被删除
+// 进程内不会因为租约过期失去leader身份, 存储关闭或者选举key被删除时lostChan关闭
+func (store *MemoryJobStore) Campaign(ctx context.Context, electionKey string, value string, ttl int64) (lostChan <-chan struct{}, resignFunc func(), err error) {
+	var (
+		notifyChan  chan struct{}
+		revision    int64
+		stopChan    chan struct{}
+		resignChan  chan struct{}
+		resignOnce  sync.Once
+		leaderValue *memoryValue
+	)
+	for {
+		store.mutex.Lock()
+		if store.closed {
+			store.mutex.Unlock()
+			err = ERR_STORE_CLOSED
+			return
+		}
+		if store.get(electionKey) == nil {
+			store.revision++
+			store.put(electionKey, []byte(value), time.Time{})
+			store.notify()
+			revision = store.revision
+			store.mutex.Unlock()
+			break
+		}
+		notifyChan = store.notifyChan
+		store.mutex.Unlock()
+
+		select {
+		case <-notifyChan:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+
+	// 当选后监听选举key, 不再是自己的时失去leader身份
+	stopChan = make(chan struct{})
+	resignChan = make(chan struct{})
+	go func() {
+		var (
+			current  *memoryValue
+			lost     bool
+			waitChan chan struct{}
+		)
+		for {
+			store.mutex.Lock()
+			current = store.get(electionKey)
+			lost = store.closed || current == nil || current.createRevision != revision
+			waitChan = store.notifyChan
+			store.mutex.Unlock()
+			if lost {
+				close(stopChan)
+				return
+			}
+			select {
+			case <-waitChan:
+			case <-resignChan:
+				return
+			}
+		}
+	}()
+
+	lostChan = stopChan
+	resignFunc = func() {
+		resignOnce.Do(func() {
+			close(resignChan)
+			store.mutex.Lock()
+			defer store.mutex.Unlock()
+			if leaderValue = store.get(electionKey); leaderValue != nil && leaderValue.createRevision == revision {
+				store.revision++
+				store.remove(electionKey)
+				store.notify()
+			}
+		})
+	}
+	return
+}
+
+// 探测存储是否可用
+func (store *MemoryJobStore) Ping(ctx context.Context) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.closed {
+		err = ERR_STORE_CLOSED
+	}
+	return
+}
+
+// 关闭存储, 所有监听收到ERR_STORE_CLOSED
+func (store *MemoryJobStore) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if !store.closed {
+		store.closed = true
+		store.notify()
+	}
+}
+
+// 转换成附属记录
+func (value *memoryValue) record(key string) *StoreRecord {
+	return &StoreRecord{
+		Key:            key,
+		Value:          value.value,
+		CreateRevision: value.createRevision,
+		ModRevision:    value.modRevision,
+	}
+}
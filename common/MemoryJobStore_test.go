@@ -0,0 +1,39 @@
+package common
+
+import (
+	"testing"
+)
+
+// 不限命名空间时任务名前缀同样生效
+func TestMemoryListJobsPrefixAcrossNamespaces(t *testing.T) {
+	var (
+		store   *MemoryJobStore
+		jobList []*Job
+		job     *Job
+		err     error
+	)
+	store = InitMemoryJobStore()
+	defer store.Close()
+
+	for _, job = range []*Job{
+		{Namespace: "ns-a", Name: "backup-db"},
+		{Namespace: "ns-a", Name: "report"},
+		{Namespace: "ns-b", Name: "backup-files"},
+	} {
+		if _, err = store.Commit([]*JobWrite{{Namespace: job.Namespace, Name: job.Name, Job: job, ExpectRevision: JOB_REVISION_ANY}}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if jobList, _, err = store.ListJobs("", "backup-"); err != nil || len(jobList) != 2 {
+		t.Fatalf("按前缀读取所有命名空间的任务不正确: %d %v", len(jobList), err)
+	}
+	for _, job = range jobList {
+		if job.Name == "report" {
+			t.Fatal("不匹配前缀的任务不应该返回")
+		}
+	}
+	if jobList, _, err = store.ListJobs("", ""); err != nil || len(jobList) != 3 {
+		t.Fatalf("读取所有任务不正确: %d %v", len(jobList), err)
+	}
+}
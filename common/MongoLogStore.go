@@ -0,0 +1,130 @@
+package common
+
+import (
+	"context"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/clientopt"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"time"
+)
+
+// mongodb日志存储
+type MongoLogStore struct {
+	client        *mongo.Client
+	logCollection *mongo.Collection
+}
+
+// 建立mongodb连接
+func InitMongoLogStore(config *LogStoreConfig) (store *MongoLogStore, err error) {
+	var (
+		client *mongo.Client
+	)
+
+	if client, err = mongo.Connect(
+		context.TODO(),
+		config.MongodbUri,
+		clientopt.ConnectTimeout(time.Duration(config.MongodbConnectTimeout)*time.Millisecond)); err != nil {
+		return
+	}
+
+	// 选择db和collection
+	store = &MongoLogStore{
+		client:        client,
+		logCollection: client.Database(config.MongodbDb).Collection(config.MongodbCollection),
+	}
+	return
+}
+
+// 查询条件转换成mongodb的过滤条件
+// 引入命名空间之前写入的日志没有namespace字段, 属于默认命名空间
+func buildMongoLogFilter(query *JobLogQuery) (filter *JobLogFilter) {
+	filter = &JobLogFilter{JobName: query.JobName}
+	switch query.Namespace {
+	case "":
+	case JOB_NAMESPACE_DEFAULT:
+		filter.Namespace = &LogValueIn{In: []interface{}{JOB_NAMESPACE_DEFAULT, nil}}
+	default:
+		filter.Namespace = query.Namespace
+	}
+	if query.EndBefore > 0 {
+		filter.EndTime = &LogTimeBefore{Before: query.EndBefore}
+	}
+	if query.PlanBefore > 0 {
+		filter.PlanTime = &LogTimeBefore{Before: query.PlanBefore}
+	}
+	return
+}
+
+// 批量写入日志
+func (store *MongoLogStore) Append(logs []*JobLog) (err error) {
+	var (
+		docs   []interface{}
+		jobLog *JobLog
+	)
+	docs = make([]interface{}, 0, len(logs))
+	for _, jobLog = range logs {
+		docs = append(docs, jobLog)
+	}
+	_, err = store.logCollection.InsertMany(context.TODO(), docs)
+	return
+}
+
+// 查询日志
+func (store *MongoLogStore) Query(query *JobLogQuery) (logList []*JobLog, err error) {
+	var (
+		opts   []findopt.Find
+		cursor mongo.Cursor
+		jobLog *JobLog
+	)
+
+	// 倒排
+	if query.SortBy == JOB_LOG_SORT_BY_PLAN_TIME {
+		opts = append(opts, findopt.Sort(&SortLogByPlanTime{SortOrder: -1}))
+	} else {
+		opts = append(opts, findopt.Sort(&SortLogByStartTime{SortOrder: -1}))
+	}
+	if query.Skip > 0 {
+		opts = append(opts, findopt.Skip(int64(query.Skip)))
+	}
+	if query.Limit > 0 {
+		opts = append(opts, findopt.Limit(int64(query.Limit)))
+	}
+
+	// 查询
+	if cursor, err = store.logCollection.Find(context.TODO(), buildMongoLogFilter(query), opts...); err != nil {
+		return
+	}
+	// 延迟释放游标
+	defer cursor.Close(context.TODO())
+
+	logList = make([]*JobLog, 0)
+	for cursor.Next(context.TODO()) {
+		jobLog = &JobLog{}
+
+		// 反序列化BSON
+		if err = cursor.Decode(jobLog); err != nil {
+			err = nil
+			continue // 有日志不合法
+		}
+
+		logList = append(logList, jobLog)
+	}
+	return
+}
+
+// 删除日志
+func (store *MongoLogStore) Delete(query *JobLogQuery) (deleted int64, err error) {
+	var (
+		delResult *mongo.DeleteResult
+	)
+	if delResult, err = store.logCollection.DeleteMany(context.TODO(), buildMongoLogFilter(query)); err != nil {
+		return
+	}
+	deleted = delResult.DeletedCount
+	return
+}
+
+// 断开MongoDB连接
+func (store *MongoLogStore) Close(ctx context.Context) (err error) {
+	return store.client.Disconnect(ctx)
+}
@@ -3,16 +3,34 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorhill/cronexpr"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // 定时任务
 type Job struct {
-	Name     string `json:"name"`     // 任务名
-	Command  string `json:"command"`  // shell命令
-	CronExpr string `json:"cronExpr"` // cron表达式
+	Namespace  string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`   // 命名空间, 不同命名空间的任务可以重名
+	Name       string            `json:"name" yaml:"name"`                                 // 任务名
+	Command    string            `json:"command" yaml:"command"`                           // shell命令
+	CronExpr   string            `json:"cronExpr" yaml:"cronExpr"`                         // cron表达式
+	Selector   map[string]string `json:"selector,omitempty" yaml:"selector,omitempty"`     // 节点标签选择器, 只有标签全部匹配的worker才会调度该任务
+	ExecMode   string            `json:"execMode,omitempty" yaml:"execMode,omitempty"`     // 执行模式: 空表示抢锁单点执行, broadcast表示每个worker都执行, shard表示分片执行
+	ShardTotal int               `json:"shardTotal,omitempty" yaml:"shardTotal,omitempty"` // 分片数, 分片模式下每次调度拆分成ShardTotal个分片由不同worker执行
+	Disabled   bool              `json:"disabled,omitempty" yaml:"disabled,omitempty"`     // 停用, 保留任务定义但不调度
+
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"` // 任务说明
+	Owner       string   `json:"owner,omitempty" yaml:"owner,omitempty"`             // 负责人
+	Tags        []string `json:"tags,omitempty" yaml:"tags,omitempty"`               // 标签
+	CreateTime  int64    `json:"createTime,omitempty" yaml:"createTime,omitempty"`   // 创建时间, 毫秒, 由master保存时维护
+	UpdateTime  int64    `json:"updateTime,omitempty" yaml:"updateTime,omitempty"`   // 最后修改时间, 毫秒, 由master保存时维护
+	UpdatedBy   string   `json:"updatedBy,omitempty" yaml:"updatedBy,omitempty"`     // 最后修改人, 由master保存时维护
+	ManagedBy   string   `json:"managedBy,omitempty" yaml:"managedBy,omitempty"`     // 由声明式同步(apply)管理时为清单来源, 页面修改会被警告或禁止
+
+	ModRevision   int64  `json:"modRevision,omitempty" yaml:"-"`   // 任务在etcd中最后一次修改的revision, 只在查询时返回，不保存到etcd
+	LastRunStatus string `json:"lastRunStatus,omitempty" yaml:"-"` // 最近一次调度的状态, 只在查询时返回，不保存到etcd
 }
 
 // HTTP接口应答
@@ -42,19 +60,33 @@ type JobExecuteInfo struct {
 	RealTime   time.Time          // 真正实际执行时间
 	CancelCtx  context.Context    // 任务command的context
 	CancelFunc context.CancelFunc // 用于取消command执行的cancel函数
+	ShardIndex int                // 分片任务抢到的分片序号
+	Dispatch   *JobDispatch       // master分派的执行任务, 为nil表示worker自己调度
+}
+
+// master分派给worker的一次执行 /cron/dispatch/{worker}/{命名空间}/{任务名}/{计划时间}/{分片序号}
+type JobDispatch struct {
+	Job        *Job   `json:"job"`        // 任务信息
+	PlanTime   int64  `json:"planTime"`   // 计划开始时间, 毫秒
+	ShardIndex int    `json:"shardIndex"` // 分片序号
+	Worker     string `json:"worker"`     // 分派到的worker
+	Revision   int64  `json:"-"`          // 分派记录在etcd中的revision, 作为栅栏令牌
 }
 
 // 任务执行结果
 type JobExecuteResult struct {
-	ExecuteInfo *JobExecuteInfo // 执行状态信息
-	OutPut      []byte          // 输出信息
-	Err         error           // 脚本执行错误信息
-	StartTime   time.Time       // 启动时间
-	EndTime     time.Time       // 执行结束时间
+	ExecuteInfo  *JobExecuteInfo // 执行状态信息
+	OutPut       []byte          // 输出信息
+	Err          error           // 脚本执行错误信息
+	StartTime    time.Time       // 启动时间
+	EndTime      time.Time       // 执行结束时间
+	FencingToken int64           // 执行时持有锁的栅栏令牌
+	Partial      bool            // 分片任务执行完一个分片后还要继续抢其他分片, 任务仍在执行中
 }
 
 // 任务执行日志
 type JobLog struct {
+	Namespace    string `json:"namespace" bson:"namespace"`       // 命名空间
 	JobName      string `json:"jobName" bson:"jobName"`           // 任务名称
 	Command      string `json:"command" bson:"command"`           // 执行的命令
 	Err          string `json:"err" bson:"err"`                   // 脚本执行报错信息
@@ -63,16 +95,216 @@ type JobLog struct {
 	ScheduleTime int64  `json:"scheduleTime" bson:"scheduleTime"` // 实际调度时间
 	StartTime    int64  `json:"startTime" bson:"startTime"`       // 任务执行开始时间
 	EndTime      int64  `json:"endTime" bson:"endTime"`           // 任务执行结束时间
+	FencingToken int64  `json:"fencingToken" bson:"fencingToken"` // 执行时持有锁的栅栏令牌
+	Worker       string `json:"worker" bson:"worker"`             // 执行任务的worker节点
+	ShardIndex   int    `json:"shardIndex" bson:"shardIndex"`     // 分片序号
+	ShardTotal   int    `json:"shardTotal" bson:"shardTotal"`     // 分片总数, 非分片任务为0
+}
+
+// 一次调度(同一计划时间)在各个worker上的执行汇总
+type JobRun struct {
+	PlanTime  int64     `json:"planTime"`  // 计划开始时间
+	Succeeded []string  `json:"succeeded"` // 执行成功的worker
+	Failed    []string  `json:"failed"`    // 执行失败的worker
+	Logs      []*JobLog `json:"logs"`      // 各个worker的执行日志
+
+	ShardTotal int      `json:"shardTotal"`       // 分片总数, 非分片任务为0
+	Shards     []string `json:"shards,omitempty"` // 每个分片的状态, 下标为分片序号
+	Status     string   `json:"status"`           // 本次调度的整体状态
 }
 
 // 日志批次
 type LogBatch struct {
-	Logs []interface{} // 多条日志
+	Logs []*JobLog // 多条日志
+}
+
+// worker节点注册信息 /cron/workers/{workerId}
+type WorkerInfo struct {
+	Id        string            `json:"id"`        // 节点ID
+	IP        string            `json:"ip"`        // 节点公布的地址
+	Labels    map[string]string `json:"labels"`    // 节点标签
+	Running   int               `json:"running"`   // 正在执行的任务数
+	LoadAvg   float64           `json:"loadAvg"`   // 1分钟平均负载
+	MemFree   uint64            `json:"memFree"`   // 可用内存, 字节
+	UpdatedAt int64             `json:"updatedAt"` // 注册信息刷新时间, 毫秒
+	State     string            `json:"state"`     // 运维状态: 空/cordoned/draining
+	Drained   bool              `json:"drained"`   // 排空完成: 处于draining状态且没有正在执行的任务
+
+	Hostname    string   `json:"hostname"`    // 主机名
+	Version     string   `json:"version"`     // 程序版本
+	Pid         int      `json:"pid"`         // 进程ID
+	StartTime   int64    `json:"startTime"`   // 进程启动时间, 毫秒
+	Os          string   `json:"os"`          // 操作系统
+	Arch        string   `json:"arch"`        // CPU架构
+	CpuNum      int      `json:"cpuNum"`      // CPU核数
+	Capacity    int      `json:"capacity"`    // 配置的并发执行能力, 只用于展示, 0表示未配置
+	RunningJobs []string `json:"runningJobs"` // 正在执行的任务
+
+	WatchResyncs *WatchResyncStats `json:"watchResyncs,omitempty"` // etcd监听中断后重新同步的次数
+	Namespaces   []string          `json:"namespaces,omitempty"`   // 只执行这些命名空间的任务, 为空表示所有命名空间
+
+	LogStats *LogSinkStats `json:"logStats,omitempty"` // 日志写入计数
+}
+
+// worker各个监听中断后重新同步的次数, 从进程启动开始累计
+type WatchResyncStats struct {
+	Jobs        int64 `json:"jobs"`        // 任务监听
+	WorkerState int64 `json:"workerState"` // 运维状态监听
+	Dispatch    int64 `json:"dispatch"`    // 分派队列监听
+}
+
+// worker日志写入计数, 从进程启动开始累计
+type LogSinkStats struct {
+	Spooled   int64 `json:"spooled"`   // 写入失败或队列满时落盘的日志条数
+	Dropped   int64 `json:"dropped"`   // 丢弃的日志条数(未启用落盘时写入失败或队列满, 磁盘已满)
+	Flushed   int64 `json:"flushed"`   // 从磁盘重放成功的日志条数
+	Pending   int64 `json:"pending"`   // 磁盘上等待重放的日志条数
+	SpoolSize int64 `json:"spoolSize"` // 磁盘上等待重放的字节数
+}
+
+// worker运维状态 /cron/worker_state/{workerId}
+type WorkerState struct {
+	State     string `json:"state"`     // 空/cordoned/draining
+	UpdatedAt int64  `json:"updatedAt"` // 修改时间, 毫秒
+}
+
+// 任务的一个历史版本 /cron/history/{命名空间}/{任务名}/{时间戳}
+type JobVersion struct {
+	Revision     int64  `json:"revision"`               // 写入该版本时etcd的revision, 作为版本号
+	Op           string `json:"op"`                     // save/delete/rollback
+	Operator     string `json:"operator"`               // 操作人
+	Time         int64  `json:"time"`                   // 操作时间, 毫秒
+	Job          *Job   `json:"job"`                    // 完整的任务定义, 删除操作时为被删除的任务
+	RollbackFrom int64  `json:"rollbackFrom,omitempty"` // 回滚操作的来源版本
+}
+
+// 导入计划中的一个任务
+type JobImportItem struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Line      int    `json:"line,omitempty"`   // crontab文件中的行号
+	Reason    string `json:"reason,omitempty"` // 冲突或失败的原因
+}
+
+// 导入计划/结果, dryRun时只预览不写入
+type JobImportPlan struct {
+	DryRun    bool             `json:"dryRun"`
+	Creates   []*JobImportItem `json:"creates"`   // 新建
+	Updates   []*JobImportItem `json:"updates"`   // 覆盖已有任务
+	Unchanged []*JobImportItem `json:"unchanged"` // 与已有任务相同
+	Conflicts []*JobImportItem `json:"conflicts"` // 已有任务不同但没有指定覆盖、文件内重名或写入时被他人修改
+	Errors    []*JobImportItem `json:"errors"`    // 解析、校验或写入失败
+}
+
+// 回收站中被删除的任务
+type TrashJob struct {
+	Id         string `json:"id"`         // 删除时间戳, 同名任务可以多次删除
+	Namespace  string `json:"namespace"`  // 命名空间
+	Name       string `json:"name"`       // 任务名
+	DeleteTime int64  `json:"deleteTime"` // 删除时间, 毫秒
+	DeletedBy  string `json:"deletedBy"`  // 删除人
+	Job        *Job   `json:"job"`        // 被删除的任务定义
+}
+
+// 声明式同步计划/结果
+// 有错误时不应用任何修改; dryRun时只返回计划
+type JobApplyPlan struct {
+	DryRun    bool             `json:"dryRun"`
+	Applied   bool             `json:"applied"`   // 是否已经写入etcd
+	Creates   []*JobImportItem `json:"creates"`   // 新建
+	Updates   []*JobImportItem `json:"updates"`   // 更新
+	Deletes   []*JobImportItem `json:"deletes"`   // 删除: 清单中已经没有的受管任务, 以及prune时的非受管任务
+	Unchanged []*JobImportItem `json:"unchanged"` // 没有变化
+	Unmanaged []*JobImportItem `json:"unmanaged"` // 清单中没有、也不归本来源管理的任务, 保留不动
+	Errors    []*JobImportItem `json:"errors"`    // 校验失败、清单内重名或由其他来源管理
+}
+
+// 任务列表过滤条件, 空字段不过滤
+type JobListFilter struct {
+	NamePrefix    string // 任务名前缀
+	Tag           string // 包含该标签
+	Owner         string // 负责人
+	Keyword       string // 任务名、说明或命令中包含该关键字, 不区分大小写
+	State         string // enabled/disabled
+	LastRunStatus string // 最近一次调度的状态, 需要先查询并填充任务的LastRunStatus
+}
+
+// 任务列表分页查询
+type JobListQuery struct {
+	Filter   JobListFilter
+	SortBy   string // name/createTime/updateTime, 相同时按任务名排序
+	Desc     bool   // 倒序
+	Page     int    // 页码, 从1开始
+	PageSize int    // 每页任务数
+}
+
+// 任务列表的一页
+type JobListPage struct {
+	Total    int    `json:"total"`    // 满足过滤条件的任务数
+	Enabled  int    `json:"enabled"`  // 其中启用的任务数
+	Disabled int    `json:"disabled"` // 其中停用的任务数
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	Jobs     []*Job `json:"jobs"`
+}
+
+// 任务是否满足过滤条件
+func (filter *JobListFilter) Match(job *Job) bool {
+	var (
+		tag     string
+		found   bool
+		keyword string
+	)
+	if filter.Tag != "" {
+		for _, tag = range job.Tags {
+			if tag == filter.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.NamePrefix != "" && !strings.HasPrefix(job.Name, filter.NamePrefix) {
+		return false
+	}
+	if filter.Owner != "" && job.Owner != filter.Owner {
+		return false
+	}
+	if filter.State == JOB_STATE_ENABLED && job.Disabled || filter.State == JOB_STATE_DISABLED && !job.Disabled {
+		return false
+	}
+	if filter.LastRunStatus != "" && job.LastRunStatus != filter.LastRunStatus {
+		return false
+	}
+	if filter.Keyword != "" {
+		keyword = strings.ToLower(filter.Keyword)
+		if !strings.Contains(strings.ToLower(job.Name), keyword) &&
+			!strings.Contains(strings.ToLower(job.Description), keyword) &&
+			!strings.Contains(strings.ToLower(job.Command), keyword) {
+			return false
+		}
+	}
+	return true
 }
 
-// 任务日志过滤条件
+// 任务日志过滤条件, 空值表示不限制
 type JobLogFilter struct {
-	JobName string `bson:"jobName"`
+	Namespace interface{}    `bson:"namespace,omitempty"`
+	JobName   string         `bson:"jobName,omitempty"`
+	EndTime   *LogTimeBefore `bson:"endTime,omitempty"`
+	PlanTime  *LogTimeBefore `bson:"planTime,omitempty"`
+}
+
+// 取值在列表中
+type LogValueIn struct {
+	In []interface{} `bson:"$in"` // {$in: [...]}
+}
+
+// 时间早于
+type LogTimeBefore struct {
+	Before int64 `bson:"$lt"` // {$lt: 毫秒}
 }
 
 // 任务日志排序规则
@@ -80,6 +312,11 @@ type SortLogByStartTime struct {
 	SortOrder int `bson:"startTime"` // {startTime: -1}
 }
 
+// 按计划时间排序
+type SortLogByPlanTime struct {
+	SortOrder int `bson:"planTime"` // {planTime: -1}
+}
+
 // 应答方法,构建一个应答
 func BuildResponse(errno int, msg string, data interface{}) (resp []byte, err error) {
 	// 1.定义一个Response对象
@@ -110,6 +347,271 @@ func UnpackJob(value []byte) (ret *Job, err error) {
 	return
 }
 
+// 根据etcd中的key反序列化Job, 命名空间以key为准
+func UnpackJobFromKey(jobKey string, value []byte) (ret *Job, err error) {
+	if ret, err = UnpackJob(value); err != nil {
+		return
+	}
+	ret.Namespace, _ = ExtractJobName(jobKey)
+	return
+}
+
+// 命名空间为空时使用默认命名空间
+func NormalizeNamespace(namespace string) string {
+	if namespace == "" {
+		return JOB_NAMESPACE_DEFAULT
+	}
+	return namespace
+}
+
+// 校验命名空间, 命名空间是etcd路径的一段
+func IsValidNamespace(namespace string) bool {
+	return namespace != "" && !strings.Contains(namespace, "/")
+}
+
+// 任务在调度表、执行表中的唯一名称 命名空间/任务名
+func JobFullName(namespace string, jobName string) string {
+	return namespace + "/" + jobName
+}
+
+// 构造任务路径 /cron/jobs/命名空间/任务名
+func BuildJobKey(namespace string, jobName string) string {
+	return JOB_SAVE_DIR + namespace + "/" + jobName
+}
+
+// 构造强杀路径 /cron/killer/命名空间/任务名
+func BuildKillerKey(namespace string, jobName string) string {
+	return JOB_KILLER_DIR + namespace + "/" + jobName
+}
+
+// 构造任务锁路径 /cron/lock/命名空间/任务名
+func BuildJobLockKey(namespace string, jobName string) string {
+	return JOB_LOCK_DIR + namespace + "/" + jobName
+}
+
+// 节点是否执行该命名空间的任务, 未限制命名空间时执行所有任务
+func ServesNamespace(namespaces []string, namespace string) bool {
+	var (
+		allowed string
+	)
+	if len(namespaces) == 0 {
+		return true
+	}
+	for _, allowed = range namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// 反序列化worker注册信息, 兼容旧版本只写了"online"的注册值
+func UnpackWorkerInfo(regKey string, value []byte) (workerInfo *WorkerInfo) {
+	workerInfo = &WorkerInfo{}
+	if err := json.Unmarshal(value, workerInfo); err != nil {
+		workerInfo = &WorkerInfo{}
+	}
+	// ID以注册路径为准, 旧版本没有上报地址时ID就是IP
+	workerInfo.Id = ExtractWorkerId(regKey)
+	if workerInfo.IP == "" {
+		workerInfo.IP = workerInfo.Id
+	}
+	return
+}
+
+// 构造任务版本目录 /cron/history/命名空间/任务名/
+func BuildJobVersionDir(namespace string, jobName string) string {
+	return JOB_HISTORY_DIR + namespace + "/" + jobName + "/"
+}
+
+// 构造任务版本路径, 时间戳补齐位数保证按key排序就是按时间排序
+func BuildJobVersionKey(namespace string, jobName string, now time.Time) string {
+	return BuildJobVersionDir(namespace, jobName) + fmt.Sprintf("%020d", now.UnixNano())
+}
+
+// 构造回收站目录 /cron/trash/命名空间/任务名/
+func BuildTrashDir(namespace string, jobName string) string {
+	return JOB_TRASH_DIR + namespace + "/" + jobName + "/"
+}
+
+// 构造回收站路径, 删除时间戳补齐位数保证按key排序就是按删除时间排序
+func BuildTrashKey(namespace string, jobName string, id string) string {
+	return BuildTrashDir(namespace, jobName) + id
+}
+
+// 回收站中的ID, 取删除时间戳
+func BuildTrashId(now time.Time) string {
+	return fmt.Sprintf("%020d", now.UnixNano())
+}
+
+// 反序列化回收站中的任务, 命名空间、任务名和ID以key为准
+func UnpackTrashJob(trashKey string, value []byte) (trashJob *TrashJob, err error) {
+	var (
+		parts []string
+	)
+	trashJob = &TrashJob{}
+	if err = json.Unmarshal(value, trashJob); err != nil {
+		return
+	}
+	if parts = strings.Split(strings.TrimPrefix(trashKey, JOB_TRASH_DIR), "/"); len(parts) == 3 {
+		trashJob.Namespace, trashJob.Name, trashJob.Id = parts[0], parts[1], parts[2]
+	}
+	return
+}
+
+// 反序列化任务版本, 版本号取该key创建时的revision
+func UnpackJobVersion(value []byte, revision int64) (version *JobVersion, err error) {
+	version = &JobVersion{}
+	if err = json.Unmarshal(value, version); err != nil {
+		return
+	}
+	version.Revision = revision
+	return
+}
+
+// 校验任务执行模式
+func IsValidExecMode(execMode string) bool {
+	switch execMode {
+	case JOB_EXEC_MODE_SINGLE, JOB_EXEC_MODE_BROADCAST, JOB_EXEC_MODE_SHARD:
+		return true
+	}
+	return false
+}
+
+// 校验任务内容: 任务名、执行模式、分片数以及cron表达式
+func ValidateJob(job *Job) (err error) {
+	if job.Name == "" {
+		return ERR_EMPTY_JOB_NAME
+	}
+	if strings.Contains(job.Name, "/") {
+		return ERR_INVALID_JOB_NAME
+	}
+	if !IsValidExecMode(job.ExecMode) {
+		return ERR_INVALID_EXEC_MODE
+	}
+	if job.ExecMode == JOB_EXEC_MODE_SHARD && job.ShardTotal <= 0 {
+		return ERR_INVALID_SHARD_TOTAL
+	}
+	_, err = cronexpr.Parse(job.CronExpr)
+	return
+}
+
+// 构造分片锁路径 /cron/lock/命名空间/任务名/计划时间/分片序号
+// 路径带上计划时间，保证同一次调度的同一分片只会被一个worker抢到
+func BuildShardLockKey(namespace string, jobName string, planTime time.Time, shardIndex int) string {
+	return BuildJobLockKey(namespace, jobName) + "/" + strconv.FormatInt(planTime.Unix(), 10) + "/" + strconv.Itoa(shardIndex)
+}
+
+// 计算分片锁执行完成后的保留时间，单位秒
+// 保留到计划时间之后的第二个调度时间，晚到的worker在此之前仍能看到分片已执行；
+// 之后同一计划时间不会再被调度，锁不必继续占用存储，最长不超过JOB_SHARD_LOCK_RETAIN
+func BuildShardLockRetain(job *Job, planTime time.Time) (retainTtl int64) {
+	var (
+		expr     *cronexpr.Expression
+		err      error
+		nextTime time.Time
+	)
+	retainTtl = JOB_SHARD_LOCK_RETAIN
+	if expr, err = cronexpr.Parse(job.CronExpr); err != nil {
+		return
+	}
+	if nextTime = expr.Next(expr.Next(planTime)); nextTime.IsZero() {
+		return
+	}
+	if retainTtl = int64(time.Until(nextTime) / time.Second); retainTtl > JOB_SHARD_LOCK_RETAIN {
+		retainTtl = JOB_SHARD_LOCK_RETAIN
+	}
+	if retainTtl < 1 {
+		retainTtl = 1
+	}
+	return
+}
+
+// 构造分派路径
+func BuildDispatchKey(worker string, namespace string, jobName string, planTime time.Time, shardIndex int) string {
+	return JOB_DISPATCH_DIR + worker + "/" + namespace + "/" + jobName + "/" + strconv.FormatInt(planTime.Unix(), 10) + "/" + strconv.Itoa(shardIndex)
+}
+
+// 反序列化分派记录
+func UnpackJobDispatch(value []byte) (ret *JobDispatch, err error) {
+	var (
+		dispatch *JobDispatch
+	)
+	dispatch = &JobDispatch{}
+
+	if err = json.Unmarshal(value, dispatch); err != nil {
+		return
+	}
+	if dispatch.Job == nil {
+		err = ERR_INVALID_DISPATCH
+		return
+	}
+	ret = dispatch
+	return
+}
+
+// 根据分派记录构造执行状态信息
+func BuildDispatchExecuteInfo(dispatch *JobDispatch) (jobExecuteInfo *JobExecuteInfo) {
+	jobExecuteInfo = &JobExecuteInfo{
+		Job:        dispatch.Job,
+		PlanTime:   time.Unix(0, dispatch.PlanTime*int64(time.Millisecond)),
+		RealTime:   time.Now(),
+		ShardIndex: dispatch.ShardIndex,
+		Dispatch:   dispatch,
+	}
+	jobExecuteInfo.CancelCtx, jobExecuteInfo.CancelFunc = context.WithCancel(context.TODO())
+	return
+}
+
+// 提取worker运维状态路径中的节点ID
+func ExtractWorkerStateId(stateKey string) string {
+	return strings.TrimPrefix(stateKey, JOB_WORKER_STATE_DIR)
+}
+
+// 反序列化worker运维状态
+func UnpackWorkerState(value []byte) (workerState *WorkerState, err error) {
+	workerState = &WorkerState{}
+	err = json.Unmarshal(value, workerState)
+	return
+}
+
+// 校验worker运维状态
+func IsValidWorkerState(state string) bool {
+	switch state {
+	case WORKER_STATE_ACTIVE, WORKER_STATE_CORDONED, WORKER_STATE_DRAINING:
+		return true
+	}
+	return false
+}
+
+// 节点负载评分, 越小越空闲
+// 可用内存越少评分越高, 内存接近耗尽时约相当于多执行一个任务, 可用内存未知(0)时不计入
+func WorkerLoadScore(workerInfo *WorkerInfo) float64 {
+	var (
+		memScore float64
+	)
+	if workerInfo.MemFree > 0 {
+		memScore = 1 / (1 + float64(workerInfo.MemFree)/WORKER_MEM_SCORE_UNIT)
+	}
+	return float64(workerInfo.Running) + workerInfo.LoadAvg + memScore
+}
+
+// 判断节点标签是否满足任务的标签选择器, 选择器为空匹配所有节点
+func MatchSelector(selector map[string]string, labels map[string]string) bool {
+	var (
+		key   string
+		value string
+		label string
+		ok    bool
+	)
+	for key, value = range selector {
+		if label, ok = labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
+}
+
 // 任务变化事件 1:更新 2:删除
 func BuildJobEvent(eventType int, job *Job) (jobEvent *JobEvent) {
 	return &JobEvent{
@@ -118,18 +620,29 @@ func BuildJobEvent(eventType int, job *Job) (jobEvent *JobEvent) {
 	}
 }
 
-// 从Etcd的key中提取任务名
-func ExtractJobName(jobKey string) string {
-	return strings.TrimPrefix(jobKey, JOB_SAVE_DIR)
+// 从Etcd的key中提取命名空间和任务名
+func ExtractJobName(jobKey string) (namespace string, jobName string) {
+	return splitNamespaceKey(strings.TrimPrefix(jobKey, JOB_SAVE_DIR))
 }
 
-// 从Etcd的key中提要杀死的取任务名
-func ExtractKillerName(killerKey string) string {
-	return strings.TrimPrefix(killerKey, JOB_KILLER_DIR)
+// 从Etcd的key中提要杀死的取命名空间和任务名
+func ExtractKillerName(killerKey string) (namespace string, jobName string) {
+	return splitNamespaceKey(strings.TrimPrefix(killerKey, JOB_KILLER_DIR))
+}
+
+// 拆分 命名空间/任务名, 旧版本没有命名空间的key属于默认命名空间
+func splitNamespaceKey(key string) (namespace string, jobName string) {
+	var (
+		index int
+	)
+	if index = strings.Index(key, "/"); index < 0 {
+		return JOB_NAMESPACE_DEFAULT, key
+	}
+	return key[:index], key[index+1:]
 }
 
-// 提取worker节点IP
-func ExtractWorkerIP(regKey string) string {
+// 提取worker节点ID
+func ExtractWorkerId(regKey string) string {
 	return strings.TrimPrefix(regKey, JOB_WORK_DIR)
 }
 
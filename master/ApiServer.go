@@ -1,8 +1,11 @@
 package master
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"strconv"
@@ -20,14 +23,21 @@ type ApiServer struct {
 }
 
 // 保存任务接口
-// POST job = {"name": "job1", "command": "echo hello", "cronExpr": "* * * * *"}
+// POST namespace = default job = {"name": "job1", "command": "echo hello", "cronExpr": "* * * * *", "selector": {"zone": "bj"}}
+// force = true 时即使没有在线worker满足选择器也保存, 也用于确认修改声明式管理的任务
+// revision = /job/list返回的modRevision, 任务已被其他人修改时拒绝保存; 0表示新建; 不传表示不检查
 func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 	var (
-		err     error
-		postJob string
-		job     common.Job
-		oldJob  *common.Job
-		bytes   []byte
+		err       error
+		postJob   string
+		job       common.Job
+		oldJob    *common.Job
+		bytes     []byte
+		force     bool
+		matched   bool
+		revision  int64
+		namespace string
+		existJob  *common.Job
 	)
 	// 任务保存到etcd中
 	// 1. 解析POST表单
@@ -44,44 +54,92 @@ func handleJobSave(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	// 4.保存到Etcd
-	if oldJob, err = G_jobMgr.SaveJob(&job); err != nil {
+	// 命名空间以表单为准
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+	job.Namespace = namespace
+
+	// 4.校验任务名、执行模式和cron表达式
+	if err = common.ValidateJob(&job); err != nil {
+		goto ERR
+	}
+
+	// 声明式管理的任务需要确认, 保存后仍然由原来源管理; 页面不能把任务标记为受管
+	force, _ = strconv.ParseBool(req.PostForm.Get("force"))
+	if existJob, err = checkManagedJob(job.Namespace, job.Name, force); err != nil {
+		goto ERR
+	}
+	job.ManagedBy = ""
+	if existJob != nil {
+		job.ManagedBy = existJob.ManagedBy
+	}
+
+	// 设置了选择器的任务，检查是否有在线worker能够运行
+	if !force && len(job.Selector) != 0 {
+		if matched, err = G_workerMgr.HasMatchingWorker(job.Namespace, job.Selector); err != nil {
+			goto ERR
+		}
+		if !matched {
+			err = common.ERR_NO_MATCHING_WORKER
+			goto ERR
+		}
+	}
+
+	// 5.保存到Etcd
+	if revision, err = formRevision(req); err != nil {
+		goto ERR
+	}
+	if oldJob, err = G_jobMgr.SaveJob(&job, revision, requestOperator(req)); err != nil {
 		goto ERR
 	}
 
-	// 5.返回正常应答
+	// 6.返回正常应答
 	if bytes, err = common.BuildResponse(0, "success", oldJob); err == nil { // 正常响应 err 应该为 nil
 		resp.Write(bytes)
 	}
 
 	return
 ERR:
-	// 返回异常应答
-	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+	// 返回异常应答, 冲突时带上任务的当前值
+	if bytes, err = common.BuildResponse(-1, err.Error(), oldJob); err == nil {
 		resp.Write(bytes)
 	}
 }
 
 // 删除任务接口
-// POST /job/delete  name = job1
+// POST /job/delete  namespace = default name = job1 revision = 123(可选) force = true(确认删除声明式管理的任务)
 func handleJobDelete(resp http.ResponseWriter, req *http.Request) {
 	var (
-		name   string
-		err    error
-		oldJob *common.Job
-		bytes  []byte
+		name      string
+		err       error
+		oldJob    *common.Job
+		bytes     []byte
+		revision  int64
+		namespace string
+		force     bool
 	)
 
 	// 解析Form表单
 	if err = req.ParseForm(); err != nil {
 		goto ERR
 	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
 
 	// 获取到要删除的任务名称
 	name = req.PostForm.Get("name")
+	force, _ = strconv.ParseBool(req.PostForm.Get("force"))
+	if _, err = checkManagedJob(namespace, name, force); err != nil {
+		goto ERR
+	}
 
 	// 通过任务名去删除任务
-	if oldJob, err = G_jobMgr.DeleteJob(name); err != nil {
+	if revision, err = formRevision(req); err != nil {
+		goto ERR
+	}
+	if oldJob, err = G_jobMgr.DeleteJob(namespace, name, revision, requestOperator(req)); err != nil {
 		goto ERR
 	}
 
@@ -96,21 +154,461 @@ ERR:
 	}
 }
 
-// 获取所有任务的列表
+// 任务版本历史
+// GET /job/history?namespace=default&name=job1
+func handleJobHistory(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err         error
+		name        string
+		versionList []*common.JobVersion
+		bytes       []byte
+		namespace   string
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+	name = req.Form.Get("name")
+
+	if versionList, err = G_jobMgr.ListJobVersions(namespace, name); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", versionList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 回滚任务到指定版本
+// POST /job/rollback namespace=default name=job1 revision=123
+func handleJobRollback(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		name      string
+		revision  int64
+		job       *common.Job
+		bytes     []byte
+		namespace string
+		force     bool
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+	name = req.PostForm.Get("name")
+	if revision, err = strconv.ParseInt(req.PostForm.Get("revision"), 10, 64); err != nil {
+		goto ERR
+	}
+	force, _ = strconv.ParseBool(req.PostForm.Get("force"))
+	if _, err = checkManagedJob(namespace, name, force); err != nil {
+		goto ERR
+	}
+
+	if job, err = G_jobMgr.RollbackJob(namespace, name, revision, requestOperator(req)); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 页面修改声明式同步管理的任务: block策略直接拒绝, warn策略需要force确认
+func checkManagedJob(namespace string, name string, force bool) (existJob *common.Job, err error) {
+	if existJob, err = G_jobMgr.GetJob(namespace, name); err != nil || existJob == nil || existJob.ManagedBy == "" {
+		return
+	}
+	if G_config.ManagedJobPolicy == common.MANAGED_JOB_POLICY_BLOCK {
+		err = common.ERR_JOB_MANAGED_BLOCKED
+	} else if !force {
+		err = common.ERR_JOB_MANAGED
+	}
+	return
+}
+
+// 请求中的命名空间, 不传时为默认命名空间
+func formNamespace(req *http.Request) (namespace string, err error) {
+	namespace = common.NormalizeNamespace(req.Form.Get("namespace"))
+	if !common.IsValidNamespace(namespace) {
+		err = common.ERR_INVALID_NAMESPACE
+	}
+	return
+}
+
+// 命名空间列表
+// GET /namespace/list
+func handleNamespaceList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		namespaces []string
+		bytes      []byte
+		err        error
+	)
+
+	if namespaces, err = G_jobMgr.ListNamespaces(); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", namespaces); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 表单中期望的任务revision, 不传时不检查
+func formRevision(req *http.Request) (revision int64, err error) {
+	var (
+		value string
+	)
+	if value = req.PostForm.Get("revision"); value == "" {
+		revision = common.JOB_REVISION_ANY
+		return
+	}
+	revision, err = strconv.ParseInt(value, 10, 64)
+	return
+}
+
+// 操作人: 优先取X-Operator请求头，其次是表单中的operator，都没有时记录客户端地址
+func requestOperator(req *http.Request) (operator string) {
+	var (
+		err error
+	)
+	if operator = req.Header.Get(common.JOB_OPERATOR_HEADER); operator != "" {
+		return
+	}
+	if operator = req.Form.Get("operator"); operator != "" {
+		return
+	}
+	if operator, _, err = net.SplitHostPort(req.RemoteAddr); err != nil {
+		operator = req.RemoteAddr
+	}
+	return
+}
+
+// 分页获取命名空间下的任务列表
+// GET /job/list?namespace=default&page=1&pageSize=20&sort=name|createTime|updateTime&order=asc|desc
+// 过滤条件都可选: prefix=任务名前缀 tag=backup owner=alice keyword=mysql state=enabled|disabled lastStatus=success|failed|incomplete|none
+// 传了page或pageSize时返回分页结果JobListPage, 都不传时与旧版本一样返回所有任务的数组
 func handleJobList(resp http.ResponseWriter, req *http.Request) {
 	var (
-		jobList []*common.Job
-		bytes   []byte
-		err     error
+		query     *common.JobListQuery
+		page      *common.JobListPage
+		paged     bool
+		bytes     []byte
+		err       error
+		namespace string
 	)
 
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+
+	// 过滤、排序和分页参数
+	query = &common.JobListQuery{
+		Filter: common.JobListFilter{
+			NamePrefix:    req.Form.Get("prefix"),
+			Tag:           req.Form.Get("tag"),
+			Owner:         req.Form.Get("owner"),
+			Keyword:       req.Form.Get("keyword"),
+			State:         req.Form.Get("state"),
+			LastRunStatus: req.Form.Get("lastStatus"),
+		},
+		SortBy: req.Form.Get("sort"),
+		Desc:   req.Form.Get("order") == "desc",
+	}
+	if query.Page, err = strconv.Atoi(req.Form.Get("page")); err != nil || query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize, err = strconv.Atoi(req.Form.Get("pageSize")); err != nil || query.PageSize < 1 {
+		query.PageSize = common.JOB_LIST_PAGE_SIZE
+	}
+	if query.PageSize > common.JOB_LIST_MAX_PAGE_SIZE {
+		query.PageSize = common.JOB_LIST_MAX_PAGE_SIZE
+	}
+	// 没有分页参数时兼容旧接口, 返回任务数组
+	if paged = req.Form.Get("page") != "" || req.Form.Get("pageSize") != ""; !paged {
+		query.PageSize = 0
+	}
+
 	// 获取任务列表
-	if jobList, err = G_jobMgr.ListJobs(); err != nil {
+	if page, err = QueryJobs(namespace, query); err != nil {
 		goto ERR
 	}
 
 	// 正常应答
-	if bytes, err = common.BuildResponse(0, "success", jobList); err == nil {
+	if !paged {
+		bytes, err = common.BuildResponse(0, "success", page.Jobs)
+	} else {
+		bytes, err = common.BuildResponse(0, "success", page)
+	}
+	if err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 导出任务
+// GET /job/export?namespace=default&format=json|yaml, namespace为空时导出所有命名空间
+func handleJobExport(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		format    string
+		jobList   []*common.Job
+		content   []byte
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace = req.Form.Get("namespace"); namespace != "" && !common.IsValidNamespace(namespace) {
+		err = common.ERR_INVALID_NAMESPACE
+		goto ERR
+	}
+	if format = req.Form.Get("format"); format == "" {
+		format = common.JOB_FORMAT_JSON
+	}
+
+	if jobList, err = G_jobMgr.ExportJobs(namespace); err != nil {
+		goto ERR
+	}
+	if content, err = EncodeJobs(jobList, format); err != nil {
+		goto ERR
+	}
+
+	// 以文件下载的方式返回
+	resp.Header().Set("Content-Disposition", "attachment; filename=jobs."+format)
+	resp.Write(content)
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 导入任务
+// POST /job/import  format = json|yaml|crontab  content = 文件内容(或以multipart上传file)
+// namespace = 导入到的命名空间, 为空时使用文件中的命名空间(crontab为默认命名空间)
+// overwrite = true 时覆盖内容不同的已有任务, dryRun = true 时只返回导入计划
+func handleJobImport(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		format    string
+		content   []byte
+		file      multipart.File
+		overwrite bool
+		dryRun    bool
+		plan      *common.JobImportPlan
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace = req.Form.Get("namespace"); namespace != "" && !common.IsValidNamespace(namespace) {
+		err = common.ERR_INVALID_NAMESPACE
+		goto ERR
+	}
+	if format = req.Form.Get("format"); format == "" {
+		format = common.JOB_FORMAT_JSON
+	}
+	overwrite, _ = strconv.ParseBool(req.Form.Get("overwrite"))
+	dryRun, _ = strconv.ParseBool(req.Form.Get("dryRun"))
+
+	// 导入内容: 优先取表单字段, 其次是上传的文件
+	if content = []byte(req.PostForm.Get("content")); len(content) == 0 {
+		if file, _, err = req.FormFile("file"); err != nil {
+			goto ERR
+		}
+		content, err = ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			goto ERR
+		}
+	}
+
+	if plan, err = G_jobMgr.ImportJobs(content, format, namespace, overwrite, dryRun, requestOperator(req)); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", plan); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 声明式同步
+// POST /job/apply  format = json|yaml  content = 清单(任务列表)
+// namespace = 清单中任务的命名空间, 为空时使用清单中的命名空间
+// source = 清单来源, 默认apply; prune = true 时删除清单中没有的非受管任务; dryRun = true 时只返回计划
+func handleJobApply(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		format    string
+		entries   []*importEntry
+		entry     *importEntry
+		jobList   []*common.Job
+		prune     bool
+		dryRun    bool
+		plan      *common.JobApplyPlan
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace = req.Form.Get("namespace"); namespace != "" && !common.IsValidNamespace(namespace) {
+		err = common.ERR_INVALID_NAMESPACE
+		goto ERR
+	}
+	if format = req.Form.Get("format"); format == "" {
+		format = common.JOB_FORMAT_YAML
+	}
+	prune, _ = strconv.ParseBool(req.Form.Get("prune"))
+	dryRun, _ = strconv.ParseBool(req.Form.Get("dryRun"))
+
+	if entries, _, err = decodeJobs([]byte(req.PostForm.Get("content")), format); err != nil {
+		goto ERR
+	}
+	jobList = make([]*common.Job, 0, len(entries))
+	for _, entry = range entries {
+		jobList = append(jobList, entry.job)
+	}
+
+	if plan, err = G_jobMgr.ApplyJobs(jobList, namespace, req.Form.Get("source"), prune, dryRun, requestOperator(req)); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", plan); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	// 清单有错误或者冲突时带上计划
+	if bytes, err = common.BuildResponse(-1, err.Error(), plan); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 回收站列表
+// GET /trash/list?namespace=default&name=job1, name为空时列出命名空间下所有被删除的任务
+func handleTrashList(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		trashList []*common.TrashJob
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+
+	if trashList, err = G_jobMgr.ListTrash(namespace, req.Form.Get("name")); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", trashList); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 从回收站恢复任务, 同名任务已存在时返回任务的当前值
+// POST /trash/restore  namespace = default name = job1 id = /trash/list返回的id
+func handleTrashRestore(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		job       *common.Job
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+
+	if job, err = G_jobMgr.RestoreJob(namespace, req.PostForm.Get("name"), req.PostForm.Get("id"), requestOperator(req)); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", job); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), job); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 彻底删除回收站中的任务
+// POST /trash/purge  namespace = default name = job1 id = 123
+// id为空时删除该任务名的所有记录; 清空命名空间的回收站需要明确传all = true
+func handleTrashPurge(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		name      string
+		purged    int64
+		bytes     []byte
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+
+	// 漏传任务名时不能默认清空整个回收站
+	if name = req.PostForm.Get("name"); name == "" && req.PostForm.Get("all") != "true" {
+		err = common.ERR_TRASH_PURGE_ALL
+		goto ERR
+	}
+
+	if purged, err = G_jobMgr.PurgeTrash(namespace, name, req.PostForm.Get("id")); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", purged); err == nil {
 		resp.Write(bytes)
 	}
 	return
@@ -123,21 +621,25 @@ ERR:
 // 强杀任务
 func handleJobKill(resp http.ResponseWriter, req *http.Request) {
 	var (
-		name  string
-		bytes []byte
-		err   error
+		name      string
+		bytes     []byte
+		err       error
+		namespace string
 	)
 
 	// 解析POST表单
 	if err = req.ParseForm(); err != nil {
 		goto ERR
 	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
 
 	// 获取要杀死的任务
 	name = req.PostForm.Get("name")
 
 	// 杀死任务
-	if err = G_jobMgr.KillJob(name); err != nil {
+	if err = G_jobMgr.KillJob(namespace, name); err != nil {
 		goto ERR
 	}
 
@@ -163,6 +665,7 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		limit      int
 		logArr     []*common.JobLog
 		bytes      []byte
+		namespace  string
 	)
 
 	// 解析GET参数
@@ -170,7 +673,10 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		goto ERR
 	}
 
-	// 获取请求参数 /job/log?name=job10&skip=0&limit=10
+	// 获取请求参数 /job/log?namespace=default&name=job10&skip=0&limit=10
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
 	name = req.Form.Get("name")
 	skipParam = req.Form.Get("skip")
 	limitParam = req.Form.Get("limit")
@@ -181,7 +687,7 @@ func handleJobLog(resp http.ResponseWriter, req *http.Request) {
 		limit = common.LOG_LIMIT_NUM
 	}
 
-	if logArr, err = G_logMgr.ListLog(name, skip, limit); err != nil {
+	if logArr, err = G_logMgr.ListLog(namespace, name, skip, limit); err != nil {
 		goto ERR
 	}
 
@@ -197,10 +703,92 @@ ERR:
 	}
 }
 
+// 删除任务日志
+// POST /job/log/purge  namespace = default name = job1 before = 1600000000000(可选, 只删除结束时间早于它的日志, 毫秒)
+func handleJobLogPurge(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		namespace string
+		before    int64
+		deleted   int64
+		bytes     []byte
+		value     string
+	)
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+	if value = req.PostForm.Get("before"); value != "" {
+		if before, err = strconv.ParseInt(value, 10, 64); err != nil {
+			goto ERR
+		}
+	}
+
+	if deleted, err = G_logMgr.PurgeLogs(namespace, req.PostForm.Get("name"), before); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", deleted); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
+// 执行记录查询, 按计划时间汇总各个worker的执行结果
+// GET /job/run?namespace=default&name=job10&skip=0&limit=10
+func handleJobRun(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err       error
+		name      string
+		skip      int
+		limit     int
+		runArr    []*common.JobRun
+		bytes     []byte
+		namespace string
+	)
+
+	// 解析GET参数
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	if namespace, err = formNamespace(req); err != nil {
+		goto ERR
+	}
+
+	name = req.Form.Get("name")
+	if skip, err = strconv.Atoi(req.Form.Get("skip")); err != nil {
+		skip = common.LOG_SKIP_NUM
+	}
+	if limit, err = strconv.Atoi(req.Form.Get("limit")); err != nil {
+		limit = common.LOG_LIMIT_NUM
+	}
+
+	if runArr, err = G_logMgr.ListRuns(namespace, name, skip, limit); err != nil {
+		goto ERR
+	}
+
+	// 正常应答
+	if bytes, err = common.BuildResponse(0, "success", runArr); err == nil {
+		resp.Write(bytes)
+	}
+	return
+
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
 // 健康节点
 func handleWorkerList(resp http.ResponseWriter, req *http.Request) {
 	var (
-		workerArr []string
+		workerArr []*common.WorkerInfo
 		err       error
 		bytes     []byte
 	)
@@ -220,6 +808,85 @@ ERR:
 	}
 }
 
+// 表单中的worker ID, 兼容旧版本的ip参数
+func formWorkerId(req *http.Request) (workerId string) {
+	if workerId = req.PostForm.Get("id"); workerId == "" {
+		workerId = req.PostForm.Get("ip")
+	}
+	return
+}
+
+// 修改worker运维状态
+// POST /worker/cordon id=192.168.2.1  封锁: 不再接收新任务
+// POST /worker/uncordon id=192.168.2.1  解除封锁
+func handleWorkerState(state string) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var (
+			err      error
+			workerId string
+			bytes    []byte
+		)
+
+		if err = req.ParseForm(); err != nil {
+			goto ERR
+		}
+		workerId = formWorkerId(req)
+
+		if err = G_workerMgr.SetWorkerState(workerId, state); err != nil {
+			goto ERR
+		}
+
+		if bytes, err = common.BuildResponse(0, "success", nil); err == nil {
+			resp.Write(bytes)
+		}
+		return
+	ERR:
+		if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+			resp.Write(bytes)
+		}
+	}
+}
+
+// 排空worker: 封锁并等待正在执行的任务结束
+// POST /worker/drain id=192.168.2.1 timeout=60000(毫秒, 0表示不等待)
+func handleWorkerDrain(resp http.ResponseWriter, req *http.Request) {
+	var (
+		err        error
+		workerId   string
+		timeout    int
+		workerInfo *common.WorkerInfo
+		bytes      []byte
+	)
+
+	if err = req.ParseForm(); err != nil {
+		goto ERR
+	}
+	workerId = formWorkerId(req)
+	if timeout, err = strconv.Atoi(req.PostForm.Get("timeout")); err != nil {
+		timeout = 0
+	}
+	// 等待时间不能超过HTTP写超时，否则应答无法返回
+	if timeout > G_config.ApiWriteTimeout-1000 {
+		timeout = G_config.ApiWriteTimeout - 1000
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+
+	if workerInfo, err = G_workerMgr.DrainWorker(workerId, time.Duration(timeout)*time.Millisecond); err != nil {
+		goto ERR
+	}
+
+	if bytes, err = common.BuildResponse(0, "success", workerInfo); err == nil {
+		resp.Write(bytes)
+	}
+	return
+ERR:
+	if bytes, err = common.BuildResponse(-1, err.Error(), nil); err == nil {
+		resp.Write(bytes)
+	}
+}
+
 // 初始化服务
 func InitApiServer() (err error) {
 	var (
@@ -231,12 +898,27 @@ func InitApiServer() (err error) {
 	)
 	// 初始化路由
 	mux = http.NewServeMux()
-	mux.HandleFunc("/job/save", handleJobSave)       // 保存任务
-	mux.HandleFunc("/job/delete", handleJobDelete)   // 删除任务
-	mux.HandleFunc("/job/list", handleJobList)       // 获取所有任务
-	mux.HandleFunc("/job/kill", handleJobKill)       // 强杀任务
-	mux.HandleFunc("/job/log", handleJobLog)         // 日持查询
-	mux.HandleFunc("/worker/list", handleWorkerList) // 健康节点
+	mux.HandleFunc("/job/save", handleJobSave)             // 保存任务
+	mux.HandleFunc("/job/delete", handleJobDelete)         // 删除任务
+	mux.HandleFunc("/job/list", handleJobList)             // 获取所有任务
+	mux.HandleFunc("/job/kill", handleJobKill)             // 强杀任务
+	mux.HandleFunc("/job/log", handleJobLog)               // 日持查询
+	mux.HandleFunc("/job/log/purge", handleJobLogPurge)    // 删除任务日志
+	mux.HandleFunc("/job/run", handleJobRun)               // 执行记录汇总
+	mux.HandleFunc("/job/history", handleJobHistory)       // 版本历史
+	mux.HandleFunc("/job/rollback", handleJobRollback)     // 回滚到历史版本
+	mux.HandleFunc("/job/export", handleJobExport)         // 导出任务
+	mux.HandleFunc("/job/import", handleJobImport)         // 导入任务
+	mux.HandleFunc("/job/apply", handleJobApply)           // 声明式同步
+	mux.HandleFunc("/trash/list", handleTrashList)         // 回收站
+	mux.HandleFunc("/trash/restore", handleTrashRestore)   // 从回收站恢复
+	mux.HandleFunc("/trash/purge", handleTrashPurge)       // 彻底删除
+	mux.HandleFunc("/worker/list", handleWorkerList)       // 健康节点
+	mux.HandleFunc("/namespace/list", handleNamespaceList) // 命名空间列表
+
+	mux.HandleFunc("/worker/cordon", handleWorkerState(common.WORKER_STATE_CORDONED)) // 封锁节点
+	mux.HandleFunc("/worker/uncordon", handleWorkerState(common.WORKER_STATE_ACTIVE)) // 解除封锁
+	mux.HandleFunc("/worker/drain", handleWorkerDrain)                                // 排空节点
 
 	// http支持静态文件路由
 	staticDir = http.Dir(G_config.WebRoot)
@@ -265,3 +947,8 @@ func InitApiServer() (err error) {
 
 	return
 }
+
+// 停止HTTP服务, 等待正在处理的请求完成或者ctx超时
+func (apiServer *ApiServer) Stop(ctx context.Context) (err error) {
+	return apiServer.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,319 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 接口应答, data保留原始JSON
+type testResponse struct {
+	Errno int             `json:"errno"`
+	Msg   string          `json:"msg"`
+	Data  json.RawMessage `json:"data"`
+}
+
+var (
+	testMasterOnce  sync.Once
+	testMasterStore *common.MemoryJobStore
+)
+
+// 在进程内初始化使用内存存储和文件日志的master模块, 所有测试共用
+func startTestMaster(t *testing.T) *common.MemoryJobStore {
+	testMasterOnce.Do(func() {
+		var (
+			logDir string
+			err    error
+		)
+		if logDir, err = ioutil.TempDir("", "crontab-master-log"); err != nil {
+			t.Fatal(err)
+		}
+		G_config = &Config{
+			ApiWriteTimeout: 5000,
+			JobLogStore:     common.LOG_STORE_FILE,
+			JobLogFileDir:   logDir,
+			DispatchMode:    common.DISPATCH_MODE_MASTER,
+		}
+		testMasterStore = common.InitMemoryJobStore()
+		InitWorkerMgrWithStore(testMasterStore)
+		if err = InitLogMgr(); err != nil {
+			t.Fatal(err)
+		}
+		InitJobMgrWithStore(testMasterStore)
+	})
+	if testMasterStore == nil {
+		t.Fatal("master初始化失败")
+	}
+	return testMasterStore
+}
+
+// 调用接口并解析应答
+func callApi(t *testing.T, handler http.HandlerFunc, form url.Values) (response *testResponse) {
+	var (
+		req      *http.Request
+		recorder *httptest.ResponseRecorder
+	)
+	req = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	handler(recorder, req)
+
+	response = &testResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+		t.Fatalf("应答无法解析: %s", recorder.Body.String())
+	}
+	return
+}
+
+// 注册一个在线worker
+func registerTestWorker(t *testing.T, store common.JobStore, workerId string) {
+	var (
+		value []byte
+		err   error
+	)
+	value, _ = json.Marshal(&common.WorkerInfo{Id: workerId, IP: "127.0.0.1"})
+	if _, err = store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut(common.JOB_WORK_DIR+workerId, value)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 保存、并发修改冲突、强杀和删除
+func TestApiJobSaveKillDelete(t *testing.T) {
+	var (
+		store     *common.MemoryJobStore
+		response  *testResponse
+		jobList   []*common.Job
+		job       *common.Job
+		watchCtx  context.Context
+		watchStop context.CancelFunc
+		watchChan <-chan *common.JobWatchResponse
+		watchResp *common.JobWatchResponse
+		revision  string
+		err       error
+	)
+	store = startTestMaster(t)
+
+	// 新建任务
+	response = callApi(t, handleJobSave, url.Values{
+		"job":      {`{"name": "api-job", "command": "echo hello", "cronExpr": "*/5 * * * * * *"}`},
+		"revision": {"0"},
+	})
+	if response.Errno != 0 {
+		t.Fatalf("保存任务失败: %s", response.Msg)
+	}
+
+	// 列表中能看到任务和它的revision
+	response = callApi(t, handleJobList, url.Values{"prefix": {"api-"}})
+	if err = json.Unmarshal(response.Data, &jobList); err != nil || len(jobList) != 1 || jobList[0].Command != "echo hello" {
+		t.Fatalf("任务列表不正确: %s", response.Data)
+	}
+	revision = strconv.FormatInt(jobList[0].ModRevision, 10)
+
+	// 再次按新建保存会冲突
+	response = callApi(t, handleJobSave, url.Values{
+		"job":      {`{"name": "api-job", "command": "echo again", "cronExpr": "*/5 * * * * * *"}`},
+		"revision": {"0"},
+	})
+	if response.Errno == 0 || response.Msg != common.ERR_JOB_CONFLICT.Error() {
+		t.Fatalf("应该提示冲突, 实际: %d %s", response.Errno, response.Msg)
+	}
+
+	// 强杀通知写入存储
+	watchCtx, watchStop = context.WithCancel(context.TODO())
+	defer watchStop()
+	watchChan = store.WatchKills(watchCtx, 0)
+	response = callApi(t, handleJobKill, url.Values{"name": {"api-job"}})
+	if response.Errno != 0 {
+		t.Fatalf("强杀任务失败: %s", response.Msg)
+	}
+	select {
+	case watchResp = <-watchChan:
+		if len(watchResp.Events) != 1 || watchResp.Events[0].Job.Name != "api-job" {
+			t.Fatalf("强杀通知不正确: %+v", watchResp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到强杀通知")
+	}
+
+	// 按列表中的revision删除, 任务移入回收站
+	response = callApi(t, handleJobDelete, url.Values{"name": {"api-job"}, "revision": {revision}})
+	if response.Errno != 0 {
+		t.Fatalf("删除任务失败: %s", response.Msg)
+	}
+	if job, err = G_jobMgr.GetJob(common.JOB_NAMESPACE_DEFAULT, "api-job"); err != nil || job != nil {
+		t.Fatalf("任务没有被删除: %+v %v", job, err)
+	}
+	response = callApi(t, handleTrashList, url.Values{})
+	if response.Errno != 0 || !strings.Contains(string(response.Data), "api-job") {
+		t.Fatalf("回收站中没有任务: %s %s", response.Msg, response.Data)
+	}
+}
+
+// 封锁和解除封锁worker
+func TestApiWorkerCordon(t *testing.T) {
+	var (
+		store     *common.MemoryJobStore
+		response  *testResponse
+		workerArr []*common.WorkerInfo
+	)
+	store = startTestMaster(t)
+
+	// 不在线的worker不能封锁
+	response = callApi(t, handleWorkerState(common.WORKER_STATE_CORDONED), url.Values{"id": {"missing-worker"}})
+	if response.Errno == 0 {
+		t.Fatal("不在线的worker不应该能封锁")
+	}
+
+	registerTestWorker(t, store, "cordon-worker")
+	response = callApi(t, handleWorkerState(common.WORKER_STATE_CORDONED), url.Values{"id": {"cordon-worker"}})
+	if response.Errno != 0 {
+		t.Fatalf("封锁失败: %s", response.Msg)
+	}
+	workerArr, _ = G_workerMgr.ListWorkers()
+	if state := findWorkerState(workerArr, "cordon-worker"); state != common.WORKER_STATE_CORDONED {
+		t.Fatalf("封锁后状态不正确: %s", state)
+	}
+
+	response = callApi(t, handleWorkerState(common.WORKER_STATE_ACTIVE), url.Values{"id": {"cordon-worker"}})
+	if response.Errno != 0 {
+		t.Fatalf("解除封锁失败: %s", response.Msg)
+	}
+	workerArr, _ = G_workerMgr.ListWorkers()
+	if state := findWorkerState(workerArr, "cordon-worker"); state != common.WORKER_STATE_ACTIVE {
+		t.Fatalf("解除封锁后状态不正确: %s", state)
+	}
+	store.DeleteRecords(common.JOB_WORK_DIR+"cordon-worker", false)
+}
+
+// master调度方式下, 当选的leader把到期任务分派到在线worker的队列
+func TestDispatcherDispatchesToWorker(t *testing.T) {
+	var (
+		store    *common.MemoryJobStore
+		response *testResponse
+		records  []*common.StoreRecord
+		dispatch *common.JobDispatch
+		deadline time.Time
+		err      error
+	)
+	store = startTestMaster(t)
+	registerTestWorker(t, store, "dispatch-worker")
+	defer store.DeleteRecords(common.JOB_WORK_DIR+"dispatch-worker", false)
+
+	response = callApi(t, handleJobSave, url.Values{
+		"job": {`{"name": "dispatch-job", "command": "echo hello", "cronExpr": "* * * * * * *"}`},
+	})
+	if response.Errno != 0 {
+		t.Fatalf("保存任务失败: %s", response.Msg)
+	}
+
+	InitDispatcherWithStore(store)
+	defer G_dispatcher.Stop()
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		if records, err = store.ListRecords(common.JOB_DISPATCH_DIR+"dispatch-worker/", false); err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("任务没有被分派")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if dispatch, err = common.UnpackJobDispatch(records[0].Value); err != nil || dispatch.Job.Name != "dispatch-job" || dispatch.Worker != "dispatch-worker" {
+		t.Fatalf("分派记录不正确: %s %v", records[0].Value, err)
+	}
+}
+
+// 查找worker的运维状态
+func findWorkerState(workerArr []*common.WorkerInfo, workerId string) string {
+	var (
+		workerInfo *common.WorkerInfo
+	)
+	for _, workerInfo = range workerArr {
+		if workerInfo.Id == workerId {
+			return workerInfo.State
+		}
+	}
+	return "not found"
+}
+
+// 开启删除日志时, 任务移入回收站后日志保留, 从回收站彻底删除后才删除日志
+func TestApiTrashPurgeDeletesLogs(t *testing.T) {
+	var (
+		response *testResponse
+		logList  []*common.JobLog
+		err      error
+	)
+	startTestMaster(t)
+	G_config.JobLogPurgeOnDelete = true
+	defer func() { G_config.JobLogPurgeOnDelete = false }()
+
+	response = callApi(t, handleJobSave, url.Values{
+		"job": {`{"name": "purge-job", "command": "echo hello", "cronExpr": "*/5 * * * * * *"}`},
+	})
+	if response.Errno != 0 {
+		t.Fatalf("保存任务失败: %s", response.Msg)
+	}
+	if err = G_logMgr.store.Append([]*common.JobLog{{Namespace: common.JOB_NAMESPACE_DEFAULT, JobName: "purge-job"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除不存在的任务和移入回收站都不删除日志
+	callApi(t, handleJobDelete, url.Values{"name": {"purge-job-missing"}})
+	if response = callApi(t, handleJobDelete, url.Values{"name": {"purge-job"}}); response.Errno != 0 {
+		t.Fatalf("删除任务失败: %s", response.Msg)
+	}
+	if logList, err = G_logMgr.ListLog(common.JOB_NAMESPACE_DEFAULT, "purge-job", 0, 10); err != nil || len(logList) != 1 {
+		t.Fatalf("任务在回收站中时日志应该保留: %d %v", len(logList), err)
+	}
+
+	if response = callApi(t, handleTrashPurge, url.Values{"name": {"purge-job"}}); response.Errno != 0 {
+		t.Fatalf("清理回收站失败: %s", response.Msg)
+	}
+	if logList, err = G_logMgr.ListLog(common.JOB_NAMESPACE_DEFAULT, "purge-job", 0, 10); err != nil || len(logList) != 0 {
+		t.Fatalf("彻底删除后日志应该删除: %d %v", len(logList), err)
+	}
+}
+
+// 排空请求之前上报的排空结果不作数, 之后上报的才算排空完成
+func TestDrainWorkerIgnoresStaleReport(t *testing.T) {
+	var (
+		store      *common.MemoryJobStore
+		workerInfo *common.WorkerInfo
+		value      []byte
+		err        error
+	)
+	store = startTestMaster(t)
+	defer store.DeleteRecords(common.JOB_WORK_DIR+"drain-worker", false)
+
+	// 上一次排空留下的结果
+	value, _ = json.Marshal(&common.WorkerInfo{Id: "drain-worker", State: common.WORKER_STATE_DRAINING, Drained: true, UpdatedAt: time.Now().Add(-time.Minute).UnixNano() / 1000 / 1000})
+	if _, err = store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut(common.JOB_WORK_DIR+"drain-worker", value)}); err != nil {
+		t.Fatal(err)
+	}
+	if workerInfo, err = G_workerMgr.DrainWorker("drain-worker", 0); err != nil || workerInfo.Drained {
+		t.Fatalf("过期的排空结果不应该作数: %+v %v", workerInfo, err)
+	}
+
+	// worker在排空请求之后重新上报
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		value, _ := json.Marshal(&common.WorkerInfo{Id: "drain-worker", State: common.WORKER_STATE_DRAINING, Drained: true, UpdatedAt: time.Now().UnixNano() / 1000 / 1000})
+		store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut(common.JOB_WORK_DIR+"drain-worker", value)})
+	}()
+	if workerInfo, err = G_workerMgr.DrainWorker("drain-worker", 5*time.Second); err != nil || !workerInfo.Drained {
+		t.Fatalf("排空没有完成: %+v %v", workerInfo, err)
+	}
+}
@@ -2,6 +2,7 @@ package master
 
 import (
 	"encoding/json"
+	"github.com/staryjie/crontab/common"
 	"io/ioutil"
 )
 
@@ -12,11 +13,26 @@ type Config struct {
 	ApiWriteTimeout       int      `json:"apiWriteTimeout"`
 	EtcdEndpoints         []string `json:"etcdEndpoints"`
 	EtcdDialTimeout       int      `json:"etcdDialTimeout"`
+	EtcdMaxTxnOps         int      `json:"etcdMaxTxnOps"`
 	MongodbUri            string   `json:"mongodbUri"`
 	MongodbConnectTimeout int      `json:"mongodbConnectTimeout"`
-	JobLogStoreDb string `json:"jobLogStoreDb"`
-	JobLogStoreCollection string `json:"jobLogStoreCollection"`
+	JobLogStoreDb         string   `json:"jobLogStoreDb"`
+	JobLogStoreCollection string   `json:"jobLogStoreCollection"`
+	JobLogStore           string   `json:"jobLogStore"`
+	JobLogFileDir         string   `json:"jobLogFileDir"`
+	JobLogFileMaxSize     int      `json:"jobLogFileMaxSize"`
+	JobLogFileMaxBackups  int      `json:"jobLogFileMaxBackups"`
+	JobLogBoltPath        string   `json:"jobLogBoltPath"`
 	WebRoot               string   `json:"webroot"`
+	ShutdownTimeout       int      `json:"shutdownTimeout"`
+	DispatchMode          string   `json:"dispatchMode"`
+	ManagedJobPolicy      string   `json:"managedJobPolicy"`
+	TrashRetentionDays    int      `json:"trashRetentionDays"`
+	JobHistoryMaxVersions int      `json:"jobHistoryMaxVersions"`
+	JobLogRetentionDays   int      `json:"jobLogRetentionDays"`
+	JobLogMaxPerJob       int      `json:"jobLogMaxPerJob"`
+	JobLogPurgeInterval   int      `json:"jobLogPurgeInterval"`
+	JobLogPurgeOnDelete   bool     `json:"jobLogPurgeOnDelete"`
 }
 
 var (
@@ -39,8 +55,40 @@ func InitConfig(configFile string) (err error) {
 		return
 	}
 
-	// 3.赋值单例
+	// 3.默认值
+	if conf.DispatchMode == "" {
+		conf.DispatchMode = common.DISPATCH_MODE_WORKER
+	}
+	if conf.ManagedJobPolicy == "" {
+		conf.ManagedJobPolicy = common.MANAGED_JOB_POLICY_WARN
+	}
+	if conf.JobLogStore == "" {
+		conf.JobLogStore = common.LOG_STORE_MONGODB
+	}
+	if conf.JobLogStoreDb == "" {
+		conf.JobLogStoreDb = "cron"
+	}
+	if conf.JobLogStoreCollection == "" {
+		conf.JobLogStoreCollection = "log"
+	}
+
+	// 4.赋值单例
 	G_config = &conf
 
 	return
 }
+
+// 日志存储配置, 需要与worker一致
+func (conf *Config) logStoreConfig() *common.LogStoreConfig {
+	return &common.LogStoreConfig{
+		Type:                  conf.JobLogStore,
+		MongodbUri:            conf.MongodbUri,
+		MongodbConnectTimeout: conf.MongodbConnectTimeout,
+		MongodbDb:             conf.JobLogStoreDb,
+		MongodbCollection:     conf.JobLogStoreCollection,
+		FileDir:               conf.JobLogFileDir,
+		FileMaxSize:           conf.JobLogFileMaxSize,
+		FileMaxBackups:        conf.JobLogFileMaxBackups,
+		BoltPath:              conf.JobLogBoltPath,
+	}
+}
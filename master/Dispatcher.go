@@ -0,0 +1,353 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/staryjie/crontab/common"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// master调度分派器: 选举出的leader统一计算调度，把执行任务写入worker的分派队列
+type Dispatcher struct {
+	store common.JobStore // 任务、选举和分派记录都保存在任务存储中
+
+	jobEventChan chan *common.JobEvent              // 任务变化事件
+	jobPlanTable map[string]*common.JobSchedulePlan // 任务调度计划表
+
+	cancelCtx  context.Context    // 用于停止选举和调度
+	cancelFunc context.CancelFunc // 停止选举和调度的取消函数
+	stopChan   chan struct{}      // 选举协程已退出
+}
+
+var (
+	G_dispatcher *Dispatcher
+)
+
+// 竞选leader, 当选后执行调度，失去leader身份后重新竞选
+func (dispatcher *Dispatcher) campaignLoop() {
+	var (
+		lostChan   <-chan struct{}
+		resignFunc func()
+		hostname   string
+		err        error
+	)
+
+	defer close(dispatcher.stopChan)
+
+	hostname, _ = os.Hostname()
+
+	for {
+		// 阻塞直到当选或者被停止, 选举租约过期后自动失去leader身份
+		if lostChan, resignFunc, err = dispatcher.store.Campaign(dispatcher.cancelCtx, common.MASTER_ELECTION_DIR,
+			fmt.Sprintf("%s-%d", hostname, os.Getpid()), common.MASTER_ELECTION_TTL); err != nil {
+			goto RETRY
+		}
+
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "当选调度leader")
+		dispatcher.scheduleLoop(lostChan)
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "退出调度leader")
+
+		// 主动让出leader
+		resignFunc()
+
+	RETRY:
+		if dispatcher.cancelCtx.Err() != nil {
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// 作为leader执行调度, 直到失去leader身份或者被停止
+// 任务监听中断(revision被压缩、etcd切换leader)时重新加载任务, 加载失败时退出, 由选举协程让出leader后重新竞选
+func (dispatcher *Dispatcher) scheduleLoop(lostChan <-chan struct{}) {
+	for dispatcher.scheduleUntilResync(lostChan) {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "任务监听中断，重新加载任务")
+	}
+}
+
+// 加载任务并调度, 任务监听中断时返回true
+func (dispatcher *Dispatcher) scheduleUntilResync(lostChan <-chan struct{}) (resync bool) {
+	var (
+		watchCtx      context.Context
+		watchCancel   context.CancelFunc
+		watchDone     <-chan struct{}
+		jobEvent      *common.JobEvent
+		scheduleAfter time.Duration
+		scheduleTimer *time.Timer
+		err           error
+	)
+
+	// 当选或者重新加载时从头建立计划表
+	dispatcher.jobPlanTable = make(map[string]*common.JobSchedulePlan)
+	dispatcher.jobEventChan = make(chan *common.JobEvent, 1000)
+
+	watchCtx, watchCancel = context.WithCancel(dispatcher.cancelCtx)
+	defer watchCancel()
+
+	if watchDone, err = dispatcher.watchJobs(watchCtx); err != nil {
+		fmt.Println("加载任务失败:", err)
+		return
+	}
+
+	scheduleAfter = dispatcher.trySchedule()
+	scheduleTimer = time.NewTimer(scheduleAfter)
+	defer scheduleTimer.Stop()
+
+	for {
+		select {
+		case jobEvent = <-dispatcher.jobEventChan:
+			dispatcher.handleJobEvent(jobEvent)
+		case <-scheduleTimer.C:
+		case <-watchDone: // 监听中断, 计划表不再更新
+			resync = dispatcher.cancelCtx.Err() == nil
+			return
+		case <-lostChan: // 选举租约失效，已经不是leader
+			return
+		case <-dispatcher.cancelCtx.Done(): // 停止
+			return
+		}
+		scheduleAfter = dispatcher.trySchedule()
+		scheduleTimer.Reset(scheduleAfter)
+	}
+}
+
+// 加载全部任务并监听后续变化, 监听中断时关闭watchDone
+func (dispatcher *Dispatcher) watchJobs(ctx context.Context) (watchDone <-chan struct{}, err error) {
+	var (
+		jobList   []*common.Job
+		revision  int64
+		job       *common.Job
+		watchChan <-chan *common.JobWatchResponse
+		eventChan chan *common.JobEvent
+		doneChan  chan struct{}
+	)
+
+	// 本次任期的事件队列
+	eventChan = dispatcher.jobEventChan
+
+	if jobList, revision, err = dispatcher.store.ListJobs("", ""); err != nil {
+		return
+	}
+	for _, job = range jobList {
+		dispatcher.handleJobEvent(common.BuildJobEvent(common.JOB_EVENT_SAVE, job))
+	}
+
+	// 从读取时刻的下一个版本开始监听
+	watchChan = dispatcher.store.WatchJobs(ctx, revision+1)
+	doneChan = make(chan struct{})
+	watchDone = doneChan
+	go func() {
+		var (
+			watchResp  *common.JobWatchResponse
+			watchEvent *common.JobWatchEvent
+		)
+		defer close(doneChan)
+		for watchResp = range watchChan {
+			// revision已被压缩或者监听被取消，之后不会再收到事件，需要重新加载
+			if watchResp.Err != nil {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "任务监听中断:", watchResp.Err)
+				return
+			}
+			for _, watchEvent = range watchResp.Events {
+				// 任期结束后不再投递
+				select {
+				case eventChan <- common.BuildJobEvent(watchEvent.EventType, watchEvent.Job):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return
+}
+
+// 处理任务变化
+func (dispatcher *Dispatcher) handleJobEvent(jobEvent *common.JobEvent) {
+	var (
+		jobSchedulePlan *common.JobSchedulePlan
+		jobFullName     string
+		err             error
+	)
+	// 不同命名空间的任务可以重名
+	jobFullName = common.JobFullName(jobEvent.Job.Namespace, jobEvent.Job.Name)
+	switch jobEvent.EventType {
+	case common.JOB_EVENT_SAVE:
+		// 停用的任务从计划表中移除
+		if jobEvent.Job.Disabled {
+			delete(dispatcher.jobPlanTable, jobFullName)
+			return
+		}
+		if jobSchedulePlan, err = common.BuildJobSchedulePlan(jobEvent.Job); err != nil {
+			delete(dispatcher.jobPlanTable, jobFullName)
+			return
+		}
+		dispatcher.jobPlanTable[jobFullName] = jobSchedulePlan
+	case common.JOV_EVENT_DELETE:
+		delete(dispatcher.jobPlanTable, jobFullName)
+	}
+}
+
+// 分派到期的任务, 返回距离下一个到期任务的时间
+// 同一轮到期的任务共用一次worker列表读取和一个分派租约, 到期任务再多也只访问两次存储
+func (dispatcher *Dispatcher) trySchedule() (scheduleAfter time.Duration) {
+	var (
+		jobPlan   *common.JobSchedulePlan
+		now       time.Time
+		nearTime  *time.Time
+		duePlans  []*common.JobSchedulePlan
+		workerArr []*common.WorkerInfo
+		leaseId   int64
+		err       error
+	)
+
+	if len(dispatcher.jobPlanTable) == 0 {
+		scheduleAfter = 1 * time.Second
+		return
+	}
+
+	now = time.Now()
+	for _, jobPlan = range dispatcher.jobPlanTable {
+		if jobPlan.NextTime.Before(now) || jobPlan.NextTime.Equal(now) {
+			duePlans = append(duePlans, jobPlan)
+		}
+	}
+
+	if len(duePlans) != 0 {
+		// 本轮调度的分派记录共用一个租约, worker长时间不取走的分派随租约过期
+		if workerArr, err = G_workerMgr.ListWorkers(); err != nil {
+			fmt.Println("获取worker列表失败, 跳过本轮调度:", err)
+		} else if leaseId, err = dispatcher.grantDispatchLease(); err != nil {
+			fmt.Println("创建分派租约失败, 跳过本轮调度:", err)
+		}
+		for _, jobPlan = range duePlans {
+			if err == nil {
+				dispatcher.dispatchJob(jobPlan, workerArr, leaseId)
+			}
+			jobPlan.NextTime = jobPlan.Expr.Next(now)
+		}
+	}
+
+	for _, jobPlan = range dispatcher.jobPlanTable {
+		if nearTime == nil || jobPlan.NextTime.Before(*nearTime) {
+			nearTime = &jobPlan.NextTime
+		}
+	}
+	scheduleAfter = (*nearTime).Sub(now)
+	return
+}
+
+// 从本轮的worker列表中选择worker并写入分派队列
+// 分派成功后增加所选worker的执行数, 本轮后面的任务据此避开刚分派过的worker
+func (dispatcher *Dispatcher) dispatchJob(jobPlan *common.JobSchedulePlan, workerArr []*common.WorkerInfo, leaseId int64) {
+	var (
+		eligible   []*common.WorkerInfo
+		workerInfo *common.WorkerInfo
+		shardIndex int
+	)
+
+	// 服务该命名空间、满足选择器并且未被封锁的在线worker
+	eligible = make([]*common.WorkerInfo, 0)
+	for _, workerInfo = range workerArr {
+		if workerInfo.State == common.WORKER_STATE_ACTIVE &&
+			common.ServesNamespace(workerInfo.Namespaces, jobPlan.Job.Namespace) &&
+			common.MatchSelector(jobPlan.Job.Selector, workerInfo.Labels) {
+			eligible = append(eligible, workerInfo)
+		}
+	}
+	if len(eligible) == 0 {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "没有可用的worker, 跳过本次调度", jobPlan.Job.Name)
+		return
+	}
+
+	switch jobPlan.Job.ExecMode {
+	case common.JOB_EXEC_MODE_BROADCAST: // 每个worker一份
+		for _, workerInfo = range eligible {
+			dispatcher.putDispatch(leaseId, workerInfo, jobPlan, 0)
+		}
+	case common.JOB_EXEC_MODE_SHARD: // 分片按负载从低到高轮流分配给不同的worker
+		sortWorkersByLoad(eligible)
+		for shardIndex = 0; shardIndex < jobPlan.Job.ShardTotal; shardIndex++ {
+			dispatcher.putDispatch(leaseId, eligible[shardIndex%len(eligible)], jobPlan, shardIndex)
+		}
+	default: // 选负载最低的worker
+		sortWorkersByLoad(eligible)
+		dispatcher.putDispatch(leaseId, eligible[0], jobPlan, 0)
+	}
+}
+
+// 按负载从低到高排序, 负载相同的随机排列，避免总是选中同一个worker
+func sortWorkersByLoad(workerArr []*common.WorkerInfo) {
+	rand.Shuffle(len(workerArr), func(i, j int) {
+		workerArr[i], workerArr[j] = workerArr[j], workerArr[i]
+	})
+	sort.SliceStable(workerArr, func(i, j int) bool {
+		return common.WorkerLoadScore(workerArr[i]) < common.WorkerLoadScore(workerArr[j])
+	})
+}
+
+// 创建分派记录的租约
+func (dispatcher *Dispatcher) grantDispatchLease() (leaseId int64, err error) {
+	leaseId, err = dispatcher.store.GrantLease(common.JOB_DISPATCH_LEASE_TTL)
+	return
+}
+
+// 写入一条分派记录, 成功后计入worker的执行数
+func (dispatcher *Dispatcher) putDispatch(leaseId int64, workerInfo *common.WorkerInfo, jobPlan *common.JobSchedulePlan, shardIndex int) {
+	var (
+		dispatch      *common.JobDispatch
+		dispatchKey   string
+		dispatchValue []byte
+		err           error
+	)
+
+	dispatch = &common.JobDispatch{
+		Job:        jobPlan.Job,
+		PlanTime:   jobPlan.NextTime.UnixNano() / 1000 / 1000,
+		ShardIndex: shardIndex,
+		Worker:     workerInfo.Id,
+	}
+	if dispatchValue, err = json.Marshal(dispatch); err != nil {
+		return
+	}
+	dispatchKey = common.BuildDispatchKey(workerInfo.Id, jobPlan.Job.Namespace, jobPlan.Job.Name, jobPlan.NextTime, shardIndex)
+
+	if _, err = dispatcher.store.Commit(nil, []*common.RecordWrite{
+		{Key: dispatchKey, Value: dispatchValue, ExpectRevision: common.JOB_REVISION_ANY, LeaseId: leaseId},
+	}); err != nil {
+		fmt.Println("分派任务失败:", jobPlan.Job.Name, err)
+		return
+	}
+	workerInfo.Running++
+	fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "分派任务:", jobPlan.Job.Name, "=>", workerInfo.Id, shardIndex)
+}
+
+// 停止选举和调度
+func (dispatcher *Dispatcher) Stop() {
+	dispatcher.cancelFunc()
+	<-dispatcher.stopChan
+}
+
+// 初始化调度分派器, 只有master调度方式才启动
+func InitDispatcher() (err error) {
+	if G_config.DispatchMode != common.DISPATCH_MODE_MASTER {
+		return
+	}
+	InitDispatcherWithStore(G_jobMgr.store)
+	return
+}
+
+// 使用指定的任务存储启动调度分派器, 进程内测试时传入内存存储
+func InitDispatcherWithStore(store common.JobStore) {
+	G_dispatcher = &Dispatcher{
+		store:    store,
+		stopChan: make(chan struct{}),
+	}
+	G_dispatcher.cancelCtx, G_dispatcher.cancelFunc = context.WithCancel(context.TODO())
+
+	go G_dispatcher.campaignLoop()
+}
@@ -0,0 +1,113 @@
+package master
+
+import (
+	"context"
+	"github.com/staryjie/crontab/common"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 第一次监听任务前保存一个任务并写入超过事件上限的记录, 让监听的起始revision被压缩
+type compactingJobStore struct {
+	common.JobStore
+	compacted int32
+}
+
+func (store *compactingJobStore) WatchJobs(ctx context.Context, fromRevision int64) <-chan *common.JobWatchResponse {
+	var (
+		index int
+	)
+	if atomic.CompareAndSwapInt32(&store.compacted, 0, 1) {
+		// 压缩窗口内保存的任务只能通过重新加载得到
+		store.Commit([]*common.JobWrite{{
+			Namespace:      common.JOB_NAMESPACE_DEFAULT,
+			Name:           "compacted-dispatch-job",
+			Job:            &common.Job{Namespace: common.JOB_NAMESPACE_DEFAULT, Name: "compacted-dispatch-job", Command: "true", CronExpr: "* * * * * * *"},
+			ExpectRevision: 0,
+		}}, nil)
+		for index = 0; index <= common.MEMORY_STORE_EVENT_LIMIT; index++ {
+			store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut("/cron/test/compact", []byte("x"))})
+		}
+	}
+	return store.JobStore.WatchJobs(ctx, fromRevision)
+}
+
+// 任务监听的revision被压缩后leader重新加载任务, 压缩窗口内保存的任务也会被分派
+func TestDispatcherResyncAfterCompaction(t *testing.T) {
+	var (
+		store    *common.MemoryJobStore
+		records  []*common.StoreRecord
+		deadline time.Time
+		err      error
+	)
+	store = startTestMaster(t)
+	registerTestWorker(t, store, "compact-worker")
+	defer store.DeleteRecords(common.JOB_WORK_DIR+"compact-worker", false)
+
+	InitDispatcherWithStore(&compactingJobStore{JobStore: store})
+	defer G_dispatcher.Stop()
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		if records, err = store.ListRecords(common.JOB_DISPATCH_DIR+"compact-worker/"+common.JOB_NAMESPACE_DEFAULT+"/compacted-dispatch-job/", false); err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("重新加载后任务没有被分派")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// 记录创建租约的次数
+type countingLeaseStore struct {
+	common.JobStore
+	grants int32
+}
+
+func (store *countingLeaseStore) GrantLease(ttl int64) (leaseId int64, err error) {
+	atomic.AddInt32(&store.grants, 1)
+	return store.JobStore.GrantLease(ttl)
+}
+
+// 同一轮到期的多个任务共用一个分派租约, 并且分散到不同的worker(只有本测试注册的两个worker在线)
+func TestDispatcherSharesLeasePerPass(t *testing.T) {
+	var (
+		store      *common.MemoryJobStore
+		countStore *countingLeaseStore
+		dispatcher *Dispatcher
+		jobPlan    *common.JobSchedulePlan
+		name       string
+		records    []*common.StoreRecord
+		err        error
+	)
+	store = startTestMaster(t)
+	registerTestWorker(t, store, "pass-worker-1")
+	registerTestWorker(t, store, "pass-worker-2")
+	defer store.DeleteRecords(common.JOB_WORK_DIR+"pass-worker-", true)
+	defer store.DeleteRecords(common.JOB_DISPATCH_DIR+"pass-worker-", true)
+
+	countStore = &countingLeaseStore{JobStore: store}
+	dispatcher = &Dispatcher{store: countStore, jobPlanTable: make(map[string]*common.JobSchedulePlan)}
+	for _, name = range []string{"pass-job-1", "pass-job-2"} {
+		if jobPlan, err = common.BuildJobSchedulePlan(&common.Job{Namespace: common.JOB_NAMESPACE_DEFAULT, Name: name, Command: "true", CronExpr: "* * * * * * *"}); err != nil {
+			t.Fatal(err)
+		}
+		jobPlan.NextTime = time.Now().Add(-time.Second)
+		dispatcher.jobPlanTable[name] = jobPlan
+	}
+
+	dispatcher.trySchedule()
+	if countStore.grants != 1 {
+		t.Fatalf("一轮调度应该只创建一个租约, 实际: %d", countStore.grants)
+	}
+	for _, name = range []string{"pass-worker-1", "pass-worker-2"} {
+		if records, err = store.ListRecords(common.JOB_DISPATCH_DIR+name+"/", false); err != nil || len(records) != 1 {
+			t.Fatalf("%s的分派记录不正确: %d %v", name, len(records), err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package master
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"time"
+)
+
+var (
+	// master各模块共享的etcd连接
+	G_etcdClient *clientv3.Client
+)
+
+// 初始化etcd连接
+func InitEtcdClient() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	// 初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     // Etcd集群
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 连接超时时间
+	}
+
+	// 建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	// 赋值单例
+	G_etcdClient = client
+	return
+}
+
+// 关闭etcd连接
+func CloseEtcdClient() (err error) {
+	if G_etcdClient != nil {
+		err = G_etcdClient.Close()
+	}
+	return
+}
@@ -0,0 +1,267 @@
+package master
+
+import (
+	"encoding/json"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 读取清单目录(包含子目录)下所有json/yaml文件中的任务
+func LoadManifestDir(dir string) (jobList []*common.Job, err error) {
+	var (
+		files   []string
+		file    string
+		format  string
+		content []byte
+		entries []*importEntry
+		entry   *importEntry
+	)
+	if err = filepath.Walk(dir, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !info.IsDir() && GuessJobFormat(path) != common.JOB_FORMAT_CRONTAB {
+			files = append(files, path)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+
+	// 按文件名顺序读取, 保证每次生成的计划相同
+	sort.Strings(files)
+	jobList = make([]*common.Job, 0)
+	for _, file = range files {
+		format = GuessJobFormat(file)
+		if content, err = ioutil.ReadFile(file); err != nil {
+			return
+		}
+		if entries, _, err = decodeJobs(content, format); err != nil {
+			err = &os.PathError{Op: "parse", Path: file, Err: err}
+			return
+		}
+		for _, entry = range entries {
+			jobList = append(jobList, entry.job)
+		}
+	}
+	return
+}
+
+// 声明式同步: 让任务与清单一致
+// namespace不为空时清单中所有任务属于该命名空间, 只同步该命名空间;
+// 否则使用清单中的命名空间, 同步清单涉及到的命名空间以及已有本来源任务的命名空间
+// source标识清单来源, 应用后的任务标记为由该来源管理; 清单中没有的本来源任务会被删除, prune时非受管任务也删除
+// 所有修改在一个存储事务中完成, 使用etcd时修改的任务数受--max-txn-ops限制(每个任务2个操作, 删除3个),
+// 超出时返回ERR_STORE_TXN_TOO_LARGE, 不会应用部分修改
+func (jobMgr *JobMgr) ApplyJobs(jobList []*common.Job, namespace string, source string, prune bool, dryRun bool, operator string) (plan *common.JobApplyPlan, err error) {
+	var (
+		job        *common.Job
+		oldJob     *common.Job
+		item       *common.JobImportItem
+		desired    map[string]*common.Job            // 命名空间/任务名 -> 清单中的任务
+		existing   map[string]map[string]*common.Job // 命名空间 -> 任务名 -> 已有任务
+		nsJobs     []*common.Job
+		nsJobList  map[string][]*common.Job // 命名空间 -> 已有任务, 按任务名排序
+		fullName   string
+		ns         string
+		namespaces []string
+		puts       []*common.Job // 新建和更新
+		deletes    []*common.Job
+		jobWrites  []*common.JobWrite
+		records    []*common.RecordWrite
+		now        time.Time
+		savedJob   *common.Job
+		version    []byte
+		trashRec   *common.RecordWrite
+		revision   int64
+		succeeded  bool
+		ok         bool
+	)
+	if source == "" {
+		source = common.JOB_MANAGED_SOURCE_DEFAULT
+	}
+	plan = &common.JobApplyPlan{
+		DryRun:    dryRun,
+		Creates:   make([]*common.JobImportItem, 0),
+		Updates:   make([]*common.JobImportItem, 0),
+		Deletes:   make([]*common.JobImportItem, 0),
+		Unchanged: make([]*common.JobImportItem, 0),
+		Unmanaged: make([]*common.JobImportItem, 0),
+		Errors:    make([]*common.JobImportItem, 0),
+	}
+
+	// 1.校验清单
+	desired = make(map[string]*common.Job)
+	existing = make(map[string]map[string]*common.Job)
+	for _, job = range jobList {
+		if namespace != "" {
+			job.Namespace = namespace
+		}
+		job.Namespace = common.NormalizeNamespace(job.Namespace)
+		job.ModRevision = 0
+		job.LastRunStatus = ""
+		job.ManagedBy = source
+		item = &common.JobImportItem{Namespace: job.Namespace, Name: job.Name}
+
+		if !common.IsValidNamespace(job.Namespace) {
+			item.Reason = common.ERR_INVALID_NAMESPACE.Error()
+			plan.Errors = append(plan.Errors, item)
+			continue
+		}
+		if err = common.ValidateJob(job); err != nil {
+			item.Reason = err.Error()
+			plan.Errors = append(plan.Errors, item)
+			err = nil
+			continue
+		}
+		fullName = common.JobFullName(job.Namespace, job.Name)
+		if _, ok = desired[fullName]; ok {
+			item.Reason = common.ERR_DUPLICATE_JOB_NAME.Error()
+			plan.Errors = append(plan.Errors, item)
+			continue
+		}
+		desired[fullName] = job
+		existing[job.Namespace] = nil
+	}
+
+	// 2.读取涉及到的命名空间下的已有任务
+	// 清单不再包含某个命名空间时, 那里本来源管理的任务也要删除
+	if namespace != "" {
+		existing[common.NormalizeNamespace(namespace)] = nil
+	} else {
+		if nsJobs, _, err = jobMgr.store.ListJobs("", ""); err != nil {
+			return
+		}
+		for _, oldJob = range nsJobs {
+			if oldJob.ManagedBy == source {
+				existing[oldJob.Namespace] = nil
+			}
+		}
+	}
+	for ns = range existing {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	nsJobList = make(map[string][]*common.Job)
+	for _, ns = range namespaces {
+		if nsJobs, err = jobMgr.ListJobs(ns); err != nil {
+			return
+		}
+		nsJobList[ns] = nsJobs
+		existing[ns] = make(map[string]*common.Job)
+		for _, oldJob = range nsJobs {
+			existing[ns][oldJob.Name] = oldJob
+		}
+	}
+
+	// 3.清单中的任务: 新建、更新或不变
+	for _, job = range jobList {
+		fullName = common.JobFullName(job.Namespace, job.Name)
+		if desired[fullName] != job {
+			continue // 校验失败或重名
+		}
+		item = &common.JobImportItem{Namespace: job.Namespace, Name: job.Name}
+		oldJob = existing[job.Namespace][job.Name]
+		switch {
+		case oldJob == nil:
+			plan.Creates = append(plan.Creates, item)
+			puts = append(puts, job)
+		case oldJob.ManagedBy != "" && oldJob.ManagedBy != source:
+			item.Reason = common.ERR_JOB_MANAGED_BY_OTHER.Error() + ": " + oldJob.ManagedBy
+			plan.Errors = append(plan.Errors, item)
+		case sameJob(oldJob, job):
+			plan.Unchanged = append(plan.Unchanged, item)
+		default:
+			plan.Updates = append(plan.Updates, item)
+			puts = append(puts, job)
+		}
+	}
+
+	// 4.清单中没有的任务: 本来源管理的删除, 非受管的prune时删除, 其他保留
+	for _, ns = range namespaces {
+		for _, oldJob = range nsJobList[ns] {
+			if _, ok = desired[common.JobFullName(ns, oldJob.Name)]; ok {
+				continue
+			}
+			item = &common.JobImportItem{Namespace: ns, Name: oldJob.Name}
+			if oldJob.ManagedBy == source || (oldJob.ManagedBy == "" && prune) {
+				plan.Deletes = append(plan.Deletes, item)
+				deletes = append(deletes, oldJob)
+			} else {
+				item.Reason = oldJob.ManagedBy
+				plan.Unmanaged = append(plan.Unmanaged, item)
+			}
+		}
+	}
+
+	// 有错误时整体放弃
+	if len(plan.Errors) != 0 {
+		err = common.ERR_APPLY_INVALID
+		return
+	}
+	if dryRun {
+		return
+	}
+	if len(puts) == 0 && len(deletes) == 0 {
+		plan.Applied = true
+		return
+	}
+
+	// 5.生成事务: 每个要修改的任务都必须还是生成计划时的版本
+	now = time.Now()
+	for _, job = range puts {
+		revision = 0
+		if oldJob = existing[job.Namespace][job.Name]; oldJob != nil {
+			revision = oldJob.ModRevision
+		}
+		savedJob = stampJob(job, oldJob, operator, now)
+		if version, err = json.Marshal(&common.JobVersion{
+			Op:       common.JOB_HISTORY_OP_SAVE,
+			Operator: operator,
+			Time:     savedJob.UpdateTime,
+			Job:      savedJob,
+		}); err != nil {
+			return
+		}
+		jobWrites = append(jobWrites, &common.JobWrite{Namespace: job.Namespace, Name: job.Name, Job: savedJob, ExpectRevision: revision})
+		records = append(records, common.BuildRecordPut(common.BuildJobVersionKey(job.Namespace, job.Name, now), version))
+	}
+	for _, oldJob = range deletes {
+		if version, err = json.Marshal(&common.JobVersion{
+			Op:       common.JOB_HISTORY_OP_DELETE,
+			Operator: operator,
+			Time:     now.UnixNano() / 1000 / 1000,
+			Job:      oldJob,
+		}); err != nil {
+			return
+		}
+		if trashRec, err = buildTrashRecord(oldJob, operator, now); err != nil {
+			return
+		}
+		jobWrites = append(jobWrites, &common.JobWrite{Namespace: oldJob.Namespace, Name: oldJob.Name, ExpectRevision: oldJob.ModRevision})
+		records = append(records, common.BuildRecordPut(common.BuildJobVersionKey(oldJob.Namespace, oldJob.Name, now), version), trashRec)
+	}
+
+	// 6.提交
+	if succeeded, err = jobMgr.store.Commit(jobWrites, records); err != nil {
+		return
+	}
+	if !succeeded {
+		err = common.ERR_APPLY_CONFLICT
+		return
+	}
+	plan.Applied = true
+
+	// 清理超出上限的旧版本
+	for _, job = range puts {
+		jobMgr.trimJobHistory(job.Namespace, job.Name)
+	}
+	for _, oldJob = range deletes {
+		jobMgr.trimJobHistory(oldJob.Namespace, oldJob.Name)
+	}
+	return
+}
@@ -3,172 +3,345 @@ package master
 import (
 	"context"
 	"encoding/json"
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"fmt"
 	"github.com/staryjie/crontab/common"
 	"time"
 )
 
 // 任务管理器
 type JobMgr struct {
-	client *clientv3.Client
-	kv     clientv3.KV
-	lease  clientv3.Lease
+	store        common.JobStore // 任务存储
+	historyLimit int             // 每个任务保留的版本记录数
+
+	purgeCtx    context.Context    // 用于停止回收站清理
+	purgeCancel context.CancelFunc // 停止回收站清理的取消函数
 }
 
 var (
 	G_jobMgr *JobMgr
 )
 
-// 初始化管理器
+// 初始化管理器, 使用etcd任务存储
 func InitJobMgr() (err error) {
 	var (
-		config clientv3.Config
-		client *clientv3.Client
-		kv     clientv3.KV
-		lease  clientv3.Lease
+		store *common.EtcdJobStore
 	)
 
-	// 初始化配置
-	config = clientv3.Config{
-		Endpoints:   G_config.EtcdEndpoints,                                     // Etcd集群
-		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 连接超时时间
+	// 使用共享的etcd连接
+	store = common.InitEtcdJobStore(G_etcdClient, 0)
+	store.SetMaxTxnOps(G_config.EtcdMaxTxnOps)
+	InitJobMgrWithStore(store)
+
+	// 迁移旧版本没有命名空间的任务
+	err = store.MigrateLegacyJobs()
+	return
+}
+
+// 使用指定的任务存储初始化管理器, 进程内测试时传入内存存储
+func InitJobMgrWithStore(store common.JobStore) {
+	// 赋值单例
+	G_jobMgr = &JobMgr{
+		store:        store,
+		historyLimit: common.JOB_HISTORY_MAX_VERSIONS,
+	}
+	if G_config != nil && G_config.JobHistoryMaxVersions > 0 {
+		G_jobMgr.historyLimit = G_config.JobHistoryMaxVersions
+	}
+	G_jobMgr.purgeCtx, G_jobMgr.purgeCancel = context.WithCancel(context.TODO())
+}
+
+// 保存任务
+// expectRevision为任务当前的ModRevision时才保存, 0表示任务必须不存在, JOB_REVISION_ANY表示不检查
+// 发生冲突时返回ERR_JOB_CONFLICT以及任务的当前值
+// 创建时间、修改时间和修改人由这里维护, 忽略调用方传入的值
+func (jobMgr *JobMgr) SaveJob(job *common.Job, expectRevision int64, operator string) (oldJob *common.Job, err error) {
+	return jobMgr.putJob(job, expectRevision, &common.JobVersion{Op: common.JOB_HISTORY_OP_SAVE, Operator: operator})
+}
+
+// 生成要保存的任务: 去掉只在查询时返回的字段, 维护创建时间、修改时间和修改人
+func stampJob(job *common.Job, oldJob *common.Job, operator string, now time.Time) (savedJob *common.Job) {
+	var (
+		jobCopy common.Job
+	)
+	// revision由etcd维护，不保存
+	jobCopy = *job
+	jobCopy.ModRevision = 0
+	jobCopy.LastRunStatus = ""
+	jobCopy.UpdateTime = now.UnixNano() / 1000 / 1000
+	jobCopy.UpdatedBy = operator
+	jobCopy.CreateTime = jobCopy.UpdateTime
+	if oldJob != nil {
+		// 旧版本保存的任务没有创建时间
+		jobCopy.CreateTime = oldJob.CreateTime
 	}
+	savedJob = &jobCopy
+	return
+}
 
-	// 建立连接
-	if client, err = clientv3.New(config); err != nil {
+// 保存任务并记录一个版本, extraRecords与任务在同一个事务中写入
+func (jobMgr *JobMgr) putJob(job *common.Job, expectRevision int64, version *common.JobVersion, extraRecords ...*common.RecordWrite) (oldJob *common.Job, err error) {
+	// 把任务保存到 /cron/jobs/命名空间/任务名 = json
+	var (
+		curRevision  int64
+		savedJob     *common.Job
+		versionValue []byte
+		now          time.Time
+		succeeded    bool
+	)
+
+RETRY:
+	// 读出任务的当前值, 用于冲突检查和保留创建时间
+	if oldJob, curRevision, err = jobMgr.store.GetJob(job.Namespace, job.Name); err != nil {
+		return
+	}
+	// 任务已被其他人修改, 返回任务的当前值
+	if expectRevision != common.JOB_REVISION_ANY && curRevision != expectRevision {
+		err = common.ERR_JOB_CONFLICT
 		return
 	}
 
-	// 得到kv和lease API子集
-	kv = clientv3.NewKV(client)
-	lease = clientv3.NewLease(client)
+	// 要保存的任务
+	now = time.Now()
+	savedJob = stampJob(job, oldJob, version.Operator, now)
 
-	// 赋值单例
-	G_jobMgr = &JobMgr{
-		client: client,
-		kv:     kv,
-		lease:  lease,
+	// 版本记录
+	version.Job = savedJob
+	version.Time = savedJob.UpdateTime
+	if versionValue, err = json.Marshal(version); err != nil {
+		return
 	}
+
+	// 任务和版本记录在同一个事务中写入, 读出之后任务又被修改时重新读取并检查
+	if succeeded, err = jobMgr.store.Commit(
+		[]*common.JobWrite{{Namespace: job.Namespace, Name: job.Name, Job: savedJob, ExpectRevision: curRevision}},
+		append([]*common.RecordWrite{common.BuildRecordPut(common.BuildJobVersionKey(job.Namespace, job.Name, now), versionValue)}, extraRecords...),
+	); err != nil {
+		return
+	}
+	if !succeeded {
+		goto RETRY
+	}
+	jobMgr.trimJobHistory(job.Namespace, job.Name)
 	return
 }
 
-// 保存任务
-func (jobMgr *JobMgr) SaveJob(job *common.Job) (oldJob *common.Job, err error) {
-	// 把任务保存到Etcd的 /cron/jobs/任务名 = json
+// 删除任务, 任务移入回收站, expectRevision的含义与SaveJob相同
+func (jobMgr *JobMgr) DeleteJob(namespace string, name string, expectRevision int64, operator string) (oldJob *common.Job, err error) {
 	var (
-		jobKey    string
-		jobValue  []byte
-		putResp   *clientv3.PutResponse
-		oldJobObj common.Job
+		curRevision  int64
+		versionValue []byte
+		now          time.Time
+		records      []*common.RecordWrite
+		trashRecord  *common.RecordWrite
+		succeeded    bool
 	)
 
-	// Etcd保存的Key
-	jobKey = common.JOB_SAVE_DIR + job.Name
-	// 任务信息 json
-	if jobValue, err = json.Marshal(job); err != nil {
+RETRY:
+	// 读出要删除的任务，写入删除记录, 无法解析的任务oldJob为nil, 也照常删除
+	if oldJob, curRevision, err = jobMgr.store.GetJob(namespace, name); err != nil {
+		return
+	}
+	if curRevision == 0 {
+		// 任务已经被其他人删除
+		if expectRevision > 0 {
+			err = common.ERR_JOB_CONFLICT
+		}
+		return
+	}
+	if expectRevision != common.JOB_REVISION_ANY && curRevision != expectRevision {
+		err = common.ERR_JOB_CONFLICT
+		return
+	}
+
+	now = time.Now()
+	if versionValue, err = json.Marshal(&common.JobVersion{
+		Op:       common.JOB_HISTORY_OP_DELETE,
+		Operator: operator,
+		Time:     now.UnixNano() / 1000 / 1000,
+		Job:      oldJob,
+	}); err != nil {
 		return
 	}
+	records = []*common.RecordWrite{common.BuildRecordPut(common.BuildJobVersionKey(namespace, name, now), versionValue)}
+	// 放入回收站, 无法解析的任务直接删除
+	if oldJob != nil {
+		if trashRecord, err = buildTrashRecord(oldJob, operator, now); err != nil {
+			return
+		}
+		records = append(records, trashRecord)
+	}
 
-	// 保存到Etcd
-	if putResp, err = jobMgr.kv.Put(context.TODO(), jobKey, string(jobValue), clientv3.WithPrevKV()); err != nil {
+	// 删除任务, 读出之后任务又被修改时重新读取
+	if succeeded, err = jobMgr.store.Commit(
+		[]*common.JobWrite{{Namespace: namespace, Name: name, ExpectRevision: curRevision}},
+		records,
+	); err != nil {
 		return
 	}
-	// 如果是更新，那么返回旧值
-	if putResp.PrevKv != nil {
-		// 对旧值做反序列化
-		if err = json.Unmarshal(putResp.PrevKv.Value, &oldJobObj); err != nil {
-			err = nil // 旧值反序列化失败也不影响新值的写入
+	if !succeeded {
+		if expectRevision != common.JOB_REVISION_ANY {
+			err = common.ERR_JOB_CONFLICT
 			return
 		}
-		oldJob = &oldJobObj
+		goto RETRY
 	}
+	jobMgr.trimJobHistory(namespace, name)
 	return
 }
 
-// 删除任务
-func (jobMgr *JobMgr) DeleteJob(name string) (oldJob *common.Job, err error) {
+// 只保留任务最新的historyLimit个版本, 清理失败不影响本次修改, 下次修改时会再次清理
+func (jobMgr *JobMgr) trimJobHistory(namespace string, name string) {
 	var (
-		jobKey    string
-		delResp   *clientv3.DeleteResponse
-		oldJobObj common.Job
+		records []*common.StoreRecord
+		record  *common.StoreRecord
+		err     error
 	)
+	if records, err = jobMgr.store.ListRecords(common.BuildJobVersionDir(namespace, name), true); err != nil {
+		goto ERR
+	}
+	if len(records) <= jobMgr.historyLimit {
+		return
+	}
+	// 新版本在前, 删除超出的旧版本
+	for _, record = range records[jobMgr.historyLimit:] {
+		if _, err = jobMgr.store.DeleteRecords(record.Key, false); err != nil {
+			goto ERR
+		}
+	}
+	return
+ERR:
+	fmt.Println("清理任务版本记录失败:", namespace, name, err)
+}
 
-	// Etcd中保存的Key
-	jobKey = common.JOB_SAVE_DIR + name
-
-	// 从Etcd中删除
-	if delResp, err = jobMgr.kv.Delete(context.TODO(), jobKey, clientv3.WithPrevKV()); err != nil {
+// 任务彻底删除后(不存在并且回收站中也没有了)删除它的版本记录, 按配置同时删除它的日志
+func (jobMgr *JobMgr) purgeDeletedJob(namespace string, name string) (err error) {
+	var (
+		curRevision int64
+		records     []*common.StoreRecord
+		logErr      error
+	)
+	// 同名任务又被创建了, 版本记录继续使用
+	if _, curRevision, err = jobMgr.store.GetJob(namespace, name); err != nil || curRevision != 0 {
+		return
+	}
+	// 回收站中还有这个任务的其他记录, 恢复后还需要版本记录
+	if records, err = jobMgr.store.ListRecords(common.BuildTrashDir(namespace, name), false); err != nil || len(records) != 0 {
+		return
+	}
+	if _, err = jobMgr.store.DeleteRecords(common.BuildJobVersionDir(namespace, name), true); err != nil {
 		return
 	}
 
-	// 返回被删除的任务信息
-	if len(delResp.PrevKvs) != 0 {
-		// 解析旧值
-		if err = json.Unmarshal(delResp.PrevKvs[0].Value, &oldJobObj); err != nil {
-			err = nil
-			return
+	// 日志删除失败不影响回收站和版本记录的清理, 剩下的日志由日志保留天数清理
+	if G_config != nil && G_config.JobLogPurgeOnDelete && G_logMgr != nil {
+		if _, logErr = G_logMgr.PurgeLogs(namespace, name, 0); logErr != nil {
+			fmt.Println("删除任务日志失败:", namespace, name, logErr)
 		}
-		oldJob = &oldJobObj
 	}
 	return
 }
 
-// 获取任务列表
-func (jobMgr *JobMgr) ListJobs() (jobList []*common.Job, err error) {
+// 获取任务的版本历史, 新版本在前
+func (jobMgr *JobMgr) ListJobVersions(namespace string, name string) (versionList []*common.JobVersion, err error) {
 	var (
-		dirKey  string
-		getResp *clientv3.GetResponse
-		kvPair  *mvccpb.KeyValue
-		job     *common.Job
+		records []*common.StoreRecord
+		record  *common.StoreRecord
+		version *common.JobVersion
 	)
 
-	// 任务保存目录
-	dirKey = common.JOB_SAVE_DIR
-
-	// 获取目录下所有任务信息
-	if getResp, err = jobMgr.kv.Get(context.TODO(), dirKey, clientv3.WithPrefix()); err != nil {
+	// 版本记录的key以时间戳结尾, 倒序即新版本在前
+	if records, err = jobMgr.store.ListRecords(common.BuildJobVersionDir(namespace, name), true); err != nil {
 		return
 	}
 
-	// 初始化任务列表
-	jobList = make([]*common.Job, 0)
-
-	// 遍历所有任务，进行反序列化
-	for _, kvPair = range getResp.Kvs {
-		job = &common.Job{}
-		if err = json.Unmarshal(kvPair.Value, job); err != nil {
+	versionList = make([]*common.JobVersion, 0)
+	for _, record = range records {
+		if version, err = common.UnpackJobVersion(record.Value, record.CreateRevision); err != nil {
 			err = nil
 			continue
 		}
-		jobList = append(jobList, job)
+		versionList = append(versionList, version)
 	}
 	return
 }
 
-// 杀死任务
-func (jobMgr *JobMgr) KillJob(name string) (err error) {
-	// 更新 /cron/killer/任务名
+// 把任务回滚到指定版本, 回滚本身也记录为一个新版本
+func (jobMgr *JobMgr) RollbackJob(namespace string, name string, revision int64, operator string) (job *common.Job, err error) {
 	var (
-		killKey        string
-		leaseGrantResp *clientv3.LeaseGrantResponse
-		leaseId        clientv3.LeaseID
+		versionList []*common.JobVersion
+		version     *common.JobVersion
 	)
 
-	// 强杀任务路径
-	killKey = common.JOB_KILLER_DIR + name
-
-	// worker监听 /cron/killer/目录下的put事件，创建租约并让他自动过期
-	if leaseGrantResp, err = jobMgr.lease.Grant(context.TODO(), common.KILL_JOB_LEASE_TTL); err != nil {
+	if versionList, err = jobMgr.ListJobVersions(namespace, name); err != nil {
+		return
+	}
+	for _, version = range versionList {
+		if version.Revision != revision {
+			continue
+		}
+		if version.Op == common.JOB_HISTORY_OP_DELETE || version.Job == nil {
+			err = common.ERR_ROLLBACK_TO_DELETE
+			return
+		}
+		job = version.Job
+		job.Namespace = namespace
+		_, err = jobMgr.putJob(job, common.JOB_REVISION_ANY, &common.JobVersion{
+			Op:           common.JOB_HISTORY_OP_ROLLBACK,
+			Operator:     operator,
+			RollbackFrom: revision,
+		})
 		return
 	}
+	err = common.ERR_JOB_VERSION_NOT_FOUND
+	return
+}
+
+// 读取一个任务, 不存在时返回nil
+func (jobMgr *JobMgr) GetJob(namespace string, name string) (job *common.Job, err error) {
+	job, _, err = jobMgr.store.GetJob(namespace, name)
+	return
+}
+
+// 获取命名空间下的任务列表
+func (jobMgr *JobMgr) ListJobs(namespace string) (jobList []*common.Job, err error) {
+	return jobMgr.ListJobsWithPrefix(namespace, "")
+}
+
+// 获取命名空间下任务名以namePrefix开头的任务列表, 按任务名排序
+func (jobMgr *JobMgr) ListJobsWithPrefix(namespace string, namePrefix string) (jobList []*common.Job, err error) {
+	jobList, _, err = jobMgr.store.ListJobs(namespace, namePrefix)
+	return
+}
 
-	// 租约ID
-	leaseId = leaseGrantResp.ID
+// 所有命名空间
+func (jobMgr *JobMgr) ListNamespaces() (namespaces []string, err error) {
+	var (
+		storeNamespaces []string
+		namespace       string
+	)
 
-	// 设置killer标记
-	if _, err = jobMgr.kv.Put(context.TODO(), killKey, "", clientv3.WithLease(leaseId)); err != nil {
+	if storeNamespaces, err = jobMgr.store.ListNamespaces(); err != nil {
 		return
 	}
+
+	// 默认命名空间总是存在, 排在最前面
+	namespaces = []string{common.JOB_NAMESPACE_DEFAULT}
+	for _, namespace = range storeNamespaces {
+		if namespace != common.JOB_NAMESPACE_DEFAULT {
+			namespaces = append(namespaces, namespace)
+		}
+	}
 	return
 }
+
+// 杀死任务
+func (jobMgr *JobMgr) KillJob(namespace string, name string) (err error) {
+	// worker监听强杀通知, 通知自动过期
+	return jobMgr.store.KillJob(namespace, name)
+}
+
+// 关闭任务管理器, etcd连接由各模块共享，不在这里关闭
+func (jobMgr *JobMgr) Close() {
+	jobMgr.purgeCancel()
+	jobMgr.store.Close()
+}
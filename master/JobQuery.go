@@ -0,0 +1,111 @@
+package master
+
+import (
+	"github.com/staryjie/crontab/common"
+	"sort"
+)
+
+// 填充任务最近一次调度的状态, 每个任务查询一次日志
+func fillLastRunStatus(namespace string, jobList []*common.Job) (err error) {
+	var (
+		job *common.Job
+	)
+	for _, job = range jobList {
+		if job.LastRunStatus, err = G_logMgr.LastRunStatus(namespace, job.Name); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 排序任务列表, 排序字段相同时按任务名排序, 保证翻页时顺序稳定
+func sortJobs(jobList []*common.Job, sortBy string, desc bool) {
+	sort.Slice(jobList, func(i, j int) bool {
+		var (
+			a, b *common.Job
+		)
+		a, b = jobList[i], jobList[j]
+		if desc {
+			a, b = b, a
+		}
+		switch sortBy {
+		case common.JOB_SORT_BY_CREATE_TIME:
+			if a.CreateTime != b.CreateTime {
+				return a.CreateTime < b.CreateTime
+			}
+		case common.JOB_SORT_BY_UPDATE_TIME:
+			if a.UpdateTime != b.UpdateTime {
+				return a.UpdateTime < b.UpdateTime
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// 分页查询命名空间下的任务, PageSize<=0时不分页, 返回所有满足条件的任务并且不查询最近执行状态
+// 任务名前缀在etcd中过滤, 其他条件在内存中过滤;
+// 按最近执行状态过滤时只查询满足其他条件的任务的日志, 否则只查询当前页的
+func QueryJobs(namespace string, query *common.JobListQuery) (page *common.JobListPage, err error) {
+	var (
+		jobList    []*common.Job
+		candidates []*common.Job
+		matched    []*common.Job
+		job        *common.Job
+		filter     common.JobListFilter
+		start      int
+		end        int
+	)
+	if jobList, err = G_jobMgr.ListJobsWithPrefix(namespace, query.Filter.NamePrefix); err != nil {
+		return
+	}
+
+	// 先按不需要查询日志的条件过滤
+	filter = query.Filter
+	filter.LastRunStatus = ""
+	candidates = make([]*common.Job, 0)
+	for _, job = range jobList {
+		if filter.Match(job) {
+			candidates = append(candidates, job)
+		}
+	}
+	if query.Filter.LastRunStatus != "" {
+		if err = fillLastRunStatus(namespace, candidates); err != nil {
+			return
+		}
+	}
+
+	page = &common.JobListPage{Page: query.Page, PageSize: query.PageSize}
+	matched = make([]*common.Job, 0)
+	for _, job = range candidates {
+		if !query.Filter.Match(job) {
+			continue
+		}
+		if job.Disabled {
+			page.Disabled++
+		} else {
+			page.Enabled++
+		}
+		matched = append(matched, job)
+	}
+	page.Total = len(matched)
+
+	// 截取当前页
+	sortJobs(matched, query.SortBy, query.Desc)
+	if query.PageSize <= 0 {
+		page.Jobs = matched
+		return
+	}
+	if start = (query.Page - 1) * query.PageSize; start > len(matched) {
+		start = len(matched)
+	}
+	if end = start + query.PageSize; end > len(matched) {
+		end = len(matched)
+	}
+	page.Jobs = matched[start:end]
+
+	// 当前页展示最近执行状态, 日志查询失败不影响任务列表
+	if query.Filter.LastRunStatus == "" {
+		fillLastRunStatus(namespace, page.Jobs)
+	}
+	return
+}
@@ -0,0 +1,390 @@
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/gorhill/cronexpr"
+	"github.com/staryjie/crontab/common"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 待导入的一个任务
+type importEntry struct {
+	job  *common.Job
+	line int // crontab文件中的行号, json/yaml为0
+}
+
+var (
+	// crontab任务行: 分 时 日 月 周 命令
+	crontabJobPattern = regexp.MustCompile(`^(\S+\s+\S+\s+\S+\s+\S+\s+\S+)\s+(.+)$`)
+	// crontab宏: @daily 命令
+	crontabMacroPattern = regexp.MustCompile(`^(@\w+)\s+(.+)$`)
+	// crontab环境变量行: NAME=value
+	crontabEnvPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+	// 注释转任务名时需要替换的字符
+	crontabNamePattern = regexp.MustCompile(`[\s/]+`)
+	// crontab -l输出的字段说明(# m h  dom mon dow   command)中的单词
+	crontabLegendWords = map[string]bool{
+		"m": true, "min": true, "minute": true,
+		"h": true, "hour": true,
+		"dom": true, "day": true,
+		"mon": true, "month": true,
+		"dow": true, "weekday": true,
+		"user": true, "command": true, "cmd": true,
+	}
+
+	// crontab宏对应的cron表达式
+	crontabMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// 根据文件扩展名推断格式, 无法识别时按crontab处理
+func GuessJobFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return common.JOB_FORMAT_JSON
+	case ".yaml", ".yml":
+		return common.JOB_FORMAT_YAML
+	}
+	return common.JOB_FORMAT_CRONTAB
+}
+
+// 导出任务, namespace为空时导出所有命名空间
+func (jobMgr *JobMgr) ExportJobs(namespace string) (jobList []*common.Job, err error) {
+	var (
+		namespaces []string
+		nsJobs     []*common.Job
+		job        *common.Job
+	)
+	if namespace != "" {
+		namespaces = []string{namespace}
+	} else if namespaces, err = jobMgr.ListNamespaces(); err != nil {
+		return
+	}
+
+	jobList = make([]*common.Job, 0)
+	for _, namespace = range namespaces {
+		if nsJobs, err = jobMgr.ListJobs(namespace); err != nil {
+			return
+		}
+		// 导出的是任务定义, 不带revision
+		for _, job = range nsJobs {
+			job.ModRevision = 0
+			jobList = append(jobList, job)
+		}
+	}
+	return
+}
+
+// 把任务列表序列化为json或yaml
+func EncodeJobs(jobList []*common.Job, format string) (content []byte, err error) {
+	switch format {
+	case common.JOB_FORMAT_JSON:
+		content, err = json.MarshalIndent(jobList, "", "  ")
+	case common.JOB_FORMAT_YAML:
+		content, err = yaml.Marshal(jobList)
+	default:
+		err = common.ERR_INVALID_JOB_FORMAT
+	}
+	return
+}
+
+// 解析导入内容, 单行解析失败的crontab条目放入errItems, 整个文件无法解析时返回err
+func decodeJobs(content []byte, format string) (entries []*importEntry, errItems []*common.JobImportItem, err error) {
+	var (
+		jobList []*common.Job
+		job     *common.Job
+	)
+	switch format {
+	case common.JOB_FORMAT_JSON:
+		err = json.Unmarshal(content, &jobList)
+	case common.JOB_FORMAT_YAML:
+		err = yaml.Unmarshal(content, &jobList)
+	case common.JOB_FORMAT_CRONTAB:
+		entries, errItems = parseCrontab(content)
+		return
+	default:
+		err = common.ERR_INVALID_JOB_FORMAT
+	}
+	if err != nil {
+		return
+	}
+	for _, job = range jobList {
+		if job != nil {
+			entries = append(entries, &importEntry{job: job})
+		}
+	}
+	return
+}
+
+// 解析标准crontab文件
+// 任务名取任务行上方紧挨着的注释, 没有注释时为crontab-行号
+// 环境变量行对之后的任务生效, 以export的方式拼接到命令前面
+func parseCrontab(content []byte) (entries []*importEntry, errItems []*common.JobImportItem) {
+	var (
+		scanner  *bufio.Scanner
+		lineNo   int
+		line     string
+		comment  string // 上一行的注释
+		envList  []string
+		matches  []string
+		cronExpr string
+		command  string
+		name     string
+		errItem  *common.JobImportItem
+		ok       bool
+	)
+	scanner = bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		lineNo++
+		line = strings.TrimSpace(scanner.Text())
+
+		// 空行把注释和任务隔开
+		if line == "" {
+			comment = ""
+			continue
+		}
+
+		// 注释, 被注释掉的任务行和字段说明不作为任务名
+		if strings.HasPrefix(line, "#") {
+			comment = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			if _, _, ok = parseCrontabSchedule(comment); ok || isCrontabLegend(comment) {
+				comment = ""
+			}
+			continue
+		}
+
+		// 环境变量
+		if matches = crontabEnvPattern.FindStringSubmatch(line); matches != nil {
+			envList = append(envList, "export "+matches[1]+"="+shellQuote(unquote(strings.TrimSpace(matches[2])))+";")
+			comment = ""
+			continue
+		}
+
+		// 任务名
+		if name = crontabNamePattern.ReplaceAllString(comment, "-"); name == "" {
+			name = "crontab-" + strconv.Itoa(lineNo)
+		}
+		comment = ""
+
+		if cronExpr, command, ok = parseCrontabSchedule(line); !ok {
+			errItem = &common.JobImportItem{Name: name, Line: lineNo, Reason: common.ERR_INVALID_CRONTAB_LINE.Error()}
+			if strings.HasPrefix(line, "@reboot") {
+				errItem.Reason = common.ERR_CRONTAB_REBOOT.Error()
+			}
+			errItems = append(errItems, errItem)
+			continue
+		}
+
+		// crontab中\%表示%本身
+		command = strings.Replace(command, `\%`, "%", -1)
+		if len(envList) != 0 {
+			command = strings.Join(envList, " ") + " " + command
+		}
+		entries = append(entries, &importEntry{
+			job:  &common.Job{Name: name, Command: command, CronExpr: cronExpr},
+			line: lineNo,
+		})
+	}
+	return
+}
+
+// 注释是否是字段说明, 例如crontab -l输出的表头 # m h  dom mon dow   command
+// 至少3个单词并且都是字段名
+func isCrontabLegend(comment string) bool {
+	var (
+		words []string
+		word  string
+	)
+	if words = strings.Fields(strings.ToLower(comment)); len(words) < 3 {
+		return false
+	}
+	for _, word = range words {
+		if !crontabLegendWords[word] {
+			return false
+		}
+	}
+	return true
+}
+
+// 拆分crontab任务行的调度部分和命令
+func parseCrontabSchedule(line string) (cronExpr string, command string, ok bool) {
+	var (
+		matches []string
+		err     error
+	)
+	if matches = crontabMacroPattern.FindStringSubmatch(line); matches != nil {
+		if cronExpr, ok = crontabMacros[matches[1]]; ok {
+			command = matches[2]
+		}
+		return
+	}
+	if matches = crontabJobPattern.FindStringSubmatch(line); matches == nil {
+		return
+	}
+	cronExpr, command = matches[1], matches[2]
+	_, err = cronexpr.Parse(cronExpr)
+	ok = err == nil
+	return
+}
+
+// 去掉环境变量值两侧的引号
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// 用单引号转义shell参数
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// 比较两个任务定义是否相同(忽略revision和master维护的时间、修改人)
+func sameJob(a *common.Job, b *common.Job) bool {
+	var (
+		copyA  common.Job
+		copyB  common.Job
+		bytesA []byte
+		bytesB []byte
+	)
+	copyA, copyB = *a, *b
+	copyA.ModRevision, copyB.ModRevision = 0, 0
+	copyA.CreateTime, copyB.CreateTime = 0, 0
+	copyA.UpdateTime, copyB.UpdateTime = 0, 0
+	copyA.UpdatedBy, copyB.UpdatedBy = "", ""
+	bytesA, _ = json.Marshal(&copyA)
+	bytesB, _ = json.Marshal(&copyB)
+	return bytes.Equal(bytesA, bytesB)
+}
+
+// 导入任务
+// namespace不为空时所有任务导入到该命名空间, 否则使用文件中的命名空间
+// 已存在且内容不同的任务只有overwrite时才覆盖; dryRun时只返回计划不写入
+func (jobMgr *JobMgr) ImportJobs(content []byte, format string, namespace string, overwrite bool, dryRun bool, operator string) (plan *common.JobImportPlan, err error) {
+	var (
+		entries        []*importEntry
+		errItems       []*common.JobImportItem
+		entry          *importEntry
+		job            *common.Job
+		item           *common.JobImportItem
+		existing       map[string]map[string]*common.Job // 命名空间 -> 任务名 -> 任务
+		nsJobs         []*common.Job
+		oldJob         *common.Job
+		seen           map[string]bool
+		fullName       string
+		expectRevision int64
+		target         *[]*common.JobImportItem
+		ok             bool
+	)
+	if entries, errItems, err = decodeJobs(content, format); err != nil {
+		return
+	}
+	// 解析失败的crontab行没有命名空间
+	for _, item = range errItems {
+		item.Namespace = common.NormalizeNamespace(namespace)
+	}
+
+	plan = &common.JobImportPlan{
+		DryRun:    dryRun,
+		Creates:   make([]*common.JobImportItem, 0),
+		Updates:   make([]*common.JobImportItem, 0),
+		Unchanged: make([]*common.JobImportItem, 0),
+		Conflicts: make([]*common.JobImportItem, 0),
+		Errors:    append(make([]*common.JobImportItem, 0), errItems...),
+	}
+	existing = make(map[string]map[string]*common.Job)
+	seen = make(map[string]bool)
+
+	for _, entry = range entries {
+		job = entry.job
+		if namespace != "" {
+			job.Namespace = namespace
+		}
+		job.Namespace = common.NormalizeNamespace(job.Namespace)
+		job.ModRevision = 0
+		job.LastRunStatus = ""
+		item = &common.JobImportItem{Namespace: job.Namespace, Name: job.Name, Line: entry.line}
+
+		// 校验
+		if !common.IsValidNamespace(job.Namespace) {
+			item.Reason = common.ERR_INVALID_NAMESPACE.Error()
+			plan.Errors = append(plan.Errors, item)
+			continue
+		}
+		if err = common.ValidateJob(job); err != nil {
+			item.Reason = err.Error()
+			plan.Errors = append(plan.Errors, item)
+			err = nil
+			continue
+		}
+
+		// 同一份导入内容中不允许重名
+		fullName = common.JobFullName(job.Namespace, job.Name)
+		if seen[fullName] {
+			item.Reason = common.ERR_DUPLICATE_JOB_NAME.Error()
+			plan.Conflicts = append(plan.Conflicts, item)
+			continue
+		}
+		seen[fullName] = true
+
+		// 按命名空间加载已有任务
+		if _, ok = existing[job.Namespace]; !ok {
+			if nsJobs, err = jobMgr.ListJobs(job.Namespace); err != nil {
+				return
+			}
+			existing[job.Namespace] = make(map[string]*common.Job)
+			for _, oldJob = range nsJobs {
+				existing[job.Namespace][oldJob.Name] = oldJob
+			}
+		}
+
+		// 和已有任务对比
+		oldJob = existing[job.Namespace][job.Name]
+		switch {
+		case oldJob == nil:
+			expectRevision = 0
+			target = &plan.Creates
+		case sameJob(oldJob, job):
+			plan.Unchanged = append(plan.Unchanged, item)
+			continue
+		case !overwrite:
+			item.Reason = common.ERR_JOB_EXISTS.Error()
+			plan.Conflicts = append(plan.Conflicts, item)
+			continue
+		default:
+			// 只覆盖预览时看到的版本
+			expectRevision = oldJob.ModRevision
+			target = &plan.Updates
+		}
+
+		// 写入, 期间被其他人修改的任务记为冲突
+		if !dryRun {
+			if _, err = jobMgr.SaveJob(job, expectRevision, operator); err != nil {
+				item.Reason = err.Error()
+				if err == common.ERR_JOB_CONFLICT {
+					plan.Conflicts = append(plan.Conflicts, item)
+				} else {
+					plan.Errors = append(plan.Errors, item)
+				}
+				err = nil
+				continue
+			}
+		}
+		*target = append(*target, item)
+	}
+	return
+}
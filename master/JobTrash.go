@@ -0,0 +1,212 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/staryjie/crontab/common"
+	"sort"
+	"time"
+)
+
+// 生成把任务放入回收站的记录, 与删除任务在同一个事务中写入
+func buildTrashRecord(job *common.Job, operator string, now time.Time) (record *common.RecordWrite, err error) {
+	var (
+		trashJob   common.TrashJob
+		trashValue []byte
+	)
+	trashJob = common.TrashJob{
+		Id:         common.BuildTrashId(now),
+		Namespace:  job.Namespace,
+		Name:       job.Name,
+		DeleteTime: now.UnixNano() / 1000 / 1000,
+		DeletedBy:  operator,
+		Job:        job,
+	}
+	if trashValue, err = json.Marshal(&trashJob); err != nil {
+		return
+	}
+	record = common.BuildRecordPut(common.BuildTrashKey(job.Namespace, job.Name, trashJob.Id), trashValue)
+	return
+}
+
+// 回收站中的任务, 最近删除的在前
+// name为空时列出命名空间下所有被删除的任务
+func (jobMgr *JobMgr) ListTrash(namespace string, name string) (trashList []*common.TrashJob, err error) {
+	var (
+		dirKey   string
+		records  []*common.StoreRecord
+		record   *common.StoreRecord
+		trashJob *common.TrashJob
+	)
+	if dirKey = common.JOB_TRASH_DIR + namespace + "/"; name != "" {
+		dirKey = common.BuildTrashDir(namespace, name)
+	}
+	if records, err = jobMgr.store.ListRecords(dirKey, false); err != nil {
+		return
+	}
+
+	trashList = make([]*common.TrashJob, 0)
+	for _, record = range records {
+		if trashJob, err = common.UnpackTrashJob(record.Key, record.Value); err != nil {
+			err = nil
+			continue
+		}
+		trashList = append(trashList, trashJob)
+	}
+	// key按任务名排序, 这里改为按删除时间倒排, 相同时按任务名
+	sort.Slice(trashList, func(i, j int) bool {
+		if trashList[i].Id != trashList[j].Id {
+			return trashList[i].Id > trashList[j].Id
+		}
+		return trashList[i].Name < trashList[j].Name
+	})
+	return
+}
+
+// 从回收站恢复任务, 同名任务已经存在时返回ERR_JOB_CONFLICT以及任务的当前值
+func (jobMgr *JobMgr) RestoreJob(namespace string, name string, id string, operator string) (job *common.Job, err error) {
+	var (
+		trashKey string
+		record   *common.StoreRecord
+		trashJob *common.TrashJob
+		curJob   *common.Job
+	)
+	trashKey = common.BuildTrashKey(namespace, name, id)
+	if record, err = jobMgr.store.GetRecord(trashKey); err != nil {
+		return
+	}
+	if record == nil {
+		err = common.ERR_TRASH_NOT_FOUND
+		return
+	}
+	if trashJob, err = common.UnpackTrashJob(trashKey, record.Value); err != nil {
+		return
+	}
+	if trashJob.Job == nil {
+		err = common.ERR_TRASH_NOT_FOUND
+		return
+	}
+
+	// 只能恢复到不存在的任务, 恢复的同时从回收站中移除
+	job = trashJob.Job
+	job.Namespace, job.Name = namespace, name
+	if curJob, err = jobMgr.putJob(job, 0, &common.JobVersion{Op: common.JOB_HISTORY_OP_RESTORE, Operator: operator},
+		common.BuildRecordDelete(trashKey)); err != nil {
+		job = curJob
+	}
+	return
+}
+
+// 彻底删除回收站中的任务, 任务不再存在时一并删除它的版本记录和日志(按配置)
+// id为空时删除任务名下的所有记录, name也为空时清空整个命名空间的回收站
+func (jobMgr *JobMgr) PurgeTrash(namespace string, name string, id string) (purged int64, err error) {
+	var (
+		names     []string
+		jobName   string
+		trashList []*common.TrashJob
+		trashJob  *common.TrashJob
+		seen      map[string]bool
+	)
+	switch {
+	case name == "":
+		// 先记下回收站中的任务名, 清空后逐个清理版本记录
+		if trashList, err = jobMgr.ListTrash(namespace, ""); err != nil {
+			return
+		}
+		seen = make(map[string]bool)
+		for _, trashJob = range trashList {
+			if !seen[trashJob.Name] {
+				seen[trashJob.Name] = true
+				names = append(names, trashJob.Name)
+			}
+		}
+		purged, err = jobMgr.store.DeleteRecords(common.JOB_TRASH_DIR+namespace+"/", true)
+	case id == "":
+		names = []string{name}
+		purged, err = jobMgr.store.DeleteRecords(common.BuildTrashDir(namespace, name), true)
+	default:
+		names = []string{name}
+		purged, err = jobMgr.store.DeleteRecords(common.BuildTrashKey(namespace, name, id), false)
+	}
+	if err != nil {
+		return
+	}
+	for _, jobName = range names {
+		if err = jobMgr.purgeDeletedJob(namespace, jobName); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 清理超过保留时间的回收站记录
+func (jobMgr *JobMgr) purgeExpiredTrash(retention time.Duration) (purged int64, err error) {
+	var (
+		records   []*common.StoreRecord
+		record    *common.StoreRecord
+		trashJob  *common.TrashJob
+		deadline  int64
+		succeeded bool
+	)
+	deadline = time.Now().Add(-retention).UnixNano() / 1000 / 1000
+	if records, err = jobMgr.store.ListRecords(common.JOB_TRASH_DIR, false); err != nil {
+		return
+	}
+	for _, record = range records {
+		// master关闭时停止清理
+		if jobMgr.purgeCtx.Err() != nil {
+			return
+		}
+		if trashJob, err = common.UnpackTrashJob(record.Key, record.Value); err != nil {
+			err = nil
+			continue
+		}
+		if trashJob.DeleteTime >= deadline {
+			continue
+		}
+		// 只删除读到的这个版本, 期间被恢复或者重新写入的不删
+		if succeeded, err = jobMgr.store.Commit(nil, []*common.RecordWrite{{Key: record.Key, ExpectRevision: record.ModRevision}}); err != nil {
+			return
+		}
+		if succeeded {
+			purged++
+			if err = jobMgr.purgeDeletedJob(trashJob.Namespace, trashJob.Name); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// 定期清理过期的回收站记录, 保留天数<=0时不清理
+// 多个master同时清理是安全的
+func (jobMgr *JobMgr) StartTrashPurge(retentionDays int) {
+	var (
+		retention time.Duration
+	)
+	if retentionDays <= 0 {
+		return
+	}
+	retention = time.Duration(retentionDays) * 24 * time.Hour
+	go func() {
+		var (
+			ticker *time.Ticker
+			purged int64
+			err    error
+		)
+		ticker = time.NewTicker(common.JOB_TRASH_PURGE_INTERVAL * time.Second)
+		defer ticker.Stop()
+		for {
+			if purged, err = jobMgr.purgeExpiredTrash(retention); err != nil {
+				fmt.Println("清理回收站失败:", err)
+			} else if purged != 0 {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "清理过期的回收站任务:", purged)
+			}
+			select {
+			case <-ticker.C:
+			case <-jobMgr.purgeCtx.Done():
+				return
+			}
+		}
+	}()
+}
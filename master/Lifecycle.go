@@ -0,0 +1,66 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// 默认优雅退出超时时间
+	DEFAULT_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// 按照依赖的逆序关闭各个模块:
+// 先停止HTTP服务不再接收新请求，再关闭各管理器，最后关闭共享的etcd连接
+func Shutdown() {
+	var (
+		timeout    time.Duration
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		err        error
+	)
+
+	// 优雅退出的最长等待时间
+	timeout = DEFAULT_SHUTDOWN_TIMEOUT
+	if G_config != nil && G_config.ShutdownTimeout > 0 {
+		timeout = time.Duration(G_config.ShutdownTimeout) * time.Millisecond
+	}
+
+	ctx, cancelFunc = context.WithTimeout(context.TODO(), timeout)
+	defer cancelFunc()
+
+	// 1.停止Api HTTP服务，等待处理中的请求完成
+	if G_apiServer != nil {
+		if err = G_apiServer.Stop(ctx); err != nil {
+			fmt.Println("关闭Api服务失败:", err)
+		}
+	}
+
+	// 2.调度分派器，让出leader
+	if G_dispatcher != nil {
+		G_dispatcher.Stop()
+	}
+
+	// 3.任务管理器
+	if G_jobMgr != nil {
+		G_jobMgr.Close()
+	}
+
+	// 4.服务发现模块
+	if G_workerMgr != nil {
+		G_workerMgr.Close()
+	}
+
+	// 5.日志管理器
+	if G_logMgr != nil {
+		if err = G_logMgr.Close(ctx); err != nil {
+			fmt.Println("关闭MongoDB连接失败:", err)
+		}
+	}
+
+	// 6.共享的etcd连接
+	if err = CloseEtcdClient(); err != nil {
+		fmt.Println("关闭etcd连接失败:", err)
+	}
+}
@@ -2,17 +2,15 @@ package master
 
 import (
 	"context"
-	"github.com/mongodb/mongo-go-driver/mongo"
-	"github.com/mongodb/mongo-go-driver/mongo/clientopt"
-	"github.com/mongodb/mongo-go-driver/mongo/findopt"
 	"github.com/staryjie/crontab/common"
-	"time"
 )
 
-// mongodb日志管理
+// 日志管理, 日志存储由配置决定
 type LogMgr struct {
-	client        *mongo.Client
-	logCollection *mongo.Collection
+	store common.LogStore
+
+	purgeCtx    context.Context    // 用于停止日志清理
+	purgeCancel context.CancelFunc // 停止日志清理的取消函数
 }
 
 var (
@@ -21,58 +19,224 @@ var (
 
 func InitLogMgr() (err error) {
 	var (
-		client *mongo.Client
+		store common.LogStore
 	)
 
-	// 建立mongodb连接
-	if client, err = mongo.Connect(
-		context.TODO(),
-		G_config.MongodbUri,
-		clientopt.ConnectTimeout(time.Duration(G_config.MongodbConnectTimeout)*time.Millisecond)); err != nil {
+	// 连接日志存储
+	if store, err = common.InitLogStore(G_config.logStoreConfig()); err != nil {
 		return
 	}
 
 	G_logMgr = &LogMgr{
-		client:        client,
-		logCollection: client.Database("cron").Collection("log"),
+		store: store,
 	}
+	G_logMgr.purgeCtx, G_logMgr.purgeCancel = context.WithCancel(context.TODO())
 	return
 }
 
-// 查看任务日志
-func (logMgr *LogMgr) ListLog(name string, skip int, limit int) (logArr []*common.JobLog, err error) {
+// 查看任务日志, 按照任务开始时间倒排
+func (logMgr *LogMgr) ListLog(namespace string, name string, skip int, limit int) (logArr []*common.JobLog, err error) {
+	return logMgr.store.Query(&common.JobLogQuery{
+		Namespace: namespace,
+		JobName:   name,
+		SortBy:    common.JOB_LOG_SORT_BY_START_TIME,
+		Skip:      skip,
+		Limit:     limit,
+	})
+}
+
+// 关闭日志存储
+func (logMgr *LogMgr) Close(ctx context.Context) (err error) {
+	logMgr.purgeCancel()
+	return logMgr.store.Close(ctx)
+}
+
+// 按计划时间汇总任务的执行情况，广播任务每次调度会有多个worker的日志
+func (logMgr *LogMgr) ListRuns(namespace string, name string, skip int, limit int) (runArr []*common.JobRun, err error) {
 	var (
-		filter  *common.JobLogFilter
-		logSort *common.SortLogByStartTime
-		cursor  mongo.Cursor
-		jobLog  *common.JobLog
+		query        *common.JobLogQuery
+		logList      []*common.JobLog
+		jobLog       *common.JobLog
+		run          *common.JobRun
+		skipped      int
+		finished     bool
+		lastPlanTime int64
+		index        int
 	)
 
-	// len(logArr)
-	logArr = make([]*common.JobLog, 0)
+	runArr = make([]*common.JobRun, 0)
+
+	// 按照计划时间倒排，同一次调度的日志相邻; 分批读取, 取够了就不再读取
+	query = &common.JobLogQuery{
+		Namespace: namespace,
+		JobName:   name,
+		SortBy:    common.JOB_LOG_SORT_BY_PLAN_TIME,
+		Limit:     common.JOB_LOG_QUERY_BATCH,
+	}
+
+	for !finished {
+		if logList, err = logMgr.store.Query(query); err != nil {
+			return
+		}
+		if finished = len(logList) < query.Limit; !finished {
+			// 批次中最后一次调度的日志可能不完整, 留到下一批, 下一批从它的计划时间开始读
+			lastPlanTime = logList[len(logList)-1].PlanTime
+			for index = len(logList); index > 0 && logList[index-1].PlanTime == lastPlanTime; index-- {
+			}
+			if index == 0 {
+				// 一次调度的日志比一批还多
+				query.Limit *= 2
+				continue
+			}
+			logList = logList[:index]
+			query.PlanBefore = lastPlanTime + 1
+		}
+
+		for _, jobLog = range logList {
+			// 新的一次调度
+			if run == nil || run.PlanTime != jobLog.PlanTime {
+				if run != nil {
+					summarizeRun(run)
+					if skipped < skip {
+						skipped++
+					} else {
+						runArr = append(runArr, run)
+					}
+				}
+				// 已经取够了
+				if len(runArr) >= limit {
+					run = nil
+					goto DONE
+				}
+				run = &common.JobRun{
+					PlanTime:  jobLog.PlanTime,
+					Succeeded: make([]string, 0),
+					Failed:    make([]string, 0),
+					Logs:      make([]*common.JobLog, 0),
+				}
+			}
 
-	// 过滤条件
-	filter = &common.JobLogFilter{JobName: name}
+			// 按执行结果归类worker
+			if jobLog.Err == "" {
+				run.Succeeded = append(run.Succeeded, jobLog.Worker)
+			} else {
+				run.Failed = append(run.Failed, jobLog.Worker)
+			}
+			run.Logs = append(run.Logs, jobLog)
+		}
+	}
 
-	// 按照任务开始时间倒排
-	logSort = &common.SortLogByStartTime{SortOrder: -1}
+DONE:
+	// 最后一次调度
+	if run != nil && skipped >= skip && len(runArr) < limit {
+		summarizeRun(run)
+		runArr = append(runArr, run)
+	}
+	return
+}
+
+// 计算一次调度的整体状态, 分片任务还要计算每个分片的状态
+func summarizeRun(run *common.JobRun) {
+	var (
+		jobLog     *common.JobLog
+		shardIndex int
+	)
+
+	// 非分片任务: 有失败即失败
+	if len(run.Failed) != 0 {
+		run.Status = common.JOB_RUN_STATUS_FAILED
+	} else {
+		run.Status = common.JOB_RUN_STATUS_SUCCESS
+	}
 
-	// 查询
-	if cursor, err = logMgr.logCollection.Find(context.TODO(), filter, findopt.Sort(logSort), findopt.Skip(int64(skip)), findopt.Limit(int64(limit))); err != nil {
+	// 分片任务: 以日志中记录的分片总数为准
+	for _, jobLog = range run.Logs {
+		if jobLog.ShardTotal > run.ShardTotal {
+			run.ShardTotal = jobLog.ShardTotal
+		}
+	}
+	if run.ShardTotal == 0 {
 		return
 	}
-	// 延迟释放游标
-	defer cursor.Close(context.TODO())
 
-	for cursor.Next(context.TODO()) {
-		jobLog = &common.JobLog{}
+	// 没有日志的分片还未执行完成
+	run.Shards = make([]string, run.ShardTotal)
+	for shardIndex = range run.Shards {
+		run.Shards[shardIndex] = common.JOB_RUN_STATUS_INCOMPLETE
+	}
+	for _, jobLog = range run.Logs {
+		if jobLog.ShardIndex < 0 || jobLog.ShardIndex >= run.ShardTotal {
+			continue
+		}
+		if jobLog.Err == "" {
+			run.Shards[jobLog.ShardIndex] = common.JOB_RUN_STATUS_SUCCESS
+		} else {
+			run.Shards[jobLog.ShardIndex] = common.JOB_RUN_STATUS_FAILED
+		}
+	}
 
-		// 反序列化BSON
-		if err = cursor.Decode(jobLog); err != nil {
-			continue // 有日志不合法
+	// 有分片失败则失败，有分片未完成则未完成
+	run.Status = common.JOB_RUN_STATUS_SUCCESS
+	for shardIndex = range run.Shards {
+		if run.Shards[shardIndex] == common.JOB_RUN_STATUS_FAILED {
+			run.Status = common.JOB_RUN_STATUS_FAILED
+			return
 		}
+		if run.Shards[shardIndex] == common.JOB_RUN_STATUS_INCOMPLETE {
+			run.Status = common.JOB_RUN_STATUS_INCOMPLETE
+		}
+	}
+}
 
-		logArr = append(logArr, jobLog)
+// 任务最近一次调度的状态, 没有执行记录时为none
+// 按计划时间倒排只读取最近的几条日志, 取其中计划时间最新的一次调度
+func (logMgr *LogMgr) LastRunStatus(namespace string, name string) (status string, err error) {
+	var (
+		query   *common.JobLogQuery
+		logList []*common.JobLog
+		jobLog  *common.JobLog
+		run     *common.JobRun
+		count   int
+	)
+	query = &common.JobLogQuery{
+		Namespace: namespace,
+		JobName:   name,
+		SortBy:    common.JOB_LOG_SORT_BY_PLAN_TIME,
+		Limit:     common.JOB_LOG_LAST_RUN_BATCH,
+	}
+	for {
+		if logList, err = logMgr.store.Query(query); err != nil {
+			return
+		}
+		if len(logList) == 0 {
+			status = common.JOB_RUN_STATUS_NONE
+			return
+		}
+		// 最近一次调度的日志条数
+		for count = 0; count < len(logList) && logList[count].PlanTime == logList[0].PlanTime; count++ {
+		}
+		// 读到的全是同一次调度, 可能还有没读到的
+		if count == query.Limit {
+			query.Limit *= 2
+			continue
+		}
+		break
+	}
+
+	run = &common.JobRun{
+		PlanTime:  logList[0].PlanTime,
+		Succeeded: make([]string, 0),
+		Failed:    make([]string, 0),
+		Logs:      logList[:count],
+	}
+	for _, jobLog = range run.Logs {
+		if jobLog.Err == "" {
+			run.Succeeded = append(run.Succeeded, jobLog.Worker)
+		} else {
+			run.Failed = append(run.Failed, jobLog.Worker)
+		}
 	}
+	summarizeRun(run)
+	status = run.Status
 	return
 }
@@ -0,0 +1,115 @@
+package master
+
+import (
+	"fmt"
+	"github.com/staryjie/crontab/common"
+	"time"
+)
+
+// 删除任务的日志, before>0时只删除结束时间早于它的日志(毫秒)
+func (logMgr *LogMgr) PurgeLogs(namespace string, name string, before int64) (deleted int64, err error) {
+	if name == "" {
+		err = common.ERR_EMPTY_JOB_NAME
+		return
+	}
+	return logMgr.store.Delete(&common.JobLogQuery{
+		Namespace: namespace,
+		JobName:   name,
+		EndBefore: before,
+	})
+}
+
+// 每个任务只保留最近maxPerJob条日志
+// 按计划时间倒排, 超出的部分整次调度删除; 第maxPerJob条所在的调度整次保留, 所以可能略多于maxPerJob
+func (logMgr *LogMgr) trimJobLogs(job *common.Job, maxPerJob int) (deleted int64, err error) {
+	var (
+		logList    []*common.JobLog
+		planBefore int64
+	)
+	// 第maxPerJob新和第maxPerJob+1新的日志
+	if logList, err = logMgr.store.Query(&common.JobLogQuery{
+		Namespace: job.Namespace,
+		JobName:   job.Name,
+		SortBy:    common.JOB_LOG_SORT_BY_PLAN_TIME,
+		Skip:      maxPerJob - 1,
+		Limit:     2,
+	}); err != nil || len(logList) < 2 {
+		return
+	}
+	// 超出的第一条和保留的最后一条属于同一次调度时, 保留这次调度
+	if planBefore = logList[1].PlanTime + 1; logList[0].PlanTime == logList[1].PlanTime {
+		planBefore = logList[1].PlanTime
+	}
+	return logMgr.store.Delete(&common.JobLogQuery{
+		Namespace:  job.Namespace,
+		JobName:    job.Name,
+		PlanBefore: planBefore,
+	})
+}
+
+// 清理超过保留天数的日志, 以及超出每个任务保留条数的日志
+// 保留条数只对现有的任务生效, 已删除任务的日志只按天数清理
+func (logMgr *LogMgr) purgeExpiredLogs(retentionDays int, maxPerJob int) (purged int64, err error) {
+	var (
+		deadline int64
+		jobList  []*common.Job
+		job      *common.Job
+		deleted  int64
+	)
+	if retentionDays > 0 {
+		deadline = time.Now().Add(-time.Duration(retentionDays)*24*time.Hour).UnixNano() / 1000 / 1000
+		if purged, err = logMgr.store.Delete(&common.JobLogQuery{EndBefore: deadline}); err != nil {
+			return
+		}
+	}
+	if maxPerJob <= 0 {
+		return
+	}
+
+	if jobList, err = G_jobMgr.ListJobs(""); err != nil {
+		return
+	}
+	for _, job = range jobList {
+		// master关闭时停止清理
+		if logMgr.purgeCtx.Err() != nil {
+			return
+		}
+		if deleted, err = logMgr.trimJobLogs(job, maxPerJob); err != nil {
+			return
+		}
+		purged += deleted
+	}
+	return
+}
+
+// 定期清理日志, 保留天数和保留条数都<=0时不清理
+// 多个master同时清理是安全的, 需要在任务管理器初始化之后调用
+func (logMgr *LogMgr) StartLogPurge(retentionDays int, maxPerJob int, interval int) {
+	if retentionDays <= 0 && maxPerJob <= 0 {
+		return
+	}
+	if interval <= 0 {
+		interval = common.JOB_LOG_PURGE_INTERVAL
+	}
+	go func() {
+		var (
+			ticker *time.Ticker
+			purged int64
+			err    error
+		)
+		ticker = time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			if purged, err = logMgr.purgeExpiredLogs(retentionDays, maxPerJob); err != nil {
+				fmt.Println("清理任务日志失败:", err)
+			} else if purged != 0 {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "清理过期的任务日志:", purged)
+			}
+			select {
+			case <-ticker.C:
+			case <-logMgr.purgeCtx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -1,18 +1,15 @@
 package master
 
 import (
-	"context"
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"encoding/json"
 	"github.com/staryjie/crontab/common"
+	"strings"
 	"time"
 )
 
 // /cron/workers/
 type WorkerMgr struct {
-	client *clientv3.Client
-	kv     clientv3.KV
-	lease  clientv3.Lease
+	store common.JobStore // worker注册信息和运维状态保存在任务存储中
 }
 
 var (
@@ -20,57 +17,182 @@ var (
 )
 
 // 获取在线worker列表
-func (workerMgr *WorkerMgr) ListWorkers() (workerArr []string, err error) {
+func (workerMgr *WorkerMgr) ListWorkers() (workerArr []*common.WorkerInfo, err error) {
 	var (
-		getResp  *clientv3.GetResponse
-		kv       *mvccpb.KeyValue
-		workerIP string
+		records     []*common.StoreRecord
+		record      *common.StoreRecord
+		stateMap    map[string]string
+		workerInfo  *common.WorkerInfo
+		workerState *common.WorkerState
 	)
 
 	// 初始化数组
-	workerArr = make([]string, 0)
+	workerArr = make([]*common.WorkerInfo, 0)
 
-	// 获取目录下所有Kv
-	if getResp, err = workerMgr.kv.Get(context.TODO(), common.JOB_WORK_DIR, clientv3.WithPrefix()); err != nil {
+	// 运维状态以master写入的为准
+	stateMap = make(map[string]string)
+	if records, err = workerMgr.store.ListRecords(common.JOB_WORKER_STATE_DIR, false); err != nil {
+		return
+	}
+	for _, record = range records {
+		if workerState, err = common.UnpackWorkerState(record.Value); err != nil {
+			err = nil
+			continue
+		}
+		stateMap[common.ExtractWorkerStateId(record.Key)] = workerState.State
+	}
+
+	// 获取目录下所有注册信息
+	if records, err = workerMgr.store.ListRecords(common.JOB_WORK_DIR, false); err != nil {
 		return
 	}
 
-	// 解析每个节点的IP
-	for _, kv = range getResp.Kvs {
-		// kv.Key : /cron/workers/192.168.2.1
-		workerIP = common.ExtractWorkerIP(string(kv.Key))
-		workerArr = append(workerArr, workerIP)
+	// 解析每个节点的注册信息
+	for _, record = range records {
+		// record.Key : /cron/workers/192.168.2.1 或者 /cron/workers/{workerId}
+		workerInfo = common.UnpackWorkerInfo(record.Key, record.Value)
+		workerInfo.State = stateMap[workerInfo.Id]
+		// worker上报的排空结果只在draining状态下有效
+		workerInfo.Drained = workerInfo.Drained && workerInfo.State == common.WORKER_STATE_DRAINING
+		workerArr = append(workerArr, workerInfo)
 	}
 	return
 }
 
-func InitWorkerMgr() (err error) {
+// 获取单个在线worker
+func (workerMgr *WorkerMgr) GetWorker(workerId string) (workerInfo *common.WorkerInfo, err error) {
+	var (
+		workerArr []*common.WorkerInfo
+		worker    *common.WorkerInfo
+	)
+	if workerArr, err = workerMgr.ListWorkers(); err != nil {
+		return
+	}
+	for _, worker = range workerArr {
+		if worker.Id == workerId {
+			workerInfo = worker
+			return
+		}
+	}
+	err = common.ERR_WORKER_NOT_FOUND
+	return
+}
+
+// 修改worker运维状态, 恢复正常时删除状态记录
+// 封锁/排空只能作用于已注册的worker, 解除封锁允许清理已下线worker残留的状态
+func (workerMgr *WorkerMgr) SetWorkerState(workerId string, state string) (err error) {
 	var (
-		config clientv3.Config
-		client *clientv3.Client
-		kv     clientv3.KV
-		lease  clientv3.Lease
+		stateKey   string
+		stateValue []byte
+		record     *common.StoreRecord
 	)
 
-	// 初始化配置
-	config = clientv3.Config{
-		Endpoints:   G_config.EtcdEndpoints,                                     // 集群地址
-		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 连接超时
+	if workerId == "" {
+		err = common.ERR_EMPTY_WORKER_ID
+		return
+	}
+	if strings.Contains(workerId, "/") {
+		err = common.ERR_INVALID_WORKER_ID
+		return
 	}
 
-	// 建立连接
-	if client, err = clientv3.New(config); err != nil {
+	stateKey = common.JOB_WORKER_STATE_DIR + workerId
+
+	if state == common.WORKER_STATE_ACTIVE {
+		_, err = workerMgr.store.DeleteRecords(stateKey, false)
 		return
 	}
 
-	// 得到KV和Lease的API子集
-	kv = clientv3.NewKV(client)
-	lease = clientv3.NewLease(client)
+	if stateValue, err = json.Marshal(&common.WorkerState{
+		State:     state,
+		UpdatedAt: time.Now().UnixNano() / 1000 / 1000,
+	}); err != nil {
+		return
+	}
 
-	G_workerMgr = &WorkerMgr{
-		client: client,
-		kv:     kv,
-		lease:  lease,
+	// worker必须已注册, 避免给不存在的节点写入孤立的状态
+	if record, err = workerMgr.store.GetRecord(common.JOB_WORK_DIR + workerId); err != nil {
+		return
+	}
+	if record == nil {
+		err = common.ERR_WORKER_NOT_FOUND
+		return
+	}
+	_, err = workerMgr.store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut(stateKey, stateValue)})
+	return
+}
+
+// 排空worker: 封锁并等待正在执行的任务结束, timeout为0时不等待
+func (workerMgr *WorkerMgr) DrainWorker(workerId string, timeout time.Duration) (workerInfo *common.WorkerInfo, err error) {
+	var (
+		deadline   time.Time
+		drainStart int64
+	)
+
+	// worker必须在线
+	if _, err = workerMgr.GetWorker(workerId); err != nil {
+		return
+	}
+
+	// 记录排空请求的时间, 之前上报的排空结果可能来自上一次排空, 不能作数
+	drainStart = time.Now().UnixNano() / 1000 / 1000
+	if err = workerMgr.SetWorkerState(workerId, common.WORKER_STATE_DRAINING); err != nil {
+		return
 	}
+
+	// 轮询worker上报的排空结果
+	deadline = time.Now().Add(timeout)
+	for {
+		if workerInfo, err = workerMgr.GetWorker(workerId); err != nil {
+			return
+		}
+		// 只认排空请求之后上报的结果
+		workerInfo.Drained = workerInfo.State == common.WORKER_STATE_DRAINING && workerInfo.Drained && workerInfo.UpdatedAt > drainStart
+		if workerInfo.Drained || timeout == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			err = common.ERR_DRAIN_TIMEOUT
+			return
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// 是否有在线worker满足标签选择器
+func (workerMgr *WorkerMgr) HasMatchingWorker(namespace string, selector map[string]string) (matched bool, err error) {
+	var (
+		workerArr  []*common.WorkerInfo
+		workerInfo *common.WorkerInfo
+	)
+
+	if workerArr, err = workerMgr.ListWorkers(); err != nil {
+		return
+	}
+	for _, workerInfo = range workerArr {
+		if common.ServesNamespace(workerInfo.Namespaces, namespace) && common.MatchSelector(selector, workerInfo.Labels) {
+			matched = true
+			return
+		}
+	}
+	return
+}
+
+// 初始化服务发现模块, 使用etcd任务存储
+func InitWorkerMgr() (err error) {
+	// 使用共享的etcd连接
+	InitWorkerMgrWithStore(common.InitEtcdJobStore(G_etcdClient, 0))
 	return
 }
+
+// 使用指定的任务存储初始化服务发现模块, 进程内测试时传入内存存储
+func InitWorkerMgrWithStore(store common.JobStore) {
+	G_workerMgr = &WorkerMgr{
+		store: store,
+	}
+}
+
+// 关闭服务发现模块
+func (workerMgr *WorkerMgr) Close() {
+	workerMgr.store.Close()
+}
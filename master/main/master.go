@@ -1,21 +1,52 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/staryjie/crontab/common"
 	"github.com/staryjie/crontab/master"
+	"io/ioutil"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
 var (
 	configFile string // 配置文件路径
+
+	// 导入导出命令, 指定后执行完直接退出, 不启动服务
+	exportFile      string // 导出到文件, -表示标准输出
+	importFile      string // 从文件导入
+	transferFormat  string // 格式, 为空时按文件扩展名推断
+	transferNs      string // 命名空间, 为空时导出所有/使用文件中的命名空间
+	importDryRun    bool   // 只打印导入计划
+	importOverwrite bool   // 覆盖内容不同的已有任务
+
+	// 声明式同步命令
+	applyDir    string // 清单目录
+	applySource string // 清单来源
+	applyPrune  bool   // 删除清单中没有的非受管任务
 )
 
 // 解析命令行参数
 func initArgs() {
 	// master -config master.json  生产环境建议填写绝对路径，因为你无法控制用户从哪里启动你的程序
 	flag.StringVar(&configFile, "config", "/Users/staryjie/go/src/github.com/staryjie/crontab/master/main/master.json", "Enter program configuration file")
+	// master -config master.json -export jobs.yaml
+	// master -config master.json -import crontab.txt -format crontab -namespace ops -dry-run
+	flag.StringVar(&exportFile, "export", "", "Export jobs to file (- for stdout) and exit")
+	flag.StringVar(&importFile, "import", "", "Import jobs from file (- for stdin) and exit")
+	flag.StringVar(&transferFormat, "format", "", "Import/export format: json, yaml or crontab (default: by file extension)")
+	flag.StringVar(&transferNs, "namespace", "", "Namespace to export from or import into")
+	flag.BoolVar(&importDryRun, "dry-run", false, "Print the import or apply plan without writing")
+	flag.BoolVar(&importOverwrite, "overwrite", false, "Overwrite existing jobs that differ")
+	// master -config master.json -apply ./jobs -source git@example.com:ops/jobs.git -dry-run
+	flag.StringVar(&applyDir, "apply", "", "Apply job manifests (json/yaml) in directory and exit")
+	flag.StringVar(&applySource, "source", "", "Manifest source recorded on managed jobs (default: apply)")
+	flag.BoolVar(&applyPrune, "prune", false, "Also delete unmanaged jobs missing from the manifests")
 	flag.Parse()
 }
 
@@ -24,9 +55,100 @@ func initEnv() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
+// 导出任务到文件
+func runExport() (err error) {
+	var (
+		format  string
+		jobList []*common.Job
+		content []byte
+	)
+	if format = transferFormat; format == "" {
+		format = master.GuessJobFormat(exportFile)
+	}
+	if jobList, err = master.G_jobMgr.ExportJobs(transferNs); err != nil {
+		return
+	}
+	if content, err = master.EncodeJobs(jobList, format); err != nil {
+		return
+	}
+	if exportFile == "-" {
+		_, err = os.Stdout.Write(content)
+		return
+	}
+	if err = ioutil.WriteFile(exportFile, content, 0644); err != nil {
+		return
+	}
+	fmt.Printf("导出%d个任务到%s\n", len(jobList), exportFile)
+	return
+}
+
+// 从文件导入任务并打印导入计划
+func runImport() (err error) {
+	var (
+		format  string
+		content []byte
+		plan    *common.JobImportPlan
+		output  []byte
+	)
+	if format = transferFormat; format == "" {
+		format = master.GuessJobFormat(importFile)
+	}
+	if importFile == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(importFile)
+	}
+	if err != nil {
+		return
+	}
+	if plan, err = master.G_jobMgr.ImportJobs(content, format, transferNs, importOverwrite, importDryRun, "cli"); err != nil {
+		return
+	}
+	if output, err = json.MarshalIndent(plan, "", "  "); err != nil {
+		return
+	}
+	fmt.Println(string(output))
+	return
+}
+
+// 按清单目录同步任务并打印计划, 有错误或冲突时返回错误
+func runApply() (err error) {
+	var (
+		jobList  []*common.Job
+		plan     *common.JobApplyPlan
+		applyErr error
+		output   []byte
+	)
+	if jobList, err = master.LoadManifestDir(applyDir); err != nil {
+		return
+	}
+	plan, applyErr = master.G_jobMgr.ApplyJobs(jobList, transferNs, applySource, applyPrune, importDryRun, "cli")
+	if plan != nil {
+		if output, err = json.MarshalIndent(plan, "", "  "); err != nil {
+			return
+		}
+		fmt.Println(string(output))
+	}
+	err = applyErr
+	return
+}
+
+// 等待退出信号
+func waitSignal() (sig os.Signal) {
+	var (
+		sigChan chan os.Signal
+	)
+	sigChan = make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig = <-sigChan
+	signal.Stop(sigChan)
+	return
+}
+
 func main() {
 	var (
 		err error
+		sig os.Signal
 	)
 
 	// 初始化命令行参数
@@ -40,6 +162,30 @@ func main() {
 		goto ERR
 	}
 
+	// 共享的etcd连接
+	if err = master.InitEtcdClient(); err != nil {
+		goto ERR
+	}
+
+	// 导入导出和声明式同步只需要任务管理器
+	if exportFile != "" || importFile != "" || applyDir != "" {
+		if err = master.InitJobMgr(); err != nil {
+			goto ERR
+		}
+		if exportFile != "" {
+			err = runExport()
+		} else if importFile != "" {
+			err = runImport()
+		} else {
+			err = runApply()
+		}
+		if err != nil {
+			goto ERR
+		}
+		master.Shutdown()
+		return
+	}
+
 	// 初始化服务发现模块
 	if err = master.InitWorkerMgr(); err != nil {
 		goto ERR
@@ -55,19 +201,34 @@ func main() {
 		goto ERR
 	}
 
+	// 回收站过期清理
+	master.G_jobMgr.StartTrashPurge(master.G_config.TrashRetentionDays)
+
+	// 任务日志定期清理
+	master.G_logMgr.StartLogPurge(master.G_config.JobLogRetentionDays, master.G_config.JobLogMaxPerJob, master.G_config.JobLogPurgeInterval)
+
+	// 调度分派器(master调度方式)
+	if err = master.InitDispatcher(); err != nil {
+		goto ERR
+	}
+
 	// 启动Api HTTP服务
 	if err = master.InitApiServer(); err != nil {
 		goto ERR
 	}
 
-	// 正常退出
-	// 测试使用，保证主进程不退出
 	fmt.Printf("[%v] Crontab Server started ...\n", time.Now().Format("2006-01-02 15:04:05"))
 	fmt.Printf("Please Visit http://127.0.0.1:%d/\n", master.G_config.ApiPort)
-	for {
-		time.Sleep(1 * time.Second)
-	}
+
+	// 阻塞直到收到退出信号，然后按顺序关闭各模块
+	sig = waitSignal()
+	fmt.Printf("[%v] 收到信号 %v, 开始退出 ...\n", time.Now().Format("2006-01-02 15:04:05"), sig)
+	master.Shutdown()
+	fmt.Printf("[%v] Crontab Server stopped\n", time.Now().Format("2006-01-02 15:04:05"))
 	return
 ERR:
+	// 初始化失败，释放已经创建的资源并以非0状态码退出
 	fmt.Println(err)
+	master.Shutdown()
+	os.Exit(1)
 }
@@ -2,19 +2,37 @@ package worker
 
 import (
 	"encoding/json"
+	"github.com/staryjie/crontab/common"
 	"io/ioutil"
 )
 
 // 程序配置
 type Config struct {
-	EtcdEndpoints   []string `json:"etcdEndpoints"`
-	EtcdDialTimeout int      `json:"etcdDialTimeout"`
-	MongodbUri string `json:"mongodbUri"`
-	MongodbCollectTimeout int `json:"mongodbCollectTimeout"`
-	JobLogStoreDb string `json:"jobLogStoreDb"`
-	JobLogStoreCollection string `json:"jobLogStoreCollection"`
-	JobLogBatchSize int `json:"jobLogBatchSize"`
-	JobLogCommitTimeout int `json:"jobLogCommitTimeout"`
+	EtcdEndpoints         []string          `json:"etcdEndpoints"`
+	EtcdDialTimeout       int               `json:"etcdDialTimeout"`
+	MongodbUri            string            `json:"mongodbUri"`
+	MongodbCollectTimeout int               `json:"mongodbCollectTimeout"`
+	JobLogStoreDb         string            `json:"jobLogStoreDb"`
+	JobLogStoreCollection string            `json:"jobLogStoreCollection"`
+	JobLogStore           string            `json:"jobLogStore"`
+	JobLogFileDir         string            `json:"jobLogFileDir"`
+	JobLogFileMaxSize     int               `json:"jobLogFileMaxSize"`
+	JobLogFileMaxBackups  int               `json:"jobLogFileMaxBackups"`
+	JobLogBoltPath        string            `json:"jobLogBoltPath"`
+	JobLogBatchSize       int               `json:"jobLogBatchSize"`
+	JobLogCommitTimeout   int               `json:"jobLogCommitTimeout"`
+	JobLogSpoolDir        string            `json:"jobLogSpoolDir"`
+	JobLogSpoolMaxSize    int               `json:"jobLogSpoolMaxSize"`
+	JobLockTtl            int               `json:"jobLockTtl"`
+	JobLockLostPolicy     string            `json:"jobLockLostPolicy"`
+	Labels                map[string]string `json:"labels"`
+	DispatchMode          string            `json:"dispatchMode"`
+	Capacity              int               `json:"capacity"`
+	WorkerId              string            `json:"workerId"`
+	AdvertiseAddr         string            `json:"advertiseAddr"`
+	JobCacheFile          string            `json:"jobCacheFile"`
+	JobLockFallback       string            `json:"jobLockFallback"`
+	Namespaces            []string          `json:"namespaces"`
 }
 
 var (
@@ -37,8 +55,40 @@ func InitConfig(configFile string) (err error) {
 		return
 	}
 
-	// 3.赋值单例
+	// 3.默认值
+	if conf.JobLockTtl <= 0 {
+		conf.JobLockTtl = common.JOB_LOCK_TTL
+	}
+	if conf.JobLockLostPolicy == "" {
+		conf.JobLockLostPolicy = common.JOB_LOCK_LOST_POLICY_KILL
+	}
+	if conf.DispatchMode == "" {
+		conf.DispatchMode = common.DISPATCH_MODE_WORKER
+	}
+	if conf.JobLockFallback == "" {
+		conf.JobLockFallback = common.JOB_LOCK_FALLBACK_SKIP
+	}
+	if conf.JobLogStore == "" {
+		conf.JobLogStore = common.LOG_STORE_MONGODB
+	}
+
+	// 4.赋值单例
 	G_config = &conf
 
 	return
 }
+
+// 日志存储配置, 需要与master一致
+func (conf *Config) logStoreConfig() *common.LogStoreConfig {
+	return &common.LogStoreConfig{
+		Type:                  conf.JobLogStore,
+		MongodbUri:            conf.MongodbUri,
+		MongodbConnectTimeout: conf.MongodbCollectTimeout,
+		MongodbDb:             conf.JobLogStoreDb,
+		MongodbCollection:     conf.JobLogStoreCollection,
+		FileDir:               conf.JobLogFileDir,
+		FileMaxSize:           conf.JobLogFileMaxSize,
+		FileMaxBackups:        conf.JobLogFileMaxBackups,
+		BoltPath:              conf.JobLogBoltPath,
+	}
+}
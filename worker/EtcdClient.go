@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"time"
+)
+
+var (
+	// worker各模块共享的etcd连接
+	G_etcdClient *clientv3.Client
+)
+
+// 初始化etcd连接
+func InitEtcdClient() (err error) {
+	var (
+		config clientv3.Config
+		client *clientv3.Client
+	)
+
+	// 初始化配置
+	config = clientv3.Config{
+		Endpoints:   G_config.EtcdEndpoints,                                     // Etcd集群
+		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 连接超时时间
+	}
+
+	// 启用了任务快照时不等待连接建立，etcd不可用也能按快照启动调度
+	if G_config.JobCacheFile != "" {
+		config.DialTimeout = 0
+	}
+
+	// 建立连接
+	if client, err = clientv3.New(config); err != nil {
+		return
+	}
+
+	// 赋值单例
+	G_etcdClient = client
+	return
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/staryjie/crontab/common"
 	"math/rand"
+	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
 	"time"
 )
 
@@ -21,11 +24,7 @@ func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) {
 	// 通过协程并发执行任务
 	go func() {
 		var (
-			cmd     *exec.Cmd
-			err     error
-			output  []byte
-			result  *common.JobExecuteResult
-			jobLock *JobLock
+			result *common.JobExecuteResult
 		)
 
 		// 任务执行结果
@@ -34,43 +33,222 @@ func (executor *Executor) ExecuteJob(info *common.JobExecuteInfo) {
 			OutPut:      make([]byte, 0),
 		}
 
-		// TODO: 获取分布式锁，获取到锁才可以执行任务
-		// 初始化锁
-		jobLock = G_jobMgr.CreateJobLock(info.Job.Name)
-
-		// 抢锁
-		// 任务开始时间
-		result.StartTime = time.Now()
-		// 先随机睡眠0-1秒，保证每个客户端都能够抢到锁
-		time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
-		err = jobLock.TryLock()
-		defer jobLock.Unlock() // 释放锁
-
-		if err != nil { // 上锁失败
-			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "抢锁失败", info.Job.Name)
-			result.Err = err
-			result.EndTime = time.Now()
-		} else { // 抢锁成功，开始执行任务
-			// 重置任务启动时间
-			result.StartTime = time.Now()
-
-			// 执行shell命令
-			cmd = exec.CommandContext(info.CancelCtx, "/bin/bash", "-c", info.Job.Command)
-
-			// 捕获输出或者异常
-			output, err = cmd.CombinedOutput()
-
-			// 任务结束时间
-			result.EndTime = time.Now()
-
-			result.OutPut = output
-			result.Err = err
+		switch {
+		case info.Dispatch != nil: // master分派的任务已经确定由本节点执行，不需要抢锁
+			executor.runDispatch(info, result)
+		case info.Job.ExecMode == common.JOB_EXEC_MODE_BROADCAST: // 广播任务每个worker都执行，不需要抢锁
+			executor.runCommand(info, result, nil)
+		case info.Job.ExecMode == common.JOB_EXEC_MODE_SHARD: // 分片任务抢到其中一个分片锁才执行该分片
+			executor.runShard(info, result)
+		default: // 抢到分布式锁才可以执行任务
+			executor.runWithLock(info, result)
 		}
+
 		// 任务执行完成，把执行结果返回给Scheduler,Scheduler将该任务从jobExecutingTable中删除
 		G_scheduler.PushJobResult(result)
 	}()
 }
 
+// 抢锁执行任务
+func (executor *Executor) runWithLock(info *common.JobExecuteInfo, result *common.JobExecuteResult) {
+	var (
+		err     error
+		jobLock *JobLock
+	)
+
+	// etcd不可用时无法抢锁，按配置的策略处理
+	if !G_jobMgr.IsOnline() {
+		if G_config.JobLockFallback == common.JOB_LOCK_FALLBACK_RUN {
+			executor.runCommand(info, result, nil)
+		} else {
+			executor.skipOffline(info, result)
+		}
+		return
+	}
+
+	// 初始化锁
+	jobLock = G_jobMgr.CreateJobLock(info.Job.Namespace, info.Job.Name)
+	executor.handleLockLost(info, jobLock)
+
+	// 抢锁
+	// 任务开始时间
+	result.StartTime = time.Now()
+	// 先按负载睡眠，让空闲的worker优先抢到锁
+	time.Sleep(lockDelay())
+	err = jobLock.TryLock()
+	defer jobLock.Unlock() // 释放锁
+
+	if err != nil { // 上锁失败
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "抢锁失败", info.Job.Name)
+		result.Err = err
+		result.EndTime = time.Now()
+		return
+	}
+
+	// 抢锁成功，开始执行任务
+	executor.runLocked(info, result, jobLock, nil)
+}
+
+// 分片执行任务: 按随机顺序抢分片锁，抢到一个分片就执行该分片
+// 执行完一个分片后继续抢剩余的分片，在线worker少于分片数时由先执行完的worker接着执行
+func (executor *Executor) runShard(info *common.JobExecuteInfo, result *common.JobExecuteResult) {
+	var (
+		err         error
+		jobLock     *JobLock
+		shardIndex  int
+		shardInfo   *common.JobExecuteInfo
+		shardResult *common.JobExecuteResult
+		lastResult  *common.JobExecuteResult
+	)
+
+	// etcd不可用时无法协调分片，跳过本次执行
+	if !G_jobMgr.IsOnline() {
+		executor.skipOffline(info, result)
+		return
+	}
+
+	result.StartTime = time.Now()
+	// 先按负载睡眠，让空闲的worker优先抢到分片
+	time.Sleep(lockDelay())
+
+	err = common.ERR_LOCK_ALREADY_REQUIRED
+	for _, shardIndex = range rand.Perm(info.Job.ShardTotal) {
+		// 任务被强杀或者丢锁被杀死时不再继续抢分片
+		if info.CancelCtx.Err() != nil {
+			break
+		}
+		jobLock = G_jobMgr.CreateShardLock(info.Job, info.PlanTime, shardIndex)
+		executor.handleLockLost(info, jobLock)
+		if err = jobLock.TryLock(); err != nil {
+			continue
+		}
+
+		// 上一个分片的结果先提交日志，任务还在执行中
+		if lastResult != nil {
+			lastResult.Partial = true
+			G_scheduler.PushJobResult(lastResult)
+		}
+
+		// 抢到分片，执行该分片, 每个分片的执行信息和结果单独记录
+		shardInfo = &common.JobExecuteInfo{}
+		*shardInfo = *info
+		shardInfo.ShardIndex = shardIndex
+		shardResult = &common.JobExecuteResult{ExecuteInfo: shardInfo, OutPut: make([]byte, 0)}
+		executor.runLocked(shardInfo, shardResult, jobLock, []string{
+			common.JOB_SHARD_INDEX_ENV + "=" + strconv.Itoa(shardIndex),
+			common.JOB_SHARD_TOTAL_ENV + "=" + strconv.Itoa(info.Job.ShardTotal),
+		})
+		jobLock.Unlock()
+		lastResult = shardResult
+	}
+
+	// 最后一个分片的结果随任务结束提交
+	if lastResult != nil {
+		*result = *lastResult
+		return
+	}
+
+	// 所有分片都已经被其他worker抢到
+	fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "抢分片失败", info.Job.Name)
+	result.Err = err
+	result.EndTime = time.Now()
+}
+
+// etcd不可用，跳过需要抢锁的任务
+func (executor *Executor) skipOffline(info *common.JobExecuteInfo, result *common.JobExecuteResult) {
+	fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "etcd不可用，跳过执行", info.Job.Name)
+	result.StartTime = time.Now()
+	result.Err = common.ERR_ETCD_UNAVAILABLE
+	result.EndTime = time.Now()
+}
+
+// 抢锁前的等待时间: 0-500毫秒的随机值保证每个worker都有机会抢到锁,
+// 再按本节点负载(执行中的任务数、每核平均负载、可用内存)增加最多500毫秒，负载越高越晚抢锁
+func lockDelay() time.Duration {
+	var (
+		loadDelay time.Duration
+		memFree   uint64
+	)
+	loadDelay = time.Duration(G_scheduler.ExecutingCount())*50*time.Millisecond +
+		time.Duration(readLoadAvg()/float64(runtime.NumCPU())*200)*time.Millisecond
+	// 可用内存越少越晚抢锁, 内存接近耗尽时最多增加200毫秒
+	if memFree = readMemAvailable(); memFree > 0 {
+		loadDelay += time.Duration(200/(1+float64(memFree)/common.WORKER_MEM_SCORE_UNIT)) * time.Millisecond
+	}
+	if loadDelay > 500*time.Millisecond {
+		loadDelay = 500 * time.Millisecond
+	}
+	return time.Duration(rand.Intn(500))*time.Millisecond + loadDelay
+}
+
+// 执行master分派的任务, 分派记录的revision作为栅栏令牌
+func (executor *Executor) runDispatch(info *common.JobExecuteInfo, result *common.JobExecuteResult) {
+	var (
+		env []string
+	)
+
+	result.FencingToken = info.Dispatch.Revision
+	env = []string{
+		common.JOB_FENCING_TOKEN_ENV + "=" + strconv.FormatInt(result.FencingToken, 10),
+	}
+	if info.Job.ExecMode == common.JOB_EXEC_MODE_SHARD {
+		env = append(env,
+			common.JOB_SHARD_INDEX_ENV+"="+strconv.Itoa(info.ShardIndex),
+			common.JOB_SHARD_TOTAL_ENV+"="+strconv.Itoa(info.Job.ShardTotal),
+		)
+	}
+	executor.runCommand(info, result, env)
+}
+
+// 执行期间锁丢失，其他worker可能已经开始执行该任务，按照策略处理
+func (executor *Executor) handleLockLost(info *common.JobExecuteInfo, jobLock *JobLock) {
+	jobLock.OnLost(func() {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "lock lost", info.Job.Name)
+		if G_config.JobLockLostPolicy == common.JOB_LOCK_LOST_POLICY_KILL {
+			info.CancelFunc()
+		}
+	})
+}
+
+// 持有锁执行任务
+func (executor *Executor) runLocked(info *common.JobExecuteInfo, result *common.JobExecuteResult, jobLock *JobLock, env []string) {
+	result.FencingToken = jobLock.FencingToken()
+
+	// 把栅栏令牌传给任务，任务写外部系统时可以据此拒绝过期的执行者
+	env = append(env, common.JOB_FENCING_TOKEN_ENV+"="+strconv.FormatInt(result.FencingToken, 10))
+	executor.runCommand(info, result, env)
+
+	// 丢锁的执行记录为lock lost
+	if jobLock.IsLost() {
+		result.Err = common.ERR_LOCK_LOST
+	}
+}
+
+// 执行shell命令，env为额外传给任务的环境变量
+func (executor *Executor) runCommand(info *common.JobExecuteInfo, result *common.JobExecuteResult, env []string) {
+	var (
+		cmd    *exec.Cmd
+		output []byte
+		err    error
+	)
+
+	// 任务启动时间
+	result.StartTime = time.Now()
+
+	// 执行shell命令
+	cmd = exec.CommandContext(info.CancelCtx, "/bin/bash", "-c", info.Job.Command)
+	cmd.Env = append(os.Environ(), env...)
+
+	// 捕获输出或者异常
+	output, err = cmd.CombinedOutput()
+
+	// 任务结束时间
+	result.EndTime = time.Now()
+
+	result.OutPut = output
+	result.Err = err
+}
+
 // 初始化执行器
 func InitExcutor() (err error) {
 	G_executor = &Executor{}
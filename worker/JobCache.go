@@ -0,0 +1,183 @@
+package worker
+
+import (
+	"encoding/json"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// 任务快照: 最近一次从etcd同步到的任务列表
+type JobSnapshot struct {
+	Revision int64                  `json:"revision"` // 同步时etcd的revision
+	Jobs     map[string]*common.Job `json:"jobs"`     // 命名空间/任务名 -> 任务
+}
+
+// 本地任务缓存，etcd不可用时按缓存继续调度
+type JobCache struct {
+	filePath string // 快照文件路径，为空时只保存在内存
+	lock     sync.Mutex
+	snapshot *JobSnapshot
+	dirty    bool // 内存中有还没写入快照文件的修改
+}
+
+var (
+	G_jobCache *JobCache
+)
+
+// 从快照文件加载任务
+func (jobCache *JobCache) load() (err error) {
+	var (
+		content  []byte
+		snapshot JobSnapshot
+		jobTable map[string]*common.Job
+		job      *common.Job
+	)
+	if jobCache.filePath == "" {
+		return
+	}
+	if content, err = ioutil.ReadFile(jobCache.filePath); err != nil {
+		// 首次启动还没有快照
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(content, &snapshot); err != nil {
+		return
+	}
+	// 旧版本快照中的任务没有命名空间，按默认命名空间重建
+	jobTable = make(map[string]*common.Job)
+	for _, job = range snapshot.Jobs {
+		job.Namespace = common.NormalizeNamespace(job.Namespace)
+		jobTable[common.JobFullName(job.Namespace, job.Name)] = job
+	}
+	snapshot.Jobs = jobTable
+	jobCache.snapshot = &snapshot
+	return
+}
+
+// 写入快照文件: 先写临时文件并落盘再改名，避免写到一半时进程退出或者机器掉电留下损坏的快照
+func (jobCache *JobCache) save() (err error) {
+	var (
+		content  []byte
+		tmpPath  string
+		tmpFile  *os.File
+		closeErr error
+	)
+	if jobCache.filePath == "" {
+		jobCache.dirty = false
+		return
+	}
+	if content, err = json.Marshal(jobCache.snapshot); err != nil {
+		return
+	}
+	tmpPath = jobCache.filePath + ".tmp"
+	if tmpFile, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	if _, err = tmpFile.Write(content); err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr = tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, jobCache.filePath); err != nil {
+		return
+	}
+	jobCache.dirty = false
+	return
+}
+
+// 把还没写入的修改写入快照文件
+// 监听到的任务变化只修改内存，由监听协程定时调用，批量保存时不会每个事件都重写一遍快照
+func (jobCache *JobCache) Flush() (err error) {
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+
+	if !jobCache.dirty {
+		return
+	}
+	err = jobCache.save()
+	return
+}
+
+// 缓存中的所有任务
+func (jobCache *JobCache) Jobs() (jobs []*common.Job) {
+	var (
+		job *common.Job
+	)
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+
+	jobs = make([]*common.Job, 0, len(jobCache.snapshot.Jobs))
+	for _, job = range jobCache.snapshot.Jobs {
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+// 缓存对应的etcd revision
+func (jobCache *JobCache) Revision() int64 {
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+	return jobCache.snapshot.Revision
+}
+
+// 用全量同步的结果替换缓存，返回已经不存在的任务
+func (jobCache *JobCache) Replace(jobs []*common.Job, revision int64) (deleted []*common.Job, err error) {
+	var (
+		jobTable    map[string]*common.Job
+		job         *common.Job
+		jobFullName string
+	)
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+
+	jobTable = make(map[string]*common.Job)
+	for _, job = range jobs {
+		jobTable[common.JobFullName(job.Namespace, job.Name)] = job
+	}
+	for jobFullName, job = range jobCache.snapshot.Jobs {
+		if _, ok := jobTable[jobFullName]; !ok {
+			deleted = append(deleted, job)
+		}
+	}
+	jobCache.snapshot = &JobSnapshot{Revision: revision, Jobs: jobTable}
+	err = jobCache.save()
+	return
+}
+
+// 任务保存, 快照文件由Flush写入
+func (jobCache *JobCache) Put(job *common.Job, revision int64) {
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+
+	jobCache.snapshot.Jobs[common.JobFullName(job.Namespace, job.Name)] = job
+	jobCache.snapshot.Revision = revision
+	jobCache.dirty = true
+}
+
+// 任务删除, 快照文件由Flush写入
+func (jobCache *JobCache) Delete(namespace string, jobName string, revision int64) {
+	jobCache.lock.Lock()
+	defer jobCache.lock.Unlock()
+
+	delete(jobCache.snapshot.Jobs, common.JobFullName(namespace, jobName))
+	jobCache.snapshot.Revision = revision
+	jobCache.dirty = true
+}
+
+// 初始化任务缓存
+func InitJobCache() (err error) {
+	G_jobCache = &JobCache{
+		filePath: G_config.JobCacheFile,
+		snapshot: &JobSnapshot{Jobs: make(map[string]*common.Job)},
+	}
+	err = G_jobCache.load()
+	return
+}
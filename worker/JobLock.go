@@ -1,28 +1,34 @@
 package worker
 
 import (
-	"context"
-	"github.com/coreos/etcd/clientv3"
 	"github.com/staryjie/crontab/common"
+	"sync"
+	"sync/atomic"
 )
 
-// 分布式锁 TXN事物
+// 分布式锁, 由任务存储实现抢锁和续期
 type JobLock struct {
-	kv    clientv3.KV    // etcd kv API子集
-	lease clientv3.Lease // etcd lease API子集
+	store common.JobStore // 任务存储
 
-	jobName    string             // 任务名
-	cancelFunc context.CancelFunc // 终止租约自动续期的取消函数
-	leaseId    clientv3.LeaseID   // 租约ID
-	isLocked   bool               // 是否上锁成功
+	lockKey    string // 锁路径
+	ttl        int64  // 租约过期时间,单位秒
+	retainTtl  int64  // 释放锁后锁再保留的时间,单位秒, 0表示立即删除
+	unlockFunc func() // 释放锁的函数
+	isLocked   bool   // 是否上锁成功
+
+	fencingToken int64 // 栅栏令牌: 抢锁成功时存储的revision, 单调递增
+
+	isLost     int32     // 租约续期失败，锁已丢失(原子操作)
+	lostOnce   sync.Once // 丢锁回调只触发一次
+	onLostFunc func()    // 丢锁回调
 }
 
 // 初始化一把锁
-func InitJobLock(jobName string, kv clientv3.KV, lease clientv3.Lease) (jobLock *JobLock) {
+func InitJobLock(lockKey string, ttl int64, store common.JobStore) (jobLock *JobLock) {
 	jobLock = &JobLock{
-		jobName: jobName,
-		kv:      kv,
-		lease:   lease,
+		lockKey: lockKey,
+		ttl:     ttl,
+		store:   store,
 	}
 
 	return
@@ -31,84 +37,48 @@ func InitJobLock(jobName string, kv clientv3.KV, lease clientv3.Lease) (jobLock
 // 尝试上锁
 func (jobLock *JobLock) TryLock() (err error) {
 	var (
-		leaseGrantResp *clientv3.LeaseGrantResponse
-		cancelCtx      context.Context
-		cancelFunc     context.CancelFunc
-		leaseId        clientv3.LeaseID
-		keepRespChan   <-chan *clientv3.LeaseKeepAliveResponse
-		txn            clientv3.Txn
-		lockKey        string
-		txnResp        *clientv3.TxnResponse
+		fencingToken int64
+		unlockFunc   func()
 	)
-	// 1.创建租约(5秒)
-	if leaseGrantResp, err = jobLock.lease.Grant(context.TODO(), 5); err != nil {
+	// 抢锁失败返回ERR_LOCK_ALREADY_REQUIRED, 持有期间租约丢失时标记丢锁
+	if fencingToken, unlockFunc, err = jobLock.store.TryLock(jobLock.lockKey, jobLock.ttl, jobLock.retainTtl, jobLock.lost); err != nil {
 		return
 	}
+	// 抢锁成功, 记录栅栏令牌
+	jobLock.fencingToken = fencingToken
+	jobLock.unlockFunc = unlockFunc
+	jobLock.isLocked = true
+	return
+}
 
-	// 用于取消自动续期的 cancelCtx, cancelFunc
-	cancelCtx, cancelFunc = context.WithCancel(context.TODO())
-
-	// 获取租约ID
-	leaseId = leaseGrantResp.ID
+// 设置丢锁回调, 需要在TryLock之前调用
+func (jobLock *JobLock) OnLost(onLostFunc func()) {
+	jobLock.onLostFunc = onLostFunc
+}
 
-	// 2.未执行完成，自动续租
-	if keepRespChan, err = jobLock.lease.KeepAlive(cancelCtx, leaseId); err != nil {
-		goto FAIL
-	}
+// 锁是否已经丢失
+func (jobLock *JobLock) IsLost() bool {
+	return atomic.LoadInt32(&jobLock.isLost) == 1
+}
 
-	// 3.处理续租自动应答
-	go func() {
-		var (
-			keepResp *clientv3.LeaseKeepAliveResponse
-		)
-		for {
-			select {
-			case keepResp = <-keepRespChan:
-				if keepResp == nil {
-					goto END
-				}
-			}
+// 标记丢锁并触发回调
+func (jobLock *JobLock) lost() {
+	jobLock.lostOnce.Do(func() {
+		atomic.StoreInt32(&jobLock.isLost, 1)
+		if jobLock.onLostFunc != nil {
+			jobLock.onLostFunc()
 		}
-	END:
-	}()
-
-	// 4.创建txn事务
-	txn = jobLock.kv.Txn(context.TODO())
-
-	// 锁路径
-	lockKey = common.JOB_LOCK_DIR
-
-	// 5.抢锁
-	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
-		Then(clientv3.OpPut(lockKey, "locked", clientv3.WithLease(leaseId))).
-		Else(clientv3.OpGet(lockKey))
-
-	// 提交事务
-	if txnResp, err = txn.Commit(); err != nil {
-		goto FAIL
-	}
-
-	// 6.抢锁成功返回,失败释放租约
-	if !txnResp.Succeeded { // 抢锁失败
-		err = common.ERR_LOCK_ALREADY_REQUIRED
-		goto FAIL
-	}
-	// 抢锁成功
-	jobLock.leaseId = leaseId
-	jobLock.cancelFunc = cancelFunc
-	jobLock.isLocked = true
+	})
+}
 
-	return
-FAIL:
-	cancelFunc()                                  // 取消自动续期
-	jobLock.lease.Revoke(context.TODO(), leaseId) // 释放租约
-	return
+// 获取栅栏令牌, 未上锁时为0
+func (jobLock *JobLock) FencingToken() int64 {
+	return jobLock.fencingToken
 }
 
 // 释放锁
 func (jobLock *JobLock) Unlock() {
 	if jobLock.isLocked {
-		jobLock.cancelFunc()
-		jobLock.lease.Revoke(context.TODO(), jobLock.leaseId) // 释放租约
+		jobLock.unlockFunc()
 	}
 }
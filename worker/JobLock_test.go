@@ -0,0 +1,143 @@
+package worker
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 找一个空闲的本地端口
+func freeLocalUrl(t *testing.T) url.URL {
+	var (
+		listener net.Listener
+		err      error
+	)
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// 启动一个单节点的内嵌etcd, 返回连接它的客户端和清理函数
+func startEmbedEtcd(t *testing.T) (client *clientv3.Client, cleanup func()) {
+	var (
+		dir       string
+		cfg       *embed.Config
+		etcd      *embed.Etcd
+		clientUrl url.URL
+		peerUrl   url.URL
+		err       error
+	)
+	if dir, err = ioutil.TempDir("", "crontab-etcd"); err != nil {
+		t.Fatal(err)
+	}
+	clientUrl, peerUrl = freeLocalUrl(t), freeLocalUrl(t)
+
+	cfg = embed.NewConfig()
+	cfg.Name = "crontab-test"
+	cfg.Dir = dir
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientUrl}, []url.URL{clientUrl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerUrl}, []url.URL{peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	if etcd, err = embed.StartEtcd(cfg); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case err = <-etcd.Err():
+		etcd.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		etcd.Close()
+		os.RemoveAll(dir)
+		t.Fatal("内嵌etcd启动超时")
+	}
+
+	if client, err = clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientUrl.String()},
+		DialTimeout: 5 * time.Second,
+	}); err != nil {
+		etcd.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		client.Close()
+		etcd.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// 两个不同的任务同时持有各自的锁, 栅栏令牌不同且递增
+func TestJobLockPerJob(t *testing.T) {
+	var (
+		client  *clientv3.Client
+		cleanup func()
+		store   common.JobStore
+		locks   []*JobLock
+		errs    []error
+		wg      sync.WaitGroup
+		index   int
+		tokens  []int64
+		other   *JobLock
+		err     error
+	)
+	client, cleanup = startEmbedEtcd(t)
+	defer cleanup()
+	store = common.InitEtcdJobStore(client, 5*time.Second)
+
+	// 两个任务并发抢锁, 都应该成功
+	locks = []*JobLock{
+		InitJobLock(common.BuildJobLockKey(common.JOB_NAMESPACE_DEFAULT, "job1"), 5, store),
+		InitJobLock(common.BuildJobLockKey(common.JOB_NAMESPACE_DEFAULT, "job2"), 5, store),
+	}
+	errs = make([]error, len(locks))
+	for index = range locks {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			errs[index] = locks[index].TryLock()
+		}(index)
+	}
+	wg.Wait()
+	for index = range locks {
+		if errs[index] != nil {
+			t.Fatalf("任务%d抢锁失败: %v", index+1, errs[index])
+		}
+	}
+	defer locks[1].Unlock()
+
+	// 栅栏令牌不同
+	tokens = []int64{locks[0].FencingToken(), locks[1].FencingToken()}
+	if tokens[0] <= 0 || tokens[1] <= 0 || tokens[0] == tokens[1] {
+		t.Fatalf("栅栏令牌不合法: %v", tokens)
+	}
+
+	// 同一个任务的锁被占用时抢锁失败
+	other = InitJobLock(common.BuildJobLockKey(common.JOB_NAMESPACE_DEFAULT, "job1"), 5, store)
+	if err = other.TryLock(); err != common.ERR_LOCK_ALREADY_REQUIRED {
+		t.Fatalf("锁被占用时应该抢锁失败, 实际: %v", err)
+	}
+
+	// 释放后重新抢锁, 令牌比之前的都大
+	locks[0].Unlock()
+	if err = other.TryLock(); err != nil {
+		t.Fatalf("释放后重新抢锁失败: %v", err)
+	}
+	defer other.Unlock()
+	if other.FencingToken() <= tokens[0] || other.FencingToken() <= tokens[1] {
+		t.Fatalf("栅栏令牌没有递增: %d, 之前为%v", other.FencingToken(), tokens)
+	}
+}
@@ -2,18 +2,22 @@ package worker
 
 import (
 	"context"
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"fmt"
 	"github.com/staryjie/crontab/common"
+	"sync/atomic"
 	"time"
 )
 
 // 任务管理器
 type JobMgr struct {
-	client  *clientv3.Client
-	kv      clientv3.KV
-	lease   clientv3.Lease
-	watcher clientv3.Watcher
+	store common.JobStore // 任务存储: 任务、强杀通知、任务锁、运维状态和分派队列
+
+	etcdOnline int32 // etcd是否可用(原子操作)
+
+	// 各个监听中断后重新读取成功的次数(原子操作)
+	jobResyncs         int64
+	workerStateResyncs int64
+	dispatchResyncs    int64
 }
 
 var (
@@ -21,152 +25,412 @@ var (
 )
 
 // 监听任务变化
-func (jobMgr *JobMgr) watchJobs() (err error) {
+func (jobMgr *JobMgr) watchJobs() {
 	var (
-		getResp            *clientv3.GetResponse
-		kvpair             *mvccpb.KeyValue
-		job                *common.Job
-		watchStartRevision int64
-		watchChan          clientv3.WatchChan
-		watchResp          clientv3.WatchResponse
-		watchEvent         *clientv3.Event
-		jobName            string
-		jobEvent           *common.JobEvent
+		job *common.Job
 	)
-	// 1. get /cron/jobs/ 下所有任务,并且获取当前集群Revision
-	if getResp, err = jobMgr.kv.Get(context.TODO(), common.JOB_SAVE_DIR, clientv3.WithPrefix()); err != nil {
-		return
+
+	// 1.先按本地快照调度，存储不可用时也能继续执行任务
+	for _, job = range G_jobCache.Jobs() {
+		G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOB_EVENT_SAVE, job))
 	}
 
-	// 遍历任务
-	for _, kvpair = range getResp.Kvs {
-		// 反序列json 得到job
-		if job, err = common.UnpackJob(kvpair.Value); err == nil { // 反解成功
-			jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
-			// 把任务同步给调度协程，完成任务调度
-			//fmt.Println((*jobEvent).EventType, *(jobEvent).Job)
-			G_scheduler.PushJobEvent(jobEvent)
+	// 2.与存储同步并监听后续变化，连接中断后重新同步
+	go func() {
+		var (
+			synced bool
+			err    error
+		)
+		for {
+			if err = jobMgr.syncJobs(&synced); err != nil {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "任务同步中断:", err)
+			}
+			time.Sleep(1 * time.Second)
 		}
+	}()
+}
+
+// 全量同步任务，然后从同步时的revision开始监听，直到监听中断或存储不可用
+func (jobMgr *JobMgr) syncJobs(synced *bool) (err error) {
+	var (
+		ctx         context.Context
+		cancelFunc  context.CancelFunc
+		jobs        []*common.Job
+		revision    int64
+		job         *common.Job
+		deleted     []*common.Job
+		watchChan   <-chan *common.JobWatchResponse
+		watchResp   *common.JobWatchResponse
+		watchEvent  *common.JobWatchEvent
+		probeTicker *time.Ticker
+		flushTicker *time.Ticker
+		isOpen      bool
+	)
+
+	// 1. 读取所有任务,并且获取当前revision
+	if jobs, revision, err = jobMgr.store.ListJobs("", ""); err != nil {
+		goto ERR
 	}
+	countResync(&jobMgr.jobResyncs, synced)
 
-	// 2.从该Revision开始监听事件变化
-	go func() {
-		// GET时刻的下一个版本
-		watchStartRevision = getResp.Header.Revision + 1
+	// 更新快照，快照里有而存储里已经没有的任务在断连期间被删除了
+	if deleted, err = G_jobCache.Replace(jobs, revision); err != nil {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "保存任务快照失败:", err)
+	}
+	for _, job = range deleted {
+		G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOV_EVENT_DELETE, job))
+	}
+	// 把任务同步给调度协程，完成任务调度
+	for _, job = range jobs {
+		G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOB_EVENT_SAVE, job))
+	}
+	jobMgr.setOnline(true)
+
+	// 2.从读取时刻的下一个版本开始监听任务的后续变化
+	ctx, cancelFunc = context.WithCancel(context.TODO())
+	defer cancelFunc()
+	watchChan = jobMgr.store.WatchJobs(ctx, revision+1)
+
+	// 连接断开时监听不会立即关闭，定时探测存储是否可用
+	probeTicker = time.NewTicker(common.ETCD_PROBE_INTERVAL * time.Second)
+	defer probeTicker.Stop()
 
-		// 启动监听 /cron/jobs/目录的后续变化
-		watchChan = jobMgr.watcher.Watch(context.TODO(), common.JOB_SAVE_DIR, clientv3.WithRev(watchStartRevision), clientv3.WithPrefix())
+	// 监听到的变化先改内存中的快照，定时写入快照文件，监听结束前把剩下的修改写入
+	flushTicker = time.NewTicker(common.JOB_CACHE_FLUSH_INTERVAL * time.Millisecond)
+	defer flushTicker.Stop()
+	defer flushJobCache()
 
-		// 处理监听事件
-		for watchResp = range watchChan {
+	// 处理监听事件
+	for {
+		select {
+		case watchResp, isOpen = <-watchChan:
+			if !isOpen {
+				err = common.ERR_ETCD_UNAVAILABLE
+				goto ERR
+			}
+			// revision已被压缩或者监听被取消，之后不会再收到事件，重新全量同步
+			if err = watchResp.Err; err != nil {
+				return
+			}
 			for _, watchEvent = range watchResp.Events {
-				switch watchEvent.Type {
-				case mvccpb.PUT: // 任务保存事件
-					// 反解json
-					if job, err = common.UnpackJob(watchEvent.Kv.Value); err != nil {
-						continue // 忽略该次更新事件
-					}
-					// 构造一个更新事件
-					jobEvent = common.BuildJobEvent(common.JOB_EVENT_SAVE, job)
+				switch watchEvent.EventType {
+				case common.JOB_EVENT_SAVE: // 任务保存事件
+					G_jobCache.Put(watchEvent.Job, watchEvent.Revision)
 					// 推一个更新事件给调度协程
-					//fmt.Println((*jobEvent).EventType, *(jobEvent).Job)
-					G_scheduler.PushJobEvent(jobEvent)
-				case mvccpb.DELETE: // 任务删除事件
-					// delete /cron/jobs/job-name
-					jobName = common.ExtractJobName(string(watchEvent.Kv.Key))
-					job = &common.Job{Name: jobName} // 删除任务只需要jobName即可
-					// 构造一个删除事件
-					jobEvent = common.BuildJobEvent(common.JOV_EVENT_DELETE, job)
-					// 推送一个删除事件给调度协程
-					//fmt.Println((*jobEvent).EventType, *(jobEvent).Job)
-					G_scheduler.PushJobEvent(jobEvent)
+					G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOB_EVENT_SAVE, watchEvent.Job))
+				case common.JOV_EVENT_DELETE: // 任务删除事件
+					G_jobCache.Delete(watchEvent.Job.Namespace, watchEvent.Job.Name, watchEvent.Revision)
+					// 推送一个删除事件给调度协程, 删除任务只需要命名空间和任务名即可
+					G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOV_EVENT_DELETE, watchEvent.Job))
 				}
 			}
+		case <-flushTicker.C:
+			flushJobCache()
+		case <-probeTicker.C:
+			ctx, cancelFunc = jobMgr.requestCtx()
+			err = jobMgr.store.Ping(ctx)
+			cancelFunc()
+			if err != nil {
+				goto ERR
+			}
 		}
-	}()
+	}
 
+ERR:
+	jobMgr.setOnline(false)
 	return
 }
 
-// 监听强杀任务通知
-func (jobMgr *JobMgr) watchKiller() {
+// 把任务快照中还没写入的修改写入文件
+func flushJobCache() {
+	var (
+		err error
+	)
+	if err = G_jobCache.Flush(); err != nil {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "保存任务快照失败:", err)
+	}
+}
+
+// 重新读取成功后给对应监听的计数加一, 首次读取不算重新同步
+func countResync(counter *int64, synced *bool) {
+	if *synced {
+		atomic.AddInt64(counter, 1)
+	}
+	*synced = true
+}
+
+// 各个监听中断后重新同步的次数
+func (jobMgr *JobMgr) WatchResyncs() *common.WatchResyncStats {
+	return &common.WatchResyncStats{
+		Jobs:        atomic.LoadInt64(&jobMgr.jobResyncs),
+		WorkerState: atomic.LoadInt64(&jobMgr.workerStateResyncs),
+		Dispatch:    atomic.LoadInt64(&jobMgr.dispatchResyncs),
+	}
+}
+
+// 带超时的请求上下文，etcd不可用时请求不会一直阻塞
+func (jobMgr *JobMgr) requestCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.TODO(), time.Duration(G_config.EtcdDialTimeout)*time.Millisecond)
+}
+
+// 更新etcd可用状态
+func (jobMgr *JobMgr) setOnline(online bool) {
 	var (
-		watchChan  clientv3.WatchChan
-		watchResp  clientv3.WatchResponse
-		watchEvent *clientv3.Event
-		jobEvent   *common.JobEvent
-		jobName    string
-		job        *common.Job
+		value int32
 	)
-	// 监听/cron/killer/目录
+	if online {
+		value = 1
+	}
+	if atomic.SwapInt32(&jobMgr.etcdOnline, value) == value {
+		return
+	}
+	if online {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "etcd连接正常，任务已同步")
+	} else {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "etcd不可用，按本地任务快照调度")
+	}
+}
+
+// etcd是否可用, 不可用时无法抢锁
+func (jobMgr *JobMgr) IsOnline() bool {
+	return atomic.LoadInt32(&jobMgr.etcdOnline) == 1
+}
+
+// 监听强杀任务通知
+func (jobMgr *JobMgr) watchKiller() {
 	go func() {
-		// 监听/cron/killer/目录的变化
-		watchChan = jobMgr.watcher.Watch(context.TODO(), common.JOB_KILLER_DIR, clientv3.WithPrefix())
-		// 处理监听事件
-		for watchResp = range watchChan {
-			for _, watchEvent = range watchResp.Events {
-				switch watchEvent.Type {
-				case mvccpb.PUT: // 杀死任务
-					// 从Etcd的keey中提取任务名
-					jobName = common.ExtractKillerName(string(watchEvent.Kv.Key))
-					job = &common.Job{Name: jobName}
-					jobEvent = common.BuildJobEvent(common.JOB_EVENT_KILL, job)
+		var (
+			ctx        context.Context
+			cancelFunc context.CancelFunc
+			watchChan  <-chan *common.JobWatchResponse
+			watchResp  *common.JobWatchResponse
+			watchEvent *common.JobWatchEvent
+			watchRev   int64 // 下次监听的起始revision, 0表示从当前开始
+		)
+		for {
+			ctx, cancelFunc = context.WithCancel(context.TODO())
+			watchChan = jobMgr.store.WatchKills(ctx, watchRev)
+			// 处理监听事件
+			for watchResp = range watchChan {
+				if watchResp.Err != nil {
+					// 被压缩的revision之前的强杀通知已经无法获取，从压缩点继续
+					if watchResp.CompactRevision != 0 {
+						watchRev = watchResp.CompactRevision
+					}
+					break
+				}
+				for _, watchEvent = range watchResp.Events {
 					// 杀死任务的事件推送给调度器scheduler
-					G_scheduler.PushJobEvent(jobEvent)
-				case mvccpb.DELETE: // 标记过期，自动被删除
+					G_scheduler.PushJobEvent(common.BuildJobEvent(common.JOB_EVENT_KILL, watchEvent.Job))
 				}
+				// 中断后从下一个revision继续监听，不漏掉强杀通知
+				watchRev = watchResp.Revision + 1
 			}
+			cancelFunc()
+
+			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "强杀监听中断，重新监听")
+			time.Sleep(1 * time.Second)
 		}
 	}()
 }
 
-// 初始化管理器
-func InitJobMgr() (err error) {
+// 监听本节点的运维状态(封锁/排空) /cron/worker_state/{workerId}
+// etcd不可用时不断重试
+func (jobMgr *JobMgr) watchWorkerState() {
+	go func() {
+		var (
+			synced bool
+			err    error
+		)
+		for {
+			if err = jobMgr.syncWorkerState(&synced); err != nil {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "节点状态同步中断:", err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}()
+}
+
+// 读取当前运维状态并监听变化，直到监听中断
+func (jobMgr *JobMgr) syncWorkerState(synced *bool) (err error) {
 	var (
-		config  clientv3.Config
-		client  *clientv3.Client
-		kv      clientv3.KV
-		lease   clientv3.Lease
-		watcher clientv3.Watcher
+		stateKey    string
+		records     []*common.StoreRecord
+		record      *common.StoreRecord
+		revision    int64
+		ctx         context.Context
+		cancelFunc  context.CancelFunc
+		watchChan   <-chan *common.RecordWatchResponse
+		watchResp   *common.RecordWatchResponse
+		watchEvent  *common.RecordWatchEvent
+		workerState *common.WorkerState
 	)
 
-	// 初始化配置
-	config = clientv3.Config{
-		Endpoints:   G_config.EtcdEndpoints,                                     // Etcd集群
-		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond, // 连接超时时间
+	stateKey = common.JOB_WORKER_STATE_DIR + G_register.workerId
+
+	// 1.当前状态, 按前缀读取时会读到以本节点ID开头的其他节点, 只看自己的key
+	if records, revision, err = jobMgr.store.ListRecordsWithRevision(stateKey); err != nil {
+		return
+	}
+	countResync(&jobMgr.workerStateResyncs, synced)
+	workerState = &common.WorkerState{State: common.WORKER_STATE_ACTIVE}
+	for _, record = range records {
+		if record.Key != stateKey {
+			continue
+		}
+		if workerState, err = common.UnpackWorkerState(record.Value); err != nil {
+			return
+		}
+	}
+	G_scheduler.SetWorkerState(workerState.State)
+
+	// 2.监听状态变化
+	ctx, cancelFunc = context.WithCancel(context.TODO())
+	defer cancelFunc()
+	watchChan = jobMgr.store.WatchRecords(ctx, stateKey, revision+1)
+	for watchResp = range watchChan {
+		// 监听出错时重新读取当前状态
+		if err = watchResp.Err; err != nil {
+			return
+		}
+		for _, watchEvent = range watchResp.Events {
+			if watchEvent.Record.Key != stateKey {
+				continue
+			}
+			if watchEvent.Deleted { // 解除封锁
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "节点解除封锁")
+				G_scheduler.SetWorkerState(common.WORKER_STATE_ACTIVE)
+				continue
+			}
+			if workerState, err = common.UnpackWorkerState(watchEvent.Record.Value); err != nil {
+				continue
+			}
+			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "节点状态变更:", workerState.State)
+			G_scheduler.SetWorkerState(workerState.State)
+		}
 	}
+	err = common.ERR_ETCD_UNAVAILABLE
+	return
+}
+
+// 监听master分派给本节点的任务 /cron/dispatch/{workerId}/
+// 监听中断后重新读取队列并继续监听
+func (jobMgr *JobMgr) watchDispatch() {
+	go func() {
+		var (
+			synced bool
+			err    error
+		)
+		for {
+			if err = jobMgr.syncDispatch(&synced); err != nil {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "分派监听中断:", err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}()
+}
+
+// 取走队列中已有的分派并监听后续分派，直到监听中断
+func (jobMgr *JobMgr) syncDispatch(synced *bool) (err error) {
+	var (
+		dispatchDir string
+		records     []*common.StoreRecord
+		record      *common.StoreRecord
+		revision    int64
+		ctx         context.Context
+		cancelFunc  context.CancelFunc
+		watchChan   <-chan *common.RecordWatchResponse
+		watchResp   *common.RecordWatchResponse
+		watchEvent  *common.RecordWatchEvent
+	)
+
+	dispatchDir = common.JOB_DISPATCH_DIR + G_register.workerId + "/"
 
-	// 建立连接
-	if client, err = clientv3.New(config); err != nil {
+	// 1.处理队列中已经分派的任务
+	if records, revision, err = jobMgr.store.ListRecordsWithRevision(dispatchDir); err != nil {
 		return
 	}
+	countResync(&jobMgr.dispatchResyncs, synced)
+	for _, record = range records {
+		jobMgr.takeDispatch(record)
+	}
+
+	// 2.监听后续分派
+	ctx, cancelFunc = context.WithCancel(context.TODO())
+	defer cancelFunc()
+	watchChan = jobMgr.store.WatchRecords(ctx, dispatchDir, revision+1)
+	for watchResp = range watchChan {
+		if err = watchResp.Err; err != nil {
+			return
+		}
+		for _, watchEvent = range watchResp.Events {
+			if !watchEvent.Deleted {
+				jobMgr.takeDispatch(watchEvent.Record)
+			}
+		}
+	}
+	err = common.ERR_ETCD_UNAVAILABLE
+	return
+}
 
-	// 得到kv和lease API子集
-	kv = clientv3.NewKV(client)
-	lease = clientv3.NewLease(client)
-	watcher = clientv3.NewWatcher(client)
+// 取走一条分派记录并交给调度协程执行
+func (jobMgr *JobMgr) takeDispatch(record *common.StoreRecord) {
+	var (
+		dispatch *common.JobDispatch
+		deleted  int64
+		err      error
+	)
 
+	// 从队列中删除, 删除成功才执行，防止重复执行
+	if deleted, err = jobMgr.store.DeleteRecords(record.Key, false); err != nil || deleted == 0 {
+		return
+	}
+	if dispatch, err = common.UnpackJobDispatch(record.Value); err != nil {
+		return
+	}
+	dispatch.Revision = record.ModRevision
+	G_scheduler.PushJobDispatch(dispatch)
+}
+
+// 初始化管理器, 使用etcd任务存储
+func InitJobMgr() (err error) {
+	InitJobMgrWithStore(common.InitEtcdJobStore(G_etcdClient, time.Duration(G_config.EtcdDialTimeout)*time.Millisecond))
+	return
+}
+
+// 使用指定的任务存储初始化管理器并启动监听, 进程内测试时传入内存存储
+func InitJobMgrWithStore(store common.JobStore) {
 	// 赋值单例
 	G_jobMgr = &JobMgr{
-		client:  client,
-		kv:      kv,
-		lease:   lease,
-		watcher: watcher,
+		store: store,
 	}
 
-	// 启动任务监听
-	G_jobMgr.watchJobs()
+	// 启动监听运维状态
+	G_jobMgr.watchWorkerState()
+
+	// 启动任务监听: master调度方式下只执行分派给本节点的任务
+	if G_config.DispatchMode == common.DISPATCH_MODE_MASTER {
+		G_jobMgr.watchDispatch()
+	} else {
+		G_jobMgr.watchJobs()
+	}
 
 	// 启动监听killer
 	G_jobMgr.watchKiller()
-
-	return
 }
 
-// 创建任务执行锁
-func (jobMgr *JobMgr) CreateJobLock(jobName string) (jobLock *JobLock) {
+// 创建任务执行锁, 每个任务一把锁 /cron/lock/命名空间/任务名
+func (jobMgr *JobMgr) CreateJobLock(namespace string, jobName string) (jobLock *JobLock) {
 	// 返回锁
-	jobLock = InitJobLock(jobName, jobMgr.kv, jobMgr.lease)
+	jobLock = InitJobLock(common.BuildJobLockKey(namespace, jobName), int64(G_config.JobLockTtl), jobMgr.store)
+
+	return
+}
 
+// 创建分片锁
+// 执行完成后锁再保留到下一次调度之后，防止晚到的worker或者继续抢分片的worker重复执行同一分片
+func (jobMgr *JobMgr) CreateShardLock(job *common.Job, planTime time.Time, shardIndex int) (jobLock *JobLock) {
+	jobLock = InitJobLock(common.BuildShardLockKey(job.Namespace, job.Name, planTime, shardIndex), int64(G_config.JobLockTtl), jobMgr.store)
+	jobLock.retainTtl = common.BuildShardLockRetain(job, planTime)
 	return
 }
@@ -1,32 +1,146 @@
 package worker
 
 import (
-	"context"
-	"github.com/mongodb/mongo-go-driver/mongo"
-	"github.com/mongodb/mongo-go-driver/mongo/clientopt"
+	"fmt"
 	"github.com/staryjie/crontab/common"
+	"sync/atomic"
 	"time"
 )
 
-// mongodb存储日志
+// 批量存储日志, 日志存储由配置决定
 type LogSink struct {
-	client         *mongo.Client
-	logCollection  *mongo.Collection
+	store          common.LogStore
 	logChan        chan *common.JobLog
 	autoCommitChan chan *common.LogBatch
+	batchChan      chan *common.LogBatch // 待写入存储的批次, 由单独的协程写入, 存储变慢时不阻塞日志收集
+
+	spool     *LogSpool     // 写入失败或排队已满的日志暂存到磁盘, 为nil表示不启用
+	spoolChan chan struct{} // 有新的批次落盘时通知重放协程
+
+	// 计数(原子操作)
+	spooled int64 // 落盘的日志条数
+	dropped int64 // 丢弃的日志条数
+	flushed int64 // 从磁盘重放成功的日志条数
 }
 
 var (
 	G_logSink *LogSink
 )
 
-// 批量写入日志
+// 批量写入日志, 写入失败时落盘等待重放
 func (logSink *LogSink) saveLogs(batch *common.LogBatch) {
-	logSink.logCollection.InsertMany(context.TODO(), batch.Logs)
-	// TODO: 日志写入失败不是特别关心，如果需要关注是否写入成功，待实现
+	var (
+		pending int64
+		err     error
+	)
+	// 磁盘上还有没重放的批次时直接落盘, 保证日志按顺序写入
+	if logSink.spool != nil {
+		pending, _ = logSink.spool.Pending()
+	}
+	if pending == 0 {
+		if err = logSink.store.Append(batch.Logs); err == nil {
+			return
+		}
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "日志写入失败:", err)
+	}
+	logSink.spoolLogs(batch.Logs)
+}
+
+// 日志落盘等待重放, 没有启用落盘或落盘失败时丢弃
+func (logSink *LogSink) spoolLogs(logs []*common.JobLog) {
+	var (
+		err error
+	)
+	if logSink.spool == nil {
+		atomic.AddInt64(&logSink.dropped, int64(len(logs)))
+		return
+	}
+	if err = logSink.spool.Write(logs); err != nil {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "日志落盘失败，丢弃", len(logs), "条日志:", err)
+		atomic.AddInt64(&logSink.dropped, int64(len(logs)))
+		return
+	}
+	atomic.AddInt64(&logSink.spooled, int64(len(logs)))
+
+	// 唤醒重放协程
+	select {
+	case logSink.spoolChan <- struct{}{}:
+	default:
+	}
+}
+
+// 重放协程: 按写入顺序把落盘的批次写入存储, 失败时指数退避重试
+func (logSink *LogSink) flushLoop() {
+	var (
+		path    string
+		logs    []*common.JobLog
+		backoff time.Duration
+		err     error
+	)
+	backoff = common.LOG_SPOOL_RETRY_MIN * time.Millisecond
+	for {
+		if path, logs, err = logSink.spool.Oldest(); err != nil {
+			goto RETRY
+		}
+		// 没有待重放的批次, 等待新的批次落盘
+		if path == "" {
+			<-logSink.spoolChan
+			continue
+		}
+		if len(logs) != 0 {
+			if err = logSink.store.Append(logs); err != nil {
+				goto RETRY
+			}
+		}
+		if err = logSink.spool.Remove(path); err != nil {
+			goto RETRY
+		}
+		atomic.AddInt64(&logSink.flushed, int64(len(logs)))
+		backoff = common.LOG_SPOOL_RETRY_MIN * time.Millisecond
+		continue
+
+	RETRY:
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "日志重放失败，", backoff, "后重试:", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > common.LOG_SPOOL_RETRY_MAX*time.Millisecond {
+			backoff = common.LOG_SPOOL_RETRY_MAX * time.Millisecond
+		}
+	}
+}
+
+// 日志计数, 随注册信息上报
+func (logSink *LogSink) Stats() (stats *common.LogSinkStats) {
+	stats = &common.LogSinkStats{
+		Spooled: atomic.LoadInt64(&logSink.spooled),
+		Dropped: atomic.LoadInt64(&logSink.dropped),
+		Flushed: atomic.LoadInt64(&logSink.flushed),
+	}
+	if logSink.spool != nil {
+		stats.Pending, stats.SpoolSize = logSink.spool.Pending()
+	}
+	return
 }
 
-// 日志存储协程
+// 把批次交给写入协程, 写入协程跟不上时直接落盘
+func (logSink *LogSink) commitBatch(batch *common.LogBatch) {
+	select {
+	case logSink.batchChan <- batch:
+	default:
+		logSink.spoolLogs(batch.Logs)
+	}
+}
+
+// 写入协程: 把批次写入存储, 写入失败时落盘
+func (logSink *LogSink) storeLoop() {
+	var (
+		batch *common.LogBatch
+	)
+	for batch = range logSink.batchChan {
+		logSink.saveLogs(batch)
+	}
+}
+
+// 日志收集协程, 按批次大小或超时打包
 func (logSink *LogSink) writeLoop() {
 	var (
 		log          *common.JobLog
@@ -53,10 +167,10 @@ func (logSink *LogSink) writeLoop() {
 			// 把新日志追加到批次中
 			logBatch.Logs = append(logBatch.Logs, log)
 
-			// 如果该批次满了，立即将日志写入到MongoDB
+			// 如果该批次满了，立即将日志写入存储
 			if len(logBatch.Logs) >= G_config.JobLogBatchSize {
 				// 发送日志
-				logSink.saveLogs(logBatch)
+				logSink.commitBatch(logBatch)
 				// 清空logBatch
 				logBatch = nil
 				// 取消定时器
@@ -67,8 +181,8 @@ func (logSink *LogSink) writeLoop() {
 			if timeoutBatch != logBatch {
 				continue // 跳过已经被提交的批次
 			}
-			// 把过期批次写入到mongoDB
-			logSink.saveLogs(timeoutBatch)
+			// 把过期批次写入存储
+			logSink.commitBatch(timeoutBatch)
 			// 清空批次
 			logBatch = nil
 		}
@@ -77,27 +191,33 @@ func (logSink *LogSink) writeLoop() {
 
 func InitLogSink() (err error) {
 	var (
-		client *mongo.Client
+		store common.LogStore
 	)
 
-	// 连接MongoDB
-	if client, err = mongo.Connect(
-		context.TODO(),
-		G_config.MongodbUri,
-		clientopt.ConnectTimeout(time.Duration(G_config.MongodbCollectTimeout)*time.Millisecond)); err != nil {
+	// 连接日志存储
+	if store, err = common.InitLogStore(G_config.logStoreConfig()); err != nil {
 		return
 	}
 
-	// 选择db和collection
 	G_logSink = &LogSink{
-		client:         client,
-		logCollection:  client.Database(G_config.JobLogStoreDb).Collection(G_config.JobLogStoreCollection),
+		store:          store,
 		logChan:        make(chan *common.JobLog, 1000),
 		autoCommitChan: make(chan *common.LogBatch, 1000),
+		batchChan:      make(chan *common.LogBatch, common.LOG_SINK_BATCH_QUEUE),
+	}
+
+	// 启用落盘时加载上次没有重放的批次
+	if G_config.JobLogSpoolDir != "" {
+		if G_logSink.spool, err = InitLogSpool(G_config.JobLogSpoolDir, G_config.JobLogSpoolMaxSize); err != nil {
+			return
+		}
+		G_logSink.spoolChan = make(chan struct{}, 1)
+		go G_logSink.flushLoop()
 	}
 
-	// 启动一个MongoDB处理协程
+	// 启动日志收集协程和存储写入协程
 	go G_logSink.writeLoop()
+	go G_logSink.storeLoop()
 
 	return
 }
@@ -106,6 +226,7 @@ func InitLogSink() (err error) {
 func (logSink *LogSink) Append(jobLog *common.JobLog) {
 	select {
 	case logSink.logChan <- jobLog:
-	default: // 队列满了就丢弃
+	default: // 队列满了直接落盘, 没有启用落盘时丢弃
+		logSink.spoolLogs([]*common.JobLog{jobLog})
 	}
 }
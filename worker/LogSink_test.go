@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"context"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// 总是写入失败的日志存储, 记录写入次数
+type failingLogStore struct {
+	appends int64
+}
+
+func (store *failingLogStore) Append(logs []*common.JobLog) (err error) {
+	atomic.AddInt64(&store.appends, 1)
+	return common.ERR_LOG_STORE_BUSY
+}
+
+func (store *failingLogStore) Query(query *common.JobLogQuery) (logList []*common.JobLog, err error) {
+	return
+}
+
+func (store *failingLogStore) Delete(query *common.JobLogQuery) (deleted int64, err error) {
+	return
+}
+
+func (store *failingLogStore) Close(ctx context.Context) (err error) {
+	return
+}
+
+// 队列满和写入失败时日志落盘而不是丢弃, 落盘之后的批次不再尝试写入存储
+func TestLogSinkSpoolsInsteadOfDropping(t *testing.T) {
+	var (
+		dir     string
+		store   *failingLogStore
+		logSink *LogSink
+		stats   *common.LogSinkStats
+		err     error
+	)
+	if dir, err = ioutil.TempDir("", "crontab-spool"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store = &failingLogStore{}
+	logSink = &LogSink{
+		store:     store,
+		logChan:   make(chan *common.JobLog, 1),
+		batchChan: make(chan *common.LogBatch, 1),
+		spoolChan: make(chan struct{}, 1),
+	}
+	if logSink.spool, err = InitLogSpool(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 日志队列满了直接落盘
+	logSink.Append(&common.JobLog{JobName: "job1"})
+	logSink.Append(&common.JobLog{JobName: "job1"})
+	logSink.Append(&common.JobLog{JobName: "job1"})
+	if stats = logSink.Stats(); stats.Spooled != 2 || stats.Dropped != 0 {
+		t.Fatalf("队列满时应该落盘: %+v", stats)
+	}
+
+	// 批次队列满了直接落盘, 不等待写入
+	logSink.commitBatch(&common.LogBatch{Logs: []*common.JobLog{{JobName: "job2"}}})
+	logSink.commitBatch(&common.LogBatch{Logs: []*common.JobLog{{JobName: "job2"}}})
+	if stats = logSink.Stats(); stats.Spooled != 3 || len(logSink.batchChan) != 1 {
+		t.Fatalf("批次队列满时应该落盘: %+v", stats)
+	}
+
+	// 磁盘上已有待重放的日志, 新批次直接落盘, 不再尝试写入存储
+	logSink.saveLogs(<-logSink.batchChan)
+	if stats = logSink.Stats(); stats.Spooled != 4 || stats.Pending != 4 || stats.Dropped != 0 {
+		t.Fatalf("落盘计数不正确: %+v", stats)
+	}
+	if atomic.LoadInt64(&store.appends) != 0 {
+		t.Fatalf("已有落盘日志时不应该写入存储, 写入了%d次", store.appends)
+	}
+}
+
+// 没有启用落盘时队列满了丢弃并计数
+func TestLogSinkDropsWithoutSpool(t *testing.T) {
+	var (
+		logSink *LogSink
+		stats   *common.LogSinkStats
+	)
+	logSink = &LogSink{
+		store:   &failingLogStore{},
+		logChan: make(chan *common.JobLog, 1),
+	}
+	logSink.Append(&common.JobLog{JobName: "job1"})
+	logSink.Append(&common.JobLog{JobName: "job1"})
+	if stats = logSink.Stats(); stats.Dropped != 1 || stats.Spooled != 0 {
+		t.Fatalf("没有启用落盘时应该丢弃: %+v", stats)
+	}
+}
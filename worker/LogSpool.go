@@ -0,0 +1,213 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/staryjie/crontab/common"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 日志存储不可用时, 写入失败的日志批次先落盘, 恢复后按写入顺序重放
+// 每个批次一个文件 spool-{序号}.jsonl, 每行一条日志
+type LogSpool struct {
+	dir     string
+	maxSize int64 // 占用磁盘的上限, 字节
+
+	mutex     sync.Mutex
+	files     []*spoolFile // 按写入顺序
+	totalSize int64        // 所有批次文件的字节数
+	pending   int64        // 所有批次文件中的日志条数
+	seq       int64        // 下一个批次文件的序号
+}
+
+// 落盘的一个批次
+type spoolFile struct {
+	path  string
+	size  int64
+	count int64
+}
+
+// 初始化日志暂存目录, 加载上次退出时没有重放的批次
+func InitLogSpool(dir string, maxSize int) (spool *LogSpool, err error) {
+	var (
+		infos []os.FileInfo
+		info  os.FileInfo
+		name  string
+		seq   int64
+		file  *spoolFile
+	)
+	spool = &LogSpool{
+		dir:     dir,
+		maxSize: int64(maxSize) * 1024 * 1024,
+		seq:     1,
+	}
+	if spool.maxSize <= 0 {
+		spool.maxSize = common.LOG_SPOOL_MAX_SIZE * 1024 * 1024
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	// ReadDir按文件名排序, 序号定长, 文件名的顺序就是写入顺序
+	for _, info = range infos {
+		name = info.Name()
+		if !strings.HasPrefix(name, "spool-") || !strings.HasSuffix(name, ".jsonl") {
+			// 写了一半的临时文件
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(dir, name))
+			}
+			continue
+		}
+		if _, err = fmt.Sscanf(name, "spool-%d.jsonl", &seq); err != nil {
+			err = nil
+			continue
+		}
+		file = &spoolFile{path: filepath.Join(dir, name), size: info.Size()}
+		if file.count, err = countSpoolLines(file.path); err != nil {
+			return
+		}
+		spool.files = append(spool.files, file)
+		spool.totalSize += file.size
+		spool.pending += file.count
+		if seq >= spool.seq {
+			spool.seq = seq + 1
+		}
+	}
+	return
+}
+
+// 统计批次文件中的日志条数
+func countSpoolLines(path string) (count int64, err error) {
+	var (
+		content []byte
+	)
+	if content, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	count = int64(bytes.Count(content, []byte{'\n'}))
+	return
+}
+
+// 把一个批次写入磁盘, 超出磁盘上限时返回ERR_LOG_SPOOL_FULL
+func (spool *LogSpool) Write(logs []*common.JobLog) (err error) {
+	var (
+		buffer  bytes.Buffer
+		jobLog  *common.JobLog
+		line    []byte
+		path    string
+		tmpPath string
+	)
+	for _, jobLog = range logs {
+		if line, err = json.Marshal(jobLog); err != nil {
+			return
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.totalSize+int64(buffer.Len()) > spool.maxSize {
+		err = common.ERR_LOG_SPOOL_FULL
+		return
+	}
+
+	// 先写临时文件再改名, 重放时不会读到写了一半的批次
+	path = filepath.Join(spool.dir, fmt.Sprintf("spool-%020d.jsonl", spool.seq))
+	tmpPath = path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, buffer.Bytes(), 0644); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	spool.seq++
+	spool.files = append(spool.files, &spoolFile{path: path, size: int64(buffer.Len()), count: int64(len(logs))})
+	spool.totalSize += int64(buffer.Len())
+	spool.pending += int64(len(logs))
+	return
+}
+
+// 读取最早的批次, 没有时path为空; 无法解析的行跳过
+func (spool *LogSpool) Oldest() (path string, logs []*common.JobLog, err error) {
+	var (
+		file   *os.File
+		reader *bufio.Reader
+		line   []byte
+		jobLog *common.JobLog
+	)
+	spool.mutex.Lock()
+	if len(spool.files) != 0 {
+		path = spool.files[0].path
+	}
+	spool.mutex.Unlock()
+	if path == "" {
+		return
+	}
+
+	if file, err = os.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader = bufio.NewReader(file)
+	for {
+		if line, err = reader.ReadBytes('\n'); len(line) != 0 {
+			jobLog = &common.JobLog{}
+			if json.Unmarshal(line, jobLog) == nil {
+				logs = append(logs, jobLog)
+			}
+		}
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 删除已经重放的批次
+func (spool *LogSpool) Remove(path string) (err error) {
+	var (
+		index int
+		file  *spoolFile
+	)
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	for index, file = range spool.files {
+		if file.path != path {
+			continue
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		spool.files = append(spool.files[:index], spool.files[index+1:]...)
+		spool.totalSize -= file.size
+		spool.pending -= file.count
+		return
+	}
+	return
+}
+
+// 等待重放的日志条数和占用的字节数
+func (spool *LogSpool) Pending() (count int64, size int64) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	return spool.pending, spool.totalSize
+}
@@ -2,32 +2,38 @@ package worker
 
 import (
 	"context"
-	"github.com/coreos/etcd/clientv3"
+	"encoding/json"
+	"fmt"
 	"github.com/staryjie/crontab/common"
 	"net"
+	"os"
+	"runtime"
+	"strings"
 	"time"
 )
 
-// 注册到etcd节点 /cron/works/{ip}
+// 注册到 /cron/workers/{workerId}
 type Register struct {
-	client *clientv3.Client
-	kv     clientv3.KV
-	lease  clientv3.Lease
+	store common.JobStore // 注册信息写入任务存储, 随租约过期
 
-	localIP string
+	workerId      string    // 节点ID, 注册路径和分派队列都以它为准
+	advertiseAddr string    // 对外公布的地址
+	hostname      string    // 主机名
+	startTime     time.Time // 进程启动时间
 }
 
 var (
 	G_register *Register
 )
 
-// 获取本机IP
-func getLocalIP() (ipv4 string, err error) {
+// 获取本机IP, 优先选择IPv4地址，没有IPv4时选择全局单播的IPv6地址
+func getLocalIP() (ip string, err error) {
 	var (
 		addrs   []net.Addr
 		addr    net.Addr
 		ipNet   *net.IPNet // ip地址
 		isIpNet bool
+		ipv6    string
 	)
 
 	// 获取所有网卡
@@ -37,57 +43,204 @@ func getLocalIP() (ipv4 string, err error) {
 	// 获取第一个非lo网卡的IP
 	for _, addr = range addrs {
 		if ipNet, isIpNet = addr.(*net.IPNet); isIpNet && !ipNet.IP.IsLoopback() {
-			// 不考虑IPV6
 			if ipNet.IP.To4() != nil {
-				ipv4 = ipNet.IP.String()
+				ip = ipNet.IP.String()
 				return
 			}
+			// 跳过fe80::这类链路本地地址
+			if ipv6 == "" && ipNet.IP.IsGlobalUnicast() {
+				ipv6 = ipNet.IP.String()
+			}
 		}
 	}
+	if ipv6 != "" {
+		ip = ipv6
+		return
+	}
 	err = common.ERR_NO_LOCAL_IP_FOUND
 	return
 }
 
-// 注册到Etcd并自动续租
+// 确定节点ID和公布地址:
+// 节点ID: 配置的workerId > 本机IP > 主机名
+// 公布地址: 配置的advertiseAddr > 本机IP > 主机名
+// 没有配置workerId时返回主机名作为备选ID, 启动时发现本机IP已被其他worker注册(多个worker共用IP)则改用主机名
+func resolveIdentity() (workerId string, fallbackId string, advertiseAddr string, err error) {
+	var (
+		localIP  string
+		hostname string
+	)
+
+	if hostname, err = os.Hostname(); err != nil {
+		return
+	}
+	if localIP, err = getLocalIP(); err != nil {
+		// 找不到网卡IP时退化为主机名
+		localIP = hostname
+		err = nil
+	}
+
+	workerId = G_config.WorkerId
+	if workerId == "" {
+		workerId = localIP
+		if hostname != localIP && !strings.Contains(hostname, "/") {
+			fallbackId = hostname
+		}
+	}
+	advertiseAddr = G_config.AdvertiseAddr
+	if advertiseAddr == "" {
+		advertiseAddr = localIP
+	}
+
+	// 节点ID会作为etcd路径的一段
+	if strings.Contains(workerId, "/") {
+		err = common.ERR_INVALID_WORKER_ID
+	}
+	return
+}
+
+// 构造注册信息
+func (register *Register) buildWorkerInfo() (workerInfo *common.WorkerInfo) {
+	workerInfo = &common.WorkerInfo{
+		Id:        register.workerId,
+		IP:        register.advertiseAddr,
+		Labels:    G_config.Labels,
+		Running:   G_scheduler.ExecutingCount(),
+		LoadAvg:   readLoadAvg(),
+		MemFree:   readMemAvailable(),
+		UpdatedAt: time.Now().UnixNano() / 1000 / 1000,
+		State:     G_scheduler.WorkerState(),
+
+		Hostname:    register.hostname,
+		Version:     common.CRONTAB_VERSION,
+		Pid:         os.Getpid(),
+		StartTime:   register.startTime.UnixNano() / 1000 / 1000,
+		Os:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		CpuNum:      runtime.NumCPU(),
+		Capacity:    G_config.Capacity,
+		RunningJobs: G_scheduler.ExecutingJobs(),
+		Namespaces:  G_config.Namespaces,
+	}
+	workerInfo.WatchResyncs = G_jobMgr.WatchResyncs()
+	if G_logSink != nil {
+		workerInfo.LogStats = G_logSink.Stats()
+	}
+	// 排空中并且任务已经全部结束
+	workerInfo.Drained = workerInfo.State == common.WORKER_STATE_DRAINING && workerInfo.Running == 0
+	return
+}
+
+// 首次注册: 注册路径只能由本进程创建，已经存在说明有其他worker使用了相同的ID
+func (register *Register) createWorkerInfo(regKey string, leaseId int64) (err error) {
+	var (
+		regValue  []byte
+		succeeded bool
+	)
+	if regValue, err = json.Marshal(register.buildWorkerInfo()); err != nil {
+		return
+	}
+	if succeeded, err = register.store.Commit(nil, []*common.RecordWrite{
+		{Key: regKey, Value: regValue, ExpectRevision: 0, LeaseId: leaseId},
+	}); err != nil {
+		return
+	}
+	if !succeeded {
+		err = common.ERR_WORKER_ID_CONFLICT
+	}
+	return
+}
+
+// 刷新注册信息
+func (register *Register) putWorkerInfo(regKey string, leaseId int64) (err error) {
+	var (
+		regValue []byte
+	)
+	if regValue, err = json.Marshal(register.buildWorkerInfo()); err != nil {
+		return
+	}
+	_, err = register.store.Commit(nil, []*common.RecordWrite{
+		{Key: regKey, Value: regValue, ExpectRevision: common.JOB_REVISION_ANY, LeaseId: leaseId},
+	})
+	return
+}
+
+// 启动时检查节点ID是否冲突
+// 进程重启时上一次的注册可能还没过期，最多等待一个租约周期，仍然存在说明有其他worker在使用该ID
+func (register *Register) checkConflict() (err error) {
+	var (
+		regKey   string
+		record   *common.StoreRecord
+		deadline time.Time
+	)
+
+	regKey = common.JOB_WORK_DIR + register.workerId
+	deadline = time.Now().Add((common.REGISTER_WORKER_LEASE_TTL + 1) * time.Second)
+	for {
+		if record, err = register.store.GetRecord(regKey); err != nil {
+			return
+		}
+		if record == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			err = common.ERR_WORKER_ID_CONFLICT
+			return
+		}
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "节点ID已被注册，等待过期:", register.workerId)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// 注册到存储并自动续租
 func (register *Register) KeepOnLine() {
 	var (
-		regKey         string
-		leaseGrantResp *clientv3.LeaseGrantResponse
-		keepAliveChan  <-chan *clientv3.LeaseKeepAliveResponse
-		keepAliveResp  *clientv3.LeaseKeepAliveResponse
-		canCtx         context.Context
-		cancelFunc     context.CancelFunc
-		err            error
+		regKey        string
+		leaseId       int64
+		aliveChan     <-chan struct{}
+		canCtx        context.Context
+		cancelFunc    context.CancelFunc
+		refreshTicker *time.Ticker
+		err           error
 	)
 
+	// 定时刷新注册信息中的负载
+	refreshTicker = time.NewTicker(common.REGISTER_WORKER_REFRESH_INTERVAL * time.Second)
+
 	for {
 		// 注册路径
-		regKey = common.JOB_WORK_DIR + register.localIP
+		regKey = common.JOB_WORK_DIR + register.workerId
 
 		cancelFunc = nil
+		leaseId = 0
 
 		// 创建租约
-		if leaseGrantResp, err = register.lease.Grant(context.TODO(), common.REGISTER_WORKER_LEASE_TTL); err != nil {
+		if leaseId, err = register.store.GrantLease(common.REGISTER_WORKER_LEASE_TTL); err != nil {
 			goto RETRY
 		}
 
+		canCtx, cancelFunc = context.WithCancel(context.TODO())
+
 		// 自动续约
-		if keepAliveChan, err = register.lease.KeepAlive(context.TODO(), leaseGrantResp.ID); err != nil {
+		if aliveChan, err = register.store.KeepAliveLease(canCtx, leaseId); err != nil {
 			goto RETRY
 		}
 
-		canCtx, cancelFunc = context.WithCancel(context.TODO())
-
-		// 注册到Etcd
-		if _, err = register.kv.Put(canCtx, regKey, "online", clientv3.WithLease(leaseGrantResp.ID)); err != nil {
+		// 注册到存储
+		if err = register.createWorkerInfo(regKey, leaseId); err != nil {
+			if err == common.ERR_WORKER_ID_CONFLICT {
+				fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "节点ID冲突:", register.workerId)
+			}
 			goto RETRY
 		}
 
-		// 处理续租应答
+		// 续租停止时重新注册
 		for {
 			select {
-			case keepAliveResp = <-keepAliveChan:
-				if keepAliveResp == nil { // 续租失败
+			case <-aliveChan: // 续租失败
+				goto RETRY
+			case <-refreshTicker.C: // 刷新负载
+				if err = register.putWorkerInfo(regKey, leaseId); err != nil {
 					goto RETRY
 				}
 			}
@@ -98,47 +251,59 @@ func (register *Register) KeepOnLine() {
 		if cancelFunc != nil {
 			cancelFunc()
 		}
+		// 撤销旧租约，旧的注册随之删除，避免和重新注册冲突
+		if leaseId != 0 {
+			register.store.RevokeLease(leaseId)
+		}
 	}
 }
 
+// 初始化服务注册, 使用etcd任务存储
 func InitRegister() (err error) {
+	return InitRegisterWithStore(common.InitEtcdJobStore(G_etcdClient, time.Duration(G_config.EtcdDialTimeout)*time.Millisecond))
+}
+
+// 使用指定的任务存储确定节点ID并检查冲突, 进程内测试时传入内存存储
+func InitRegisterWithStore(store common.JobStore) (err error) {
 	var (
-		config  clientv3.Config
-		client  *clientv3.Client
-		kv      clientv3.KV
-		lease   clientv3.Lease
-		localIP string
+		workerId      string
+		fallbackId    string
+		advertiseAddr string
 	)
 
-	// 初始化配置
-	config = clientv3.Config{
-		Endpoints:   G_config.EtcdEndpoints,
-		DialTimeout: time.Duration(G_config.EtcdDialTimeout) * time.Millisecond,
-	}
-
-	// 建立连接
-	if client, err = clientv3.New(config); err != nil {
+	// 确定节点ID
+	if workerId, fallbackId, advertiseAddr, err = resolveIdentity(); err != nil {
 		return
 	}
 
-	// 获取本机IP
-	if localIP, err = getLocalIP(); err != nil {
-		return
+	G_register = &Register{
+		store:         store,
+		workerId:      workerId,
+		advertiseAddr: advertiseAddr,
+		startTime:     time.Now(),
 	}
+	G_register.hostname, _ = os.Hostname()
 
-	// 获取kv和lease API子集
-	kv = clientv3.NewKV(client)
-	lease = clientv3.NewLease(client)
-
-	G_register = &Register{
-		client:  client,
-		kv:      kv,
-		lease:   lease,
-		localIP: localIP,
+	// 同一个ID不能有两个worker同时在线
+	err = G_register.checkConflict()
+	// 本机IP已被其他worker使用, 改用主机名作为节点ID
+	if err == common.ERR_WORKER_ID_CONFLICT && fallbackId != "" {
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "本机IP已被其他worker注册，改用主机名作为节点ID:", fallbackId)
+		G_register.workerId = fallbackId
+		err = G_register.checkConflict()
+	}
+	if err != nil {
+		// 启用了任务快照时etcd不可用也继续启动，恢复后注册时仍会检查冲突
+		if err == common.ERR_WORKER_ID_CONFLICT || G_config.JobCacheFile == "" {
+			return
+		}
+		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), "etcd不可用，跳过节点ID检查:", err)
+		err = nil
 	}
+	return
+}
 
-	// 服务注册
+// 开始注册并续租, 注册信息包含任务管理器的状态, 必须在任务管理器初始化之后调用
+func StartRegister() {
 	go G_register.KeepOnLine()
-
-	return
 }
@@ -3,7 +3,10 @@ package worker
 import (
 	"fmt"
 	"github.com/staryjie/crontab/common"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,6 +16,10 @@ type Scheduler struct {
 	jobPlanTable      map[string]*common.JobSchedulePlan // 任务调度计划表
 	jobExecutingTable map[string]*common.JobExecuteInfo  // 任务执行表
 	jobResultChan     chan *common.JobExecuteResult      // 任务执行结果队列
+	jobDispatchChan   chan *common.JobDispatch           // master分派的执行任务队列
+	executingCount    int32                              // 正在执行的任务数(原子操作), 供服务注册上报负载
+	executingJobs     atomic.Value                       // 正在执行的任务名快照, 供服务注册上报
+	workerState       atomic.Value                       // 本节点运维状态, 封锁或排空时不再启动新任务
 }
 
 var (
@@ -24,30 +31,86 @@ func (scheduler *Scheduler) handlerJobEvent(jobEvent *common.JobEvent) {
 	var (
 		jobSchedulePlan *common.JobSchedulePlan
 		jobExecuteInfo  *common.JobExecuteInfo
-		jobExecuting    bool
 		jobExisted      bool
+		jobFullName     string
 		err             error
 	)
+	// 不同命名空间的任务可以重名
+	jobFullName = common.JobFullName(jobEvent.Job.Namespace, jobEvent.Job.Name)
 	switch jobEvent.EventType {
 	case common.JOB_EVENT_SAVE: // 更新事件
+		// 任务已停用、本节点不服务该命名空间或者标签不满足任务的选择器，不调度(任务可能是修改了选择器，需要从计划表中移除)
+		if jobEvent.Job.Disabled ||
+			!common.ServesNamespace(G_config.Namespaces, jobEvent.Job.Namespace) ||
+			!common.MatchSelector(jobEvent.Job.Selector, G_config.Labels) {
+			delete(scheduler.jobPlanTable, jobFullName)
+			return
+		}
 		if jobSchedulePlan, err = common.BuildJobSchedulePlan(jobEvent.Job); err != nil {
 			return
 		}
 		// 加入到任务调度计划表
-		scheduler.jobPlanTable[jobEvent.Job.Name] = jobSchedulePlan
+		scheduler.jobPlanTable[jobFullName] = jobSchedulePlan
 	case common.JOV_EVENT_DELETE: // 删除事件
-		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobEvent.Job.Name]; jobExisted {
-			delete(scheduler.jobPlanTable, jobEvent.Job.Name)
+		if jobSchedulePlan, jobExisted = scheduler.jobPlanTable[jobFullName]; jobExisted {
+			delete(scheduler.jobPlanTable, jobFullName)
 		}
 	case common.JOB_EVENT_KILL: // 强杀任务事件
 		// 取消Command执行
-		// 判断任务是否在执行中
-		if jobExecuteInfo, jobExecuting = scheduler.jobExecutingTable[jobEvent.Job.Name]; jobExecuting {
-			jobExecuteInfo.CancelFunc() // 取消执行
+		// 判断任务是否在执行中, master分派的分片可能在本节点同时执行多个
+		for _, jobExecuteInfo = range scheduler.jobExecutingTable {
+			if jobExecuteInfo.Job.Namespace == jobEvent.Job.Namespace && jobExecuteInfo.Job.Name == jobEvent.Job.Name {
+				jobExecuteInfo.CancelFunc() // 取消执行
+			}
 		}
 	}
 }
 
+// 执行表的key, master分派的分片任务同一节点可能分到多个分片
+func executingKey(jobExecuteInfo *common.JobExecuteInfo) string {
+	var (
+		jobFullName string
+	)
+	jobFullName = common.JobFullName(jobExecuteInfo.Job.Namespace, jobExecuteInfo.Job.Name)
+	if jobExecuteInfo.Dispatch != nil && jobExecuteInfo.Job.ExecMode == common.JOB_EXEC_MODE_SHARD {
+		return jobFullName + "/" + strconv.Itoa(jobExecuteInfo.ShardIndex)
+	}
+	return jobFullName
+}
+
+// 执行master分派的任务
+func (scheduler *Scheduler) handlerJobDispatch(dispatch *common.JobDispatch) {
+	var (
+		jobExecuteInfo *common.JobExecuteInfo
+		jobExecuting   bool
+	)
+
+	// 构建执行状态信息
+	jobExecuteInfo = common.BuildDispatchExecuteInfo(dispatch)
+
+	// 分派记录已经从队列中取走, 跳过时写一条日志说明原因, 否则这次调度没有任何记录
+	// 节点已封锁，不再启动新任务(封锁前已经分派的任务)
+	if scheduler.WorkerState() != common.WORKER_STATE_ACTIVE {
+		fmt.Println("节点已封锁，跳过本次分派", dispatch.Job.Name)
+		scheduler.skipDispatch(jobExecuteInfo, common.ERR_DISPATCH_CORDONED)
+		return
+	}
+
+	// 如果任务正在执行，则跳过本次分派
+	if _, jobExecuting = scheduler.jobExecutingTable[executingKey(jobExecuteInfo)]; jobExecuting {
+		fmt.Println("任务正在执行中，跳过本次分派", dispatch.Job.Name)
+		scheduler.skipDispatch(jobExecuteInfo, common.ERR_DISPATCH_RUNNING)
+		return
+	}
+
+	// 保存执行状态
+	scheduler.jobExecutingTable[executingKey(jobExecuteInfo)] = jobExecuteInfo
+	scheduler.updateExecuting()
+
+	fmt.Println("执行分派任务:", jobExecuteInfo.Job.Name, jobExecuteInfo.PlanTime, jobExecuteInfo.ShardIndex)
+	G_executor.ExecuteJob(jobExecuteInfo)
+}
+
 // 尝试执行任务
 func (scheduler *Scheduler) TryStartJob(jobPlan *common.JobSchedulePlan) {
 	// 调度和执行时两件事
@@ -57,8 +120,14 @@ func (scheduler *Scheduler) TryStartJob(jobPlan *common.JobSchedulePlan) {
 	)
 	// 任务执行可能要很久，但是调度很频繁，比如1分钟调度60次，单次执行要1分钟，那么只有一次能够执行，防止并发执行
 
+	// 节点已封锁，不再启动新任务
+	if scheduler.WorkerState() != common.WORKER_STATE_ACTIVE {
+		fmt.Println("节点已封锁，跳过本次调度", jobPlan.Job.Name)
+		return
+	}
+
 	// 如果任务正在执行，则跳过本次调度
-	if jobExecuteInfo, jobExecuting = scheduler.jobExecutingTable[jobPlan.Job.Name]; jobExecuting {
+	if jobExecuteInfo, jobExecuting = scheduler.jobExecutingTable[common.JobFullName(jobPlan.Job.Namespace, jobPlan.Job.Name)]; jobExecuting {
 		fmt.Println("任务正在执行中，跳过本次调度", jobPlan.Job.Name)
 		return
 	}
@@ -67,7 +136,8 @@ func (scheduler *Scheduler) TryStartJob(jobPlan *common.JobSchedulePlan) {
 	jobExecuteInfo = common.BuildJobExecuteInfo(jobPlan)
 
 	// 保存执行状态
-	scheduler.jobExecutingTable[jobPlan.Job.Name] = jobExecuteInfo
+	scheduler.jobExecutingTable[executingKey(jobExecuteInfo)] = jobExecuteInfo
+	scheduler.updateExecuting()
 
 	// 执行任务
 	fmt.Println("执行任务:", jobExecuteInfo.Job.Name, jobExecuteInfo.PlanTime, jobExecuteInfo.RealTime)
@@ -110,32 +180,62 @@ func (scheduler *Scheduler) TrySchedule() (scheduleAfer time.Duration) {
 	return
 }
 
-// 处理任务执行结果
-func (scheduler *Scheduler) handlerJobResult(jobResult *common.JobExecuteResult) {
+// 生成任务执行日志
+func buildJobLog(jobResult *common.JobExecuteResult) (jobLog *common.JobLog) {
+	jobLog = &common.JobLog{
+		Namespace:    jobResult.ExecuteInfo.Job.Namespace,
+		JobName:      jobResult.ExecuteInfo.Job.Name,
+		Command:      jobResult.ExecuteInfo.Job.Command,
+		Output:       string(jobResult.OutPut),
+		PlanTime:     jobResult.ExecuteInfo.PlanTime.UnixNano() / 1000 / 1000,
+		ScheduleTime: jobResult.ExecuteInfo.RealTime.UnixNano() / 1000 / 1000,
+		StartTime:    jobResult.StartTime.UnixNano() / 1000 / 1000,
+		EndTime:      jobResult.EndTime.UnixNano() / 1000 / 1000,
+		FencingToken: jobResult.FencingToken,
+		Worker:       G_register.workerId,
+	}
+	// 分片任务记录分片信息
+	if jobResult.ExecuteInfo.Job.ExecMode == common.JOB_EXEC_MODE_SHARD {
+		jobLog.ShardIndex = jobResult.ExecuteInfo.ShardIndex
+		jobLog.ShardTotal = jobResult.ExecuteInfo.Job.ShardTotal
+	}
+	if jobResult.Err != nil {
+		jobLog.Err = jobResult.Err.Error()
+	} else {
+		jobLog.Err = ""
+	}
+	return
+}
+
+// 跳过master分派的任务, 记录跳过的原因
+func (scheduler *Scheduler) skipDispatch(jobExecuteInfo *common.JobExecuteInfo, reason error) {
 	var (
-		jobLog *common.JobLog
+		now time.Time
 	)
-	// 删除任务执行表中的该任务
-	delete(scheduler.jobExecutingTable, jobResult.ExecuteInfo.Job.Name)
+	// 不会执行, 释放上下文
+	jobExecuteInfo.CancelFunc()
+	now = time.Now()
+	G_logSink.Append(buildJobLog(&common.JobExecuteResult{
+		ExecuteInfo:  jobExecuteInfo,
+		OutPut:       make([]byte, 0),
+		Err:          reason,
+		StartTime:    now,
+		EndTime:      now,
+		FencingToken: jobExecuteInfo.Dispatch.Revision,
+	}))
+}
 
-	// 生成任务执行日志
+// 处理任务执行结果
+func (scheduler *Scheduler) handlerJobResult(jobResult *common.JobExecuteResult) {
+	// 删除任务执行表中的该任务, 分片任务中途完成的分片只记录日志
+	if !jobResult.Partial {
+		delete(scheduler.jobExecutingTable, executingKey(jobResult.ExecuteInfo))
+		scheduler.updateExecuting()
+	}
+
+	// 生成任务执行日志, 将日志推送给日志存储
 	if jobResult.Err != common.ERR_LOCK_ALREADY_REQUIRED {
-		jobLog = &common.JobLog{
-			JobName:      jobResult.ExecuteInfo.Job.Name,
-			Command:      jobResult.ExecuteInfo.Job.Command,
-			Output:       string(jobResult.OutPut),
-			PlanTime:     jobResult.ExecuteInfo.PlanTime.UnixNano() / 1000 / 1000,
-			ScheduleTime: jobResult.ExecuteInfo.RealTime.UnixNano() / 1000 / 1000,
-			StartTime:    jobResult.StartTime.UnixNano() / 1000 / 1000,
-			EndTime:      jobResult.EndTime.UnixNano() / 1000 / 1000,
-		}
-		if jobResult.Err != nil {
-			jobLog.Err = jobResult.Err.Error()
-		} else {
-			jobLog.Err = ""
-		}
-		// 将日志推送给MongoDB
-		G_logSink.Append(jobLog)
+		G_logSink.Append(buildJobLog(jobResult))
 	}
 
 	if jobResult.Err != nil {
@@ -152,6 +252,7 @@ func (scheduler *Scheduler) scheduleLoop() {
 		scheduleAfter time.Duration
 		scheduleTimer *time.Timer
 		jobResult     *common.JobExecuteResult
+		jobDispatch   *common.JobDispatch
 	)
 
 	// 初始化计算任务调度状态执行任务
@@ -169,6 +270,8 @@ func (scheduler *Scheduler) scheduleLoop() {
 		case <-scheduleTimer.C: // 最近的任务到期
 		case jobResult = <-scheduler.jobResultChan: // 监听任务执行结果
 			scheduler.handlerJobResult(jobResult) // 处理任务执行结果
+		case jobDispatch = <-scheduler.jobDispatchChan: // master分派的任务
+			scheduler.handlerJobDispatch(jobDispatch)
 		}
 		// 调度一次任务
 		scheduleAfter = scheduler.TrySchedule()
@@ -182,6 +285,46 @@ func (scheduler *Scheduler) PushJobEvent(jobEvent *common.JobEvent) {
 	scheduler.jobEventChan <- jobEvent
 }
 
+// 任务执行表变化后更新上报用的快照
+func (scheduler *Scheduler) updateExecuting() {
+	var (
+		jobs []string
+		key  string
+	)
+	jobs = make([]string, 0, len(scheduler.jobExecutingTable))
+	for key = range scheduler.jobExecutingTable {
+		jobs = append(jobs, key)
+	}
+	sort.Strings(jobs)
+	scheduler.executingJobs.Store(jobs)
+	atomic.StoreInt32(&scheduler.executingCount, int32(len(jobs)))
+}
+
+// 正在执行的任务数
+func (scheduler *Scheduler) ExecutingCount() int {
+	return int(atomic.LoadInt32(&scheduler.executingCount))
+}
+
+// 正在执行的任务名
+func (scheduler *Scheduler) ExecutingJobs() []string {
+	return scheduler.executingJobs.Load().([]string)
+}
+
+// 修改本节点运维状态
+func (scheduler *Scheduler) SetWorkerState(state string) {
+	scheduler.workerState.Store(state)
+}
+
+// 本节点运维状态
+func (scheduler *Scheduler) WorkerState() string {
+	return scheduler.workerState.Load().(string)
+}
+
+// 推送master分派的任务
+func (scheduler *Scheduler) PushJobDispatch(jobDispatch *common.JobDispatch) {
+	scheduler.jobDispatchChan <- jobDispatch
+}
+
 // 初始化调度器
 func InitScheduler() (err error) {
 	G_scheduler = &Scheduler{
@@ -189,7 +332,10 @@ func InitScheduler() (err error) {
 		jobPlanTable:      make(map[string]*common.JobSchedulePlan),
 		jobExecutingTable: make(map[string]*common.JobExecuteInfo),
 		jobResultChan:     make(chan *common.JobExecuteResult, 1000),
+		jobDispatchChan:   make(chan *common.JobDispatch, 1000),
 	}
+	G_scheduler.SetWorkerState(common.WORKER_STATE_ACTIVE)
+	G_scheduler.updateExecuting()
 	go G_scheduler.scheduleLoop()
 	return
 }
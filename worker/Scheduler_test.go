@@ -0,0 +1,321 @@
+package worker
+
+import (
+	"context"
+	"github.com/staryjie/crontab/common"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 第一次监听任务前写入超过事件上限的记录, 让监听的起始revision被压缩
+type compactingJobStore struct {
+	common.JobStore
+	compacted int32
+}
+
+func (store *compactingJobStore) WatchJobs(ctx context.Context, fromRevision int64) <-chan *common.JobWatchResponse {
+	var (
+		index int
+	)
+	if atomic.CompareAndSwapInt32(&store.compacted, 0, 1) {
+		// 压缩窗口内保存的任务只能通过重新同步得到
+		store.Commit([]*common.JobWrite{{
+			Namespace:      common.JOB_NAMESPACE_DEFAULT,
+			Name:           "compacted-job",
+			Job:            &common.Job{Namespace: common.JOB_NAMESPACE_DEFAULT, Name: "compacted-job", Command: "true", CronExpr: "0 0 1 1 *", Disabled: true},
+			ExpectRevision: 0,
+		}}, nil)
+		for index = 0; index <= common.MEMORY_STORE_EVENT_LIMIT; index++ {
+			store.Commit(nil, []*common.RecordWrite{common.BuildRecordPut("/cron/test/compact", []byte("x"))})
+		}
+	}
+	return store.JobStore.WatchJobs(ctx, fromRevision)
+}
+
+var (
+	testWorkerOnce  sync.Once
+	testWorkerStore *compactingJobStore
+)
+
+// 在进程内启动一个使用内存存储和文件日志的worker, 所有测试共用
+func startTestWorker(t *testing.T) *compactingJobStore {
+	testWorkerOnce.Do(func() {
+		var (
+			logDir string
+			err    error
+		)
+		if logDir, err = ioutil.TempDir("", "crontab-worker-log"); err != nil {
+			t.Fatal(err)
+		}
+		G_config = &Config{
+			EtcdDialTimeout:     1000,
+			JobLogStore:         common.LOG_STORE_FILE,
+			JobLogFileDir:       logDir,
+			JobLogBatchSize:     1,
+			JobLogCommitTimeout: 100,
+			JobLockTtl:          5,
+			JobLockLostPolicy:   common.JOB_LOCK_LOST_POLICY_KILL,
+			DispatchMode:        common.DISPATCH_MODE_WORKER,
+			JobLockFallback:     common.JOB_LOCK_FALLBACK_SKIP,
+			WorkerId:            "test-worker",
+		}
+		testWorkerStore = &compactingJobStore{JobStore: common.InitMemoryJobStore()}
+
+		if err = InitJobCache(); err != nil {
+			t.Fatal(err)
+		}
+		if err = InitLogSink(); err != nil {
+			t.Fatal(err)
+		}
+		InitExcutor()
+		InitScheduler()
+		if err = InitRegisterWithStore(testWorkerStore); err != nil {
+			t.Fatal(err)
+		}
+		InitJobMgrWithStore(testWorkerStore)
+		StartRegister()
+	})
+	if testWorkerStore == nil {
+		t.Fatal("worker启动失败")
+	}
+	return testWorkerStore
+}
+
+// 等待条件成立, 超时则测试失败
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	var (
+		deadline time.Time
+	)
+	deadline = time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 保存一个每秒执行的任务
+func saveTestJob(t *testing.T, store common.JobStore, name string, command string) {
+	var (
+		succeeded bool
+		err       error
+	)
+	if succeeded, err = store.Commit([]*common.JobWrite{{
+		Namespace:      common.JOB_NAMESPACE_DEFAULT,
+		Name:           name,
+		Job:            &common.Job{Namespace: common.JOB_NAMESPACE_DEFAULT, Name: name, Command: command, CronExpr: "* * * * * * *"},
+		ExpectRevision: 0,
+	}}, nil); err != nil || !succeeded {
+		t.Fatalf("保存任务失败: %v %v", succeeded, err)
+	}
+}
+
+// 删除任务
+func deleteTestJob(t *testing.T, store common.JobStore, name string) {
+	if _, err := store.Commit([]*common.JobWrite{{
+		Namespace:      common.JOB_NAMESPACE_DEFAULT,
+		Name:           name,
+		ExpectRevision: common.JOB_REVISION_ANY,
+	}}, nil); err != nil {
+		t.Fatalf("删除任务失败: %v", err)
+	}
+}
+
+// 查询任务日志
+func queryTestLogs(name string) (logList []*common.JobLog) {
+	logList, _ = G_logSink.store.Query(&common.JobLogQuery{Namespace: common.JOB_NAMESPACE_DEFAULT, JobName: name})
+	return
+}
+
+// 正在执行的任务中是否有它
+func isExecuting(name string) bool {
+	var (
+		jobName string
+	)
+	for _, jobName = range G_scheduler.ExecutingJobs() {
+		if jobName == common.JobFullName(common.JOB_NAMESPACE_DEFAULT, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 节点通过租约注册到任务存储
+func TestRegisterOnMemoryStore(t *testing.T) {
+	var (
+		store *compactingJobStore
+	)
+	store = startTestWorker(t)
+	waitFor(t, 5*time.Second, "节点注册", func() bool {
+		record, err := store.GetRecord(common.JOB_WORK_DIR + "test-worker")
+		return err == nil && record != nil
+	})
+}
+
+// 保存的任务被监听到并执行, 执行日志写入日志存储; 删除后不再执行
+func TestSchedulerRunsSavedJob(t *testing.T) {
+	var (
+		store   *compactingJobStore
+		logList []*common.JobLog
+		count   int
+	)
+	store = startTestWorker(t)
+	saveTestJob(t, store, "echo-job", "echo hello")
+
+	waitFor(t, 10*time.Second, "任务执行日志", func() bool {
+		logList = queryTestLogs("echo-job")
+		return len(logList) > 0
+	})
+	if !strings.Contains(logList[0].Output, "hello") || logList[0].Err != "" {
+		t.Fatalf("执行结果不正确: %+v", logList[0])
+	}
+
+	// 删除后等正在执行的一次结束, 之后日志条数不再增加
+	deleteTestJob(t, store, "echo-job")
+	waitFor(t, 5*time.Second, "任务停止执行", func() bool { return !isExecuting("echo-job") })
+	time.Sleep(500 * time.Millisecond)
+	count = len(queryTestLogs("echo-job"))
+	time.Sleep(2 * time.Second)
+	if len(queryTestLogs("echo-job")) != count {
+		t.Fatal("任务删除后仍在执行")
+	}
+}
+
+// 强杀通知中断正在执行的任务
+func TestSchedulerKillsRunningJob(t *testing.T) {
+	var (
+		store   *compactingJobStore
+		logList []*common.JobLog
+		err     error
+	)
+	store = startTestWorker(t)
+	saveTestJob(t, store, "sleep-job", "sleep 30")
+	waitFor(t, 10*time.Second, "任务开始执行", func() bool { return isExecuting("sleep-job") })
+
+	// 先删除任务, 避免强杀后再次被调度
+	deleteTestJob(t, store, "sleep-job")
+	if err = store.KillJob(common.JOB_NAMESPACE_DEFAULT, "sleep-job"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "任务被强杀", func() bool { return !isExecuting("sleep-job") })
+	waitFor(t, 5*time.Second, "强杀日志", func() bool {
+		logList = queryTestLogs("sleep-job")
+		return len(logList) > 0
+	})
+	if logList[0].Err == "" || logList[0].EndTime-logList[0].StartTime >= 30*1000 {
+		t.Fatalf("任务没有被强杀: %+v", logList[0])
+	}
+}
+
+// 监听的revision被压缩后重新全量同步, 压缩窗口内保存的任务进入本地快照
+func TestWatchResyncAfterCompaction(t *testing.T) {
+	startTestWorker(t)
+	waitFor(t, 10*time.Second, "压缩后重新同步", func() bool { return G_jobMgr.WatchResyncs().Jobs >= 1 })
+	waitFor(t, 5*time.Second, "任务快照更新", func() bool {
+		for _, job := range G_jobCache.Jobs() {
+			if job.Name == "compacted-job" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// 同一个任务的锁只有一个worker能抢到, 释放后其他worker才能抢到且令牌递增
+func TestJobLockContentionOnMemoryStore(t *testing.T) {
+	var (
+		store   common.JobStore
+		locks   []*JobLock
+		errs    []error
+		wg      sync.WaitGroup
+		index   int
+		winner  int
+		token   int64
+		lockKey string
+	)
+	store = common.InitMemoryJobStore()
+	defer store.Close()
+	lockKey = common.BuildJobLockKey(common.JOB_NAMESPACE_DEFAULT, "contended")
+
+	locks = make([]*JobLock, 5)
+	errs = make([]error, len(locks))
+	for index = range locks {
+		locks[index] = InitJobLock(lockKey, 5, store)
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			errs[index] = locks[index].TryLock()
+		}(index)
+	}
+	wg.Wait()
+
+	winner = -1
+	for index = range locks {
+		switch errs[index] {
+		case nil:
+			if winner != -1 {
+				t.Fatalf("锁被%d和%d同时持有", winner, index)
+			}
+			winner = index
+		case common.ERR_LOCK_ALREADY_REQUIRED:
+		default:
+			t.Fatalf("抢锁出错: %v", errs[index])
+		}
+	}
+	if winner == -1 {
+		t.Fatal("没有人抢到锁")
+	}
+	token = locks[winner].FencingToken()
+
+	// 释放后其他worker重新抢锁
+	locks[winner].Unlock()
+	index = (winner + 1) % len(locks)
+	locks[index] = InitJobLock(lockKey, 5, store)
+	if errs[index] = locks[index].TryLock(); errs[index] != nil {
+		t.Fatalf("释放后重新抢锁失败: %v", errs[index])
+	}
+	defer locks[index].Unlock()
+	if locks[index].FencingToken() <= token {
+		t.Fatalf("栅栏令牌没有递增: %d, 之前为%d", locks[index].FencingToken(), token)
+	}
+}
+
+// 监听到的任务变化合并后定时写入快照文件
+func TestJobCacheFlushesCoalescedChanges(t *testing.T) {
+	var (
+		cacheFile *os.File
+		jobCache  *JobCache
+		reloaded  *JobCache
+		name      string
+		err       error
+	)
+	if cacheFile, err = ioutil.TempFile("", "crontab-job-cache"); err != nil {
+		t.Fatal(err)
+	}
+	cacheFile.Close()
+	defer os.Remove(cacheFile.Name())
+
+	jobCache = &JobCache{filePath: cacheFile.Name(), snapshot: &JobSnapshot{Jobs: make(map[string]*common.Job)}}
+	for _, name = range []string{"cache-job-1", "cache-job-2", "cache-job-3"} {
+		jobCache.Put(&common.Job{Namespace: common.JOB_NAMESPACE_DEFAULT, Name: name}, 10)
+	}
+	jobCache.Delete(common.JOB_NAMESPACE_DEFAULT, "cache-job-2", 11)
+
+	// 修改只在内存中, Flush之后才写入文件
+	reloaded = &JobCache{filePath: cacheFile.Name(), snapshot: &JobSnapshot{Jobs: make(map[string]*common.Job)}}
+	if err = reloaded.load(); err == nil && len(reloaded.snapshot.Jobs) != 0 {
+		t.Fatalf("Flush之前不应该写入快照文件: %d", len(reloaded.snapshot.Jobs))
+	}
+	if err = jobCache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloaded.load(); err != nil || len(reloaded.Jobs()) != 2 || reloaded.Revision() != 11 {
+		t.Fatalf("快照文件内容不正确: %+v %v", reloaded.snapshot, err)
+	}
+}
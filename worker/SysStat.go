@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 读取1分钟平均负载, 非Linux系统返回0
+func readLoadAvg() (loadAvg float64) {
+	var (
+		content []byte
+		fields  []string
+		err     error
+	)
+	if content, err = ioutil.ReadFile("/proc/loadavg"); err != nil {
+		return
+	}
+	// 0.52 0.58 0.59 1/467 12345
+	if fields = strings.Fields(string(content)); len(fields) == 0 {
+		return
+	}
+	loadAvg, _ = strconv.ParseFloat(fields[0], 64)
+	return
+}
+
+// 读取可用内存(字节), 非Linux系统返回0
+func readMemAvailable() (memAvailable uint64) {
+	var (
+		file    *os.File
+		scanner *bufio.Scanner
+		fields  []string
+		kb      uint64
+		err     error
+	)
+	if file, err = os.Open("/proc/meminfo"); err != nil {
+		return
+	}
+	defer file.Close()
+
+	// MemAvailable:    8123456 kB
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields = strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			if kb, err = strconv.ParseUint(fields[1], 10, 64); err == nil {
+				memAvailable = kb * 1024
+			}
+			return
+		}
+	}
+	return
+}
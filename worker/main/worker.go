@@ -39,8 +39,13 @@ func main() {
 		goto ERR
 	}
 
-	// 服务注册
-	if err = worker.InitRegister(); err != nil {
+	// 建立etcd连接
+	if err = worker.InitEtcdClient(); err != nil {
+		goto ERR
+	}
+
+	// 加载本地任务快照
+	if err = worker.InitJobCache(); err != nil {
 		goto ERR
 	}
 
@@ -59,11 +64,19 @@ func main() {
 		goto ERR
 	}
 
+	// 确定节点ID并检查冲突, 任务管理器按节点ID监听运维状态和分派队列
+	if err = worker.InitRegister(); err != nil {
+		goto ERR
+	}
+
 	// 初始化任务管理器
 	if err = worker.InitJobMgr(); err != nil {
 		goto ERR
 	}
 
+	// 服务注册, 需要上报调度器的负载和任务管理器的状态
+	worker.StartRegister()
+
 	// 正常退出
 	// 测试使用，保证主进程不退出
 	for {